@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// httpRequestPayload is the httpRequest field of a Cloud Logging
+// LogEntry, which the console shows as a request.
+type httpRequestPayload struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestURL    string `json:"requestUrl"`
+	RequestSize   string `json:"requestSize,omitempty"`
+	Status        int    `json:"status"`
+	ResponseSize  string `json:"responseSize"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp"`
+	Referer       string `json:"referer,omitempty"`
+	Latency       string `json:"latency"`
+	Protocol      string `json:"protocol"`
+}
+
+// structuredEntry is a line of the structured logging format the
+// logging agents of GKE and Cloud Run turn into a LogEntry.
+type structuredEntry struct {
+	Time        time.Time           `json:"time"`
+	Severity    string              `json:"severity"`
+	HTTPRequest *httpRequestPayload `json:"httpRequest"`
+	Trace       string              `json:"logging.googleapis.com/trace,omitempty"`
+	SpanID      string              `json:"logging.googleapis.com/spanId,omitempty"`
+	Labels      map[string]string   `json:"logging.googleapis.com/labels,omitempty"`
+}
+
+// accessLogHandler logs every request with its httpRequest, its trace
+// and its request labels, either as entries of the proxy log in Cloud
+// Logging, or as structured logging lines to w. The URLs are scrubbed.
+// It must be wrapped by ochttp.Handler for the entries to link to the
+// traces.
+type accessLogHandler struct {
+	cl      *cloudLogger // if nil, w is written to
+	project string       // of the traces written to w
+	scrub   *scrubber
+	handler http.Handler
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (h *accessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	h.handler.ServeHTTP(sw, r)
+
+	req := &httpRequestPayload{
+		RequestMethod: r.Method,
+		RequestURL:    h.scrub.Scrub(r.URL.String()),
+		Status:        sw.Status(),
+		ResponseSize:  strconv.FormatInt(sw.size, 10),
+		UserAgent:     r.UserAgent(),
+		RemoteIP:      clientIP(r),
+		Referer:       r.Referer(),
+		Latency:       fmt.Sprintf("%.9fs", time.Since(start).Seconds()),
+		Protocol:      r.Proto,
+	}
+	if r.ContentLength > 0 {
+		req.RequestSize = strconv.FormatInt(r.ContentLength, 10)
+	}
+	severity := "INFO"
+	switch {
+	case req.Status >= 500:
+		severity = "ERROR"
+	case req.Status >= 400:
+		severity = "WARNING"
+	}
+	var traceID, spanID string
+	if span := trace.FromContext(r.Context()); span != nil {
+		sc := span.SpanContext()
+		traceID, spanID = sc.TraceID.String(), sc.SpanID.String()
+	}
+	labels := labelsFromContext(r.Context())
+
+	if h.cl != nil {
+		e := logEntry{
+			Timestamp:   start,
+			Severity:    severity,
+			SpanID:      spanID,
+			Labels:      labels,
+			HTTPRequest: req,
+		}
+		if traceID != "" {
+			e.Trace = "projects/" + h.cl.project + "/traces/" + traceID
+		}
+		h.cl.Add(e)
+		return
+	}
+	e := structuredEntry{
+		Time:        start,
+		Severity:    severity,
+		HTTPRequest: req,
+		SpanID:      spanID,
+		Labels:      labels,
+	}
+	if traceID != "" {
+		e.Trace = traceID
+		if h.project != "" {
+			e.Trace = "projects/" + h.project + "/traces/" + traceID
+		}
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.w.Write(append(b, '\n'))
+}
+
+// serverErrorHandler logs the 5xx responses as errors, with the trace
+// of the request, so that they are reported to Error Reporting. The
+// URLs are scrubbed.
+type serverErrorHandler struct {
+	scrub   *scrubber
+	handler http.Handler
+}
+
+func (h *serverErrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &statusWriter{ResponseWriter: w}
+	h.handler.ServeHTTP(sw, r)
+	if status := sw.Status(); status >= 500 {
+		requestLogf(r.Context(), "ERROR: %v %v responded %d %v", r.Method, h.scrub.Scrub(r.URL.Path), status, http.StatusText(status))
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// newACMEManager returns the manager obtaining and renewing the
+// certificates of domains from the ACME CA at directory, Let's Encrypt
+// if empty, with the TLS-ALPN-01 challenge. The certificates and the
+// account key are kept in cache, a directory or the Secret Manager
+// secrets of a project, projects/<project>. The CA and Secret Manager
+// are reached with base.
+func newACMEManager(ctx context.Context, domains []string, cache, email, directory string, base http.RoundTripper) (*autocert.Manager, error) {
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("no domain")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      email,
+		Client: &acme.Client{
+			DirectoryURL: directory,
+			HTTPClient:   &http.Client{Transport: base, Timeout: 2 * time.Minute},
+		},
+	}
+	switch {
+	case cache == "":
+		return nil, fmt.Errorf("no cache, the certificates would be requested again on every start")
+	case strings.HasPrefix(cache, "projects/"):
+		c, err := newSecretCache(ctx, cache, base)
+		if err != nil {
+			return nil, err
+		}
+		m.Cache = c
+	default:
+		m.Cache = autocert.DirCache(cache)
+	}
+	return m, nil
+}
+
+// acmeTLSConfig returns the TLS config serving the certificates of m,
+// and answering its TLS-ALPN-01 challenges with a config of its own:
+// the CA presents no client certificate, whatever -client-ca requires.
+func acmeTLSConfig(m *autocert.Manager) *tls.Config {
+	challenge := &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+				return challenge, nil
+			}
+			return nil, nil
+		},
+		NextProtos: []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+// secretCache is an autocert.Cache keeping the entries in the Secret
+// Manager secrets of a project, shared by the replicas of the proxy.
+// An entry is the latest version of the secret acme-<escaped key>.
+type secretCache struct {
+	client  *http.Client
+	project string // projects/<project>
+}
+
+func newSecretCache(ctx context.Context, project string, base http.RoundTripper) (*secretCache, error) {
+	if strings.Count(project, "/") != 1 || strings.HasSuffix(project, "/") {
+		return nil, fmt.Errorf("%q is not projects/<project>", project)
+	}
+	ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, err
+	}
+	return &secretCache{
+		client: &http.Client{
+			Transport: &oauth2.Transport{Source: ts, Base: base},
+			Timeout:   time.Minute,
+		},
+		project: project,
+	}, nil
+}
+
+// secretID escapes key, e.g. example.com+rsa, into a secret ID, which
+// is limited to letters, digits, - and _.
+func secretID(key string) string {
+	var b strings.Builder
+	b.WriteString("acme-")
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+func (c *secretCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := accessSecret(ctx, c.client, c.project+"/secrets/"+secretID(key)+"/versions/latest")
+	if err == errSecretNotFound {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (c *secretCache) Put(ctx context.Context, key string, data []byte) error {
+	id := secretID(key)
+	err := c.call(ctx, "POST", c.project+"/secrets?secretId="+id, map[string]interface{}{
+		"replication": map[string]interface{}{"automatic": map[string]interface{}{}},
+		"labels":      map[string]string{"managed-by": "stackdriver-reverse-proxy"},
+	}, http.StatusConflict)
+	if err != nil {
+		return err
+	}
+	return c.call(ctx, "POST", c.project+"/secrets/"+id+":addVersion", map[string]interface{}{
+		"payload": map[string]string{"data": base64.StdEncoding.EncodeToString(data)},
+	})
+}
+
+func (c *secretCache) Delete(ctx context.Context, key string) error {
+	return c.call(ctx, "DELETE", c.project+"/secrets/"+secretID(key), nil, http.StatusNotFound)
+}
+
+// call sends body to the Secret Manager resource, the statuses in
+// accepted succeeding as well as 200.
+func (c *secretCache) call(ctx context.Context, method, resource string, body interface{}, accepted ...int) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, secretManagerURL+resource, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	for _, s := range accepted {
+		if resp.StatusCode == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v %v: %v", method, resource, resp.Status)
+}
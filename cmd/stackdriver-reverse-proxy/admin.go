@@ -0,0 +1,83 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// adminPrincipal is the audited principal of the admin API calls,
+// which are authenticated with a shared token.
+const adminPrincipal = "admin-token"
+
+// adminServer serves the admin API on its own listener. Every call
+// must carry the admin token as a bearer token and is audit logged.
+type adminServer struct {
+	token []byte
+	audit *auditLogger
+	mux   *http.ServeMux
+}
+
+func newAdminServer(token []byte, audit *auditLogger) *adminServer {
+	return &adminServer{
+		token: token,
+		audit: audit,
+		mux:   http.NewServeMux(),
+	}
+}
+
+// Handle registers an authenticated admin endpoint. Calls are
+// audit logged as method.
+func (a *adminServer) Handle(pattern, method string, h http.Handler) {
+	a.mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		a.audit.LogRequest(r, adminPrincipal, method, r.URL.Path, queryFields(r))
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// HandleProbe registers an endpoint of the health probes, which
+// can't carry the token. Its calls are neither authenticated nor
+// audit logged.
+func (a *adminServer) HandleProbe(pattern string, h http.Handler) {
+	a.mux.Handle(pattern, h)
+}
+
+func (a *adminServer) authorized(r *http.Request) bool {
+	token := bearerToken(r, "Authorization")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), a.token) == 1
+}
+
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// queryFields returns the query parameters of r as audit log fields.
+func queryFields(r *http.Request) map[string]interface{} {
+	q := r.URL.Query()
+	if len(q) == 0 {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(q))
+	for k := range q {
+		fields[k] = q.Get(k)
+	}
+	return fields
+}
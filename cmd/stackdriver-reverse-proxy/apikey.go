@@ -0,0 +1,60 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+)
+
+// apiKeyVerifier rejects with 401 the requests without one of the API
+// keys in their header. The requests are identified by the name of
+// their key, as apikey:<name>.
+type apiKeyVerifier struct {
+	header  string
+	keys    map[[sha256.Size]byte]string // names by key digest
+	handler http.Handler
+}
+
+// newAPIKeyVerifier returns a verifier of the keys, by name. The keys
+// are looked up by digest, so that the lookup time doesn't depend on
+// how much of a guessed key matches.
+func newAPIKeyVerifier(header string, keys map[string]string, h http.Handler) *apiKeyVerifier {
+	v := &apiKeyVerifier{
+		header:  header,
+		keys:    make(map[[sha256.Size]byte]string, len(keys)),
+		handler: h,
+	}
+	for name, key := range keys {
+		v.keys[sha256.Sum256([]byte(key))] = name
+	}
+	return v
+}
+
+func (v *apiKeyVerifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get(v.header)
+	if key == "" {
+		recordRejection(r.Context(), "api_key_missing")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	name, ok := v.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		recordRejection(r.Context(), "api_key_invalid")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	v.handler.ServeHTTP(w, withVerifiedIdentity(r, "apikey:"+name))
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// auditEntry is a JSON log entry shaped after Cloud Audit Logs,
+// so the entries can be ingested and queried the same way.
+type auditEntry struct {
+	Timestamp    time.Time      `json:"timestamp"`
+	Severity     string         `json:"severity"`
+	LogName      string         `json:"logName"`
+	ProtoPayload auditLogRecord `json:"protoPayload"`
+}
+
+type auditLogRecord struct {
+	Type               string                  `json:"@type"`
+	ServiceName        string                  `json:"serviceName"`
+	MethodName         string                  `json:"methodName"`
+	ResourceName       string                  `json:"resourceName,omitempty"`
+	AuthenticationInfo auditAuthenticationInfo `json:"authenticationInfo"`
+	RequestMetadata    auditRequestMetadata    `json:"requestMetadata"`
+	Request            map[string]interface{}  `json:"request,omitempty"`
+}
+
+type auditAuthenticationInfo struct {
+	PrincipalEmail string `json:"principalEmail,omitempty"`
+}
+
+type auditRequestMetadata struct {
+	CallerIP                string `json:"callerIp,omitempty"`
+	CallerSuppliedUserAgent string `json:"callerSuppliedUserAgent,omitempty"`
+}
+
+// auditLogger writes one JSON audit entry per line.
+// The request details and user agents are scrubbed, the principals
+// are kept since they are the point of an audit log.
+type auditLogger struct {
+	scrub *scrubber
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newAuditLogger(w io.Writer, s *scrubber) *auditLogger {
+	return &auditLogger{w: w, scrub: s}
+}
+
+// LogRequest records an action triggered by an HTTP request,
+// such as an admin API call.
+func (l *auditLogger) LogRequest(r *http.Request, principal, method, resource string, req map[string]interface{}) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	l.log(auditLogRecord{
+		MethodName:         method,
+		ResourceName:       resource,
+		AuthenticationInfo: auditAuthenticationInfo{PrincipalEmail: principal},
+		RequestMetadata: auditRequestMetadata{
+			CallerIP:                host,
+			CallerSuppliedUserAgent: r.UserAgent(),
+		},
+		Request: req,
+	})
+}
+
+// LogLocal records an action triggered from the host the proxy is
+// running on, such as a flag change or a signal.
+func (l *auditLogger) LogLocal(method, resource string, req map[string]interface{}) {
+	var principal string
+	if u, err := user.Current(); err == nil {
+		principal = u.Username
+	}
+	hostname, _ := os.Hostname()
+	l.log(auditLogRecord{
+		MethodName:         method,
+		ResourceName:       resource,
+		AuthenticationInfo: auditAuthenticationInfo{PrincipalEmail: principal},
+		RequestMetadata:    auditRequestMetadata{CallerIP: hostname},
+		Request:            req,
+	})
+}
+
+// LogMessage records an action triggered by a message received from
+// principal on resource, such as a control command.
+func (l *auditLogger) LogMessage(principal, method, resource string, req map[string]interface{}) {
+	l.log(auditLogRecord{
+		MethodName:         method,
+		ResourceName:       resource,
+		AuthenticationInfo: auditAuthenticationInfo{PrincipalEmail: principal},
+		Request:            req,
+	})
+}
+
+func (l *auditLogger) log(rec auditLogRecord) {
+	rec.Type = "type.googleapis.com/google.cloud.audit.AuditLog"
+	rec.ServiceName = "stackdriver-reverse-proxy"
+	rec.RequestMetadata.CallerSuppliedUserAgent = l.scrub.Scrub(rec.RequestMetadata.CallerSuppliedUserAgent)
+	rec.Request = l.scrub.ScrubFields(rec.Request)
+	b, err := json.Marshal(auditEntry{
+		Timestamp:    time.Now().UTC(),
+		Severity:     "NOTICE",
+		LogName:      "stackdriver-reverse-proxy/audit",
+		ProtoPayload: rec,
+	})
+	if err != nil {
+		log.Printf("Cannot encode audit log entry: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		log.Printf("Cannot write audit log entry: %v", err)
+	}
+}
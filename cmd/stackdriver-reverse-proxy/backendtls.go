@@ -0,0 +1,63 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// loadCAPool returns the pool of the PEM certificates of the file at
+// path.
+func loadCAPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificate in %v", path)
+	}
+	return pool, nil
+}
+
+// withClientCert makes c present the certificate of the certFile and
+// keyFile files to the backends, reloaded by r when they change, e.g.
+// when rotated by a certificate manager.
+func withClientCert(c *tls.Config, r *configReloader, certFile, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return errors.New("both a certificate and a key are needed")
+	}
+	var cert atomic.Value
+	err := r.Watch("-target-tls-cert", []string{certFile, keyFile}, func(data [][]byte) error {
+		c, err := tls.X509KeyPair(data[0], data[1])
+		if err != nil {
+			return err
+		}
+		cert.Store(&c)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return cert.Load().(*tls.Certificate), nil
+	}
+	return nil
+}
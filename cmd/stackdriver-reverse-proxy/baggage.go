@@ -0,0 +1,110 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// baggageHeader is the W3C Baggage header. It is forwarded to the
+// backend like the other headers.
+const baggageHeader = "Baggage"
+
+// baggageMember is a list member of a W3C Baggage header.
+type baggageMember struct {
+	key   string
+	value string
+
+	// raw is the member as received, with its properties.
+	raw string
+}
+
+// parseBaggage returns the list members of the baggage headers.
+// Malformed members are ignored.
+func parseBaggage(headers []string) []baggageMember {
+	var members []baggageMember
+	for _, h := range headers {
+		for _, raw := range splitList(h) {
+			kv := raw
+			if i := strings.Index(kv, ";"); i >= 0 {
+				kv = kv[:i]
+			}
+			i := strings.Index(kv, "=")
+			if i < 1 {
+				continue
+			}
+			value, err := url.PathUnescape(strings.TrimSpace(kv[i+1:]))
+			if err != nil {
+				continue
+			}
+			members = append(members, baggageMember{
+				key:   strings.TrimSpace(kv[:i]),
+				value: value,
+				raw:   raw,
+			})
+		}
+	}
+	return members
+}
+
+// baggageLabel is the label name for the named baggage key.
+func baggageLabel(key string) string {
+	return "baggage." + key
+}
+
+// baggageHandler labels requests with selected entries of their
+// baggage, and sets entries in the baggage forwarded to the backend.
+type baggageHandler struct {
+	keys    []string
+	set     map[string]string
+	handler http.Handler
+}
+
+func (h *baggageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	members := parseBaggage(r.Header[baggageHeader])
+	if len(h.keys) > 0 {
+		labels := make(map[string]string, len(h.keys))
+		for _, m := range members {
+			for _, k := range h.keys {
+				if m.key == k {
+					labels[baggageLabel(k)] = m.value
+				}
+			}
+		}
+		for _, k := range h.keys {
+			if v, ok := h.set[k]; ok {
+				labels[baggageLabel(k)] = v
+			}
+		}
+		if len(labels) > 0 {
+			r = r.WithContext(withLabels(r.Context(), labels))
+		}
+	}
+	if len(h.set) > 0 {
+		var list []string
+		for _, m := range members {
+			if _, ok := h.set[m.key]; !ok {
+				list = append(list, m.raw)
+			}
+		}
+		for k, v := range h.set {
+			list = append(list, k+"="+url.PathEscape(v))
+		}
+		r.Header.Set(baggageHeader, strings.Join(list, ","))
+	}
+	h.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"go.opencensus.io/trace"
+)
+
+// balancerPolicies are the load balancing policies by name.
+var balancerPolicies = map[string]bool{
+	"round-robin":       true,
+	"least-connections": true,
+}
+
+// balancerHandler spreads the requests across targets, in turn with
+// the round-robin policy, or to the target with the fewest requests
+// in flight with the least-connections one. The server span of each
+// request is labeled with the target serving it as backend.target.
+type balancerHandler struct {
+	targets          []*url.URL
+	proxies          []http.Handler
+	leastConnections bool
+
+	next uint32 // atomic
+
+	mu       sync.Mutex
+	inFlight []int
+}
+
+func newBalancerHandler(targets []*url.URL, newProxy func(*url.URL) http.Handler, policy string) (*balancerHandler, error) {
+	if !balancerPolicies[policy] {
+		return nil, fmt.Errorf("unknown policy %q, want round-robin or least-connections", policy)
+	}
+	h := &balancerHandler{
+		targets:          targets,
+		leastConnections: policy == "least-connections",
+		inFlight:         make([]int, len(targets)),
+	}
+	for _, u := range targets {
+		h.proxies = append(h.proxies, newProxy(u))
+	}
+	return h, nil
+}
+
+// pick returns the target of the next request, counted in flight
+// until done is called.
+func (h *balancerHandler) pick() (i int, done func()) {
+	n := atomic.AddUint32(&h.next, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i = int(n % uint32(len(h.targets)))
+	if h.leastConnections {
+		// Ties are broken in turn from i.
+		best := i
+		for k := 1; k < len(h.targets); k++ {
+			j := (i + k) % len(h.targets)
+			if h.inFlight[j] < h.inFlight[best] {
+				best = j
+			}
+		}
+		i = best
+	}
+	h.inFlight[i]++
+	return i, func() {
+		h.mu.Lock()
+		h.inFlight[i]--
+		h.mu.Unlock()
+	}
+}
+
+// statuszRows returns the statusz rows of the requests in flight per
+// target.
+func (h *balancerHandler) statuszRows() []statuszRow {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rows := make([]statuszRow, len(h.targets))
+	for i, u := range h.targets {
+		rows[i] = statuszRow{name: "In flight to " + u.String(), value: h.inFlight[i]}
+	}
+	return rows
+}
+
+func (h *balancerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i, done := h.pick()
+	defer done()
+	if span := trace.FromContext(r.Context()); span != nil {
+		span.SetAttributes(trace.StringAttribute("backend.target", h.targets[i].Host))
+	}
+	h.proxies[i].ServeHTTP(w, r)
+}
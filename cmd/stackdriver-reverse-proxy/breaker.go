@@ -0,0 +1,232 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// States of the circuit breakers.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// circuitBreaker stops sending requests to a backend host after
+// failures consecutive failures, for openTimeout. Then a single probe
+// request is let through: its success closes the circuit, its failure
+// opens it again.
+type circuitBreaker struct {
+	host        string
+	failures    int
+	openTimeout time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failed   int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a request can be sent, and if not, how long
+// the circuit stays open.
+func (b *circuitBreaker) allow(ctx context.Context, now time.Time) (ok bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.openedAt.Add(b.openTimeout).Sub(now); wait > 0 {
+			return false, wait
+		}
+		b.transition(ctx, breakerHalfOpen)
+		b.probing = true
+		return true, 0
+	case breakerHalfOpen:
+		if b.probing {
+			return false, time.Second
+		}
+		b.probing = true
+	}
+	return true, 0
+}
+
+// done records the outcome of a request let through.
+func (b *circuitBreaker) done(ctx context.Context, now time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == breakerHalfOpen && failed:
+		b.probing = false
+		b.openedAt = now
+		b.transition(ctx, breakerOpen)
+	case b.state == breakerHalfOpen:
+		b.probing = false
+		b.failed = 0
+		b.transition(ctx, breakerClosed)
+	case b.state == breakerClosed && failed:
+		b.failed++
+		if b.failed >= b.failures {
+			b.openedAt = now
+			b.transition(ctx, breakerOpen)
+		}
+	case b.state == breakerClosed:
+		b.failed = 0
+	}
+}
+
+// release lets another probe through if the one let through was
+// canceled.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// transition changes the state, annotating the span of the request
+// causing it. b.mu must be held.
+func (b *circuitBreaker) transition(ctx context.Context, state string) {
+	from := b.state
+	b.state = state
+	if state == breakerOpen {
+		log.Printf("ERROR: Circuit breaker of %v opened for %v", b.host, b.openTimeout)
+	} else {
+		log.Printf("Circuit breaker of %v is %v", b.host, strings.Replace(state, "_", "-", 1))
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		span.Annotate([]trace.Attribute{
+			trace.StringAttribute("breaker.from", from),
+			trace.StringAttribute("breaker.to", state),
+		}, "Circuit breaker of "+b.host+" is "+state)
+	}
+	recordBreakerTransition(b.host, state)
+}
+
+// breakerTransport fails fast with 503 the requests to the backend
+// hosts whose circuit breaker is open. Transport errors, timeouts
+// included, and 5xx responses count as failures.
+type breakerTransport struct {
+	breakers *breakerSet
+	base     http.RoundTripper
+}
+
+// breakerSet has the circuit breakers of the backend hosts, shared by
+// its transports, e.g. of the HTTP and gRPC requests to a host.
+type breakerSet struct {
+	failures    int
+	openTimeout time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newBreakerSet(failures int, openTimeout time.Duration) *breakerSet {
+	return &breakerSet{
+		failures:    failures,
+		openTimeout: openTimeout,
+		breakers:    make(map[string]*circuitBreaker),
+	}
+}
+
+// transport returns a transport sending the requests with base
+// through the breakers.
+func (t *breakerSet) transport(base http.RoundTripper) *breakerTransport {
+	return &breakerTransport{breakers: t, base: base}
+}
+
+func (t *breakerSet) breaker(host string) *circuitBreaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		b = &circuitBreaker{
+			host:        host,
+			failures:    t.failures,
+			openTimeout: t.openTimeout,
+			state:       breakerClosed,
+		}
+		t.breakers[host] = b
+	}
+	return b
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	b := t.breakers.breaker(req.URL.Host)
+	if ok, retryAfter := b.allow(ctx, time.Now()); !ok {
+		recordRejection(ctx, "circuit_open")
+		if span := trace.FromContext(ctx); span != nil {
+			span.Annotate(nil, "Circuit breaker of "+b.host+" is open")
+		}
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		resp := errorResponse(req, http.StatusServiceUnavailable)
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return resp, nil
+	}
+	resp, err := t.base.RoundTrip(req)
+	// Requests canceled by their client don't tell about the backend.
+	if ctx.Err() == context.Canceled {
+		b.release()
+	} else {
+		b.done(ctx, time.Now(), err != nil || resp.StatusCode >= 500)
+	}
+	return resp, err
+}
+
+// statuszRows returns the statusz rows of the state of the breakers.
+func (t *breakerSet) statuszRows() []statuszRow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var hosts []string
+	for host := range t.breakers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	rows := make([]statuszRow, len(hosts))
+	for i, host := range hosts {
+		b := t.breakers[host]
+		b.mu.Lock()
+		rows[i] = statuszRow{name: "Circuit breaker of " + host, value: b.state}
+		b.mu.Unlock()
+	}
+	return rows
+}
+
+// recordBreakerTransition counts a transition of the breaker of the
+// backend host to state.
+func recordBreakerTransition(host, state string) {
+	ctx, err := tag.New(context.Background(),
+		tag.Upsert(hostKey, tagValue(host)),
+		tag.Upsert(stateKey, state),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, breakerTransitions.M(1))
+}
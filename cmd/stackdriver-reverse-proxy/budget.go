@@ -0,0 +1,82 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// latencyBudgets are the latency budgets of routes.
+type latencyBudgets struct {
+	routes  []string
+	budgets []time.Duration
+}
+
+// parseLatencyBudgets parses route=duration items,
+// e.g. /api/=200ms.
+func parseLatencyBudgets(items []string) (*latencyBudgets, error) {
+	b := &latencyBudgets{}
+	for _, item := range items {
+		route, v, err := splitPair(item)
+		if err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid budget for %v: %v", route, err)
+		}
+		b.routes = append(b.routes, routePrefix(route))
+		b.budgets = append(b.budgets, d)
+	}
+	return b, nil
+}
+
+// budgetHandler warns about the requests exceeding the latency
+// budget of their route. It must be installed inside ochttp.Handler
+// for the annotations.
+type budgetHandler struct {
+	budgets  *latencyBudgets
+	backend  string
+	annotate bool
+	handler  http.Handler
+}
+
+func (h *budgetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i := matchRoute(h.budgets.routes, r.URL.Path)
+	if i < 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	start := time.Now()
+	h.handler.ServeHTTP(w, r)
+	latency := time.Since(start)
+	budget := h.budgets.budgets[i]
+	if latency <= budget {
+		return
+	}
+	requestLogf(r.Context(), "WARNING: %v %v took %v, over the %v budget of %v, backend %v",
+		r.Method, r.URL.Path, latency, budget, h.budgets.routes[i], h.backend)
+	if h.annotate {
+		trace.FromContext(r.Context()).Annotate([]trace.Attribute{
+			trace.StringAttribute("budget", budget.String()),
+			trace.StringAttribute("latency", latency.String()),
+			trace.StringAttribute("backend", h.backend),
+		}, "Latency budget exceeded")
+	}
+}
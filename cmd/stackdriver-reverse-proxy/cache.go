@@ -0,0 +1,410 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheMaxEntryBytes is the size of the largest response body cached.
+const cacheMaxEntryBytes = 1 << 20
+
+// cacheControl is the Cache-Control of a response, with the
+// stale-while-revalidate and stale-if-error extensions of RFC 5861.
+type cacheControl struct {
+	noStore              bool
+	noCache              bool
+	private              bool
+	maxAge               time.Duration
+	hasMaxAge            bool
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+}
+
+func parseCacheControl(v string) cacheControl {
+	var cc cacheControl
+	for _, d := range strings.Split(v, ",") {
+		name, value := strings.ToLower(strings.TrimSpace(d)), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], strings.Trim(name[i+1:], `"`)
+		}
+		seconds := func() time.Duration {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return 0
+			}
+			return time.Duration(n) * time.Second
+		}
+		switch name {
+		case "no-store":
+			cc.noStore = true
+		case "no-cache":
+			cc.noCache = true
+		case "private":
+			cc.private = true
+		case "max-age":
+			if !cc.hasMaxAge {
+				cc.maxAge, cc.hasMaxAge = seconds(), true
+			}
+		case "s-maxage":
+			// Overrides max-age in shared caches.
+			cc.maxAge, cc.hasMaxAge = seconds(), true
+		case "stale-while-revalidate":
+			cc.staleWhileRevalidate = seconds()
+		case "stale-if-error":
+			cc.staleIfError = seconds()
+		}
+	}
+	return cc
+}
+
+// cachedResponse is a response kept by the cache.
+type cachedResponse struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+	cc     cacheControl
+
+	refreshing bool // a background revalidation is in progress
+}
+
+func (c *cachedResponse) age(now time.Time) time.Duration {
+	return now.Sub(c.stored)
+}
+
+func (c *cachedResponse) fresh(now time.Time) bool {
+	return !c.cc.noCache && c.age(now) < c.cc.maxAge
+}
+
+func (c *cachedResponse) size() int64 {
+	return int64(len(c.body) + len(c.key))
+}
+
+// bufferWriter buffers a response.
+type bufferWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *bufferWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// teeWriter writes the response to the client and keeps a copy of up
+// to cacheMaxEntryBytes of its body.
+type teeWriter struct {
+	*statusWriter
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	if !w.truncated {
+		if w.body.Len()+len(b) > cacheMaxEntryBytes {
+			w.truncated = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.statusWriter.Write(b)
+}
+
+// cacheHandler serves the GET and HEAD requests from an in-memory LRU
+// cache of the responses fresh per their Cache-Control. Stale
+// responses are revalidated with If-None-Match and If-Modified-Since,
+// or served while revalidated in the background within their
+// stale-while-revalidate, or when the backend fails within their
+// stale-if-error. Requests with credentials and responses with Vary
+// or Set-Cookie are not cached. The X-Cache response header is HIT,
+// MISS, STALE or REVALIDATED.
+type cacheHandler struct {
+	maxBytes int64
+	handler  http.Handler
+
+	mu      sync.Mutex
+	lru     *list.List // of *cachedResponse, most recent first
+	entries map[string]*list.Element
+	size    int64
+}
+
+func newCacheHandler(maxBytes int64, h http.Handler) *cacheHandler {
+	return &cacheHandler{
+		maxBytes: maxBytes,
+		handler:  h,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// cacheable reports whether the response to r may be served from
+// the cache.
+func cacheable(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	for _, h := range []string{"Authorization", "Cookie", "Upgrade"} {
+		if r.Header.Get(h) != "" {
+			return false
+		}
+	}
+	return !parseCacheControl(r.Header.Get("Cache-Control")).noStore
+}
+
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !cacheable(r) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	key := cacheKey(r)
+	now := time.Now()
+	c := h.get(key)
+	switch {
+	case c == nil:
+		h.miss(w, r, key)
+	case c.fresh(now):
+		recordCacheLookup(r.Context(), "hit")
+		h.serve(w, r, c, "HIT")
+	case c.age(now) < c.cc.maxAge+c.cc.staleWhileRevalidate && !c.cc.noCache:
+		recordCacheLookup(r.Context(), "stale")
+		h.refresh(c, r)
+		h.serve(w, r, c, "STALE")
+	default:
+		h.revalidate(w, r, c)
+	}
+}
+
+// miss proxies the request, caching the response if allowed.
+func (h *cacheHandler) miss(w http.ResponseWriter, r *http.Request, key string) {
+	recordCacheLookup(r.Context(), "miss")
+	// The headers set by the outer handlers belong to this request.
+	outer := make(map[string]bool, len(w.Header()))
+	for k := range w.Header() {
+		outer[k] = true
+	}
+	w.Header().Set("X-Cache", "MISS")
+	tw := &teeWriter{statusWriter: &statusWriter{ResponseWriter: w}}
+	h.handler.ServeHTTP(tw, r)
+	if tw.truncated || r.Method != "GET" {
+		return
+	}
+	header := cloneHeader(w.Header())
+	for k := range outer {
+		header.Del(k)
+	}
+	h.store(key, tw.Status(), header, tw.body.Bytes(), time.Now())
+}
+
+// revalidate sends the conditional request of the stale c, and serves
+// c if it is not modified, or the new response.
+func (h *cacheHandler) revalidate(w http.ResponseWriter, r *http.Request, c *cachedResponse) {
+	bw := h.fetch(r, c)
+	switch {
+	case bw.status == http.StatusNotModified:
+		recordCacheLookup(r.Context(), "revalidated")
+		c = h.update(c, bw.header)
+		h.serve(w, r, c, "REVALIDATED")
+		return
+	case bw.status >= 500 && c.age(time.Now()) < c.cc.maxAge+c.cc.staleIfError:
+		recordCacheLookup(r.Context(), "stale_if_error")
+		h.serve(w, r, c, "STALE")
+		return
+	}
+	recordCacheLookup(r.Context(), "miss")
+	if r.Method == "GET" {
+		h.store(c.key, bw.status, bw.header, bw.body.Bytes(), time.Now())
+	}
+	for k, vv := range bw.header {
+		w.Header()[k] = vv
+	}
+	w.Header().Set("X-Cache", "MISS")
+	w.WriteHeader(bw.status)
+	w.Write(bw.body.Bytes())
+}
+
+// refresh revalidates c in the background, once at a time.
+func (h *cacheHandler) refresh(c *cachedResponse, r *http.Request) {
+	h.mu.Lock()
+	if c.refreshing {
+		h.mu.Unlock()
+		return
+	}
+	c.refreshing = true
+	h.mu.Unlock()
+	// The refresh outlives the request.
+	r = r.WithContext(context.Background())
+	go func() {
+		// c stays cached when the new response is not, it may be
+		// refreshed again.
+		defer func() {
+			h.mu.Lock()
+			c.refreshing = false
+			h.mu.Unlock()
+		}()
+		bw := h.fetch(r, c)
+		switch {
+		case bw.status == http.StatusNotModified:
+			h.update(c, bw.header)
+		case bw.status < 500:
+			h.store(c.key, bw.status, bw.header, bw.body.Bytes(), time.Now())
+		default:
+			log.Printf("WARNING: Cannot refresh the cached %v: status %d", c.key, bw.status)
+		}
+	}()
+}
+
+// fetch sends the request conditional on the validators of c.
+func (h *cacheHandler) fetch(r *http.Request, c *cachedResponse) *bufferWriter {
+	cr := new(http.Request)
+	*cr = *r
+	cr.Method = "GET"
+	cr.Header = make(http.Header, len(r.Header)+2)
+	for k, vv := range r.Header {
+		cr.Header[k] = vv
+	}
+	cr.Header.Del("If-None-Match")
+	cr.Header.Del("If-Modified-Since")
+	if etag := c.header.Get("ETag"); etag != "" {
+		cr.Header.Set("If-None-Match", etag)
+	}
+	if lm := c.header.Get("Last-Modified"); lm != "" {
+		cr.Header.Set("If-Modified-Since", lm)
+	}
+	bw := &bufferWriter{header: make(http.Header)}
+	h.handler.ServeHTTP(bw, cr)
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	return bw
+}
+
+// serve writes c, or 304 if it matches the validators of r.
+func (h *cacheHandler) serve(w http.ResponseWriter, r *http.Request, c *cachedResponse, result string) {
+	for k, vv := range c.header {
+		w.Header()[k] = vv
+	}
+	w.Header().Set("Age", strconv.Itoa(int(c.age(time.Now()).Seconds())))
+	w.Header().Set("X-Cache", result)
+	if etag := c.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(c.status)
+	if r.Method != "HEAD" {
+		w.Write(c.body)
+	}
+}
+
+func (h *cacheHandler) get(key string) *cachedResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.entries[key]
+	if !ok {
+		return nil
+	}
+	h.lru.MoveToFront(e)
+	return e.Value.(*cachedResponse)
+}
+
+// store caches the response if its status and Cache-Control allow,
+// evicting the least recently used ones over the size of the cache.
+func (h *cacheHandler) store(key string, status int, header http.Header, body []byte, now time.Time) {
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	switch {
+	case status != http.StatusOK && status != http.StatusNotFound && status != http.StatusMovedPermanently:
+		return
+	case cc.noStore || cc.private || !cc.hasMaxAge:
+		return
+	case header.Get("Vary") != "" || header.Get("Set-Cookie") != "":
+		return
+	}
+	c := &cachedResponse{
+		key:    key,
+		status: status,
+		header: cloneHeader(header),
+		body:   append([]byte(nil), body...),
+		stored: now,
+		cc:     cc,
+	}
+	c.header.Del("X-Cache")
+	if c.size() > h.maxBytes {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e, ok := h.entries[key]; ok {
+		h.size -= e.Value.(*cachedResponse).size()
+		h.lru.Remove(e)
+	}
+	h.entries[key] = h.lru.PushFront(c)
+	h.size += c.size()
+	for h.size > h.maxBytes {
+		e := h.lru.Back()
+		old := e.Value.(*cachedResponse)
+		h.lru.Remove(e)
+		delete(h.entries, old.key)
+		h.size -= old.size()
+	}
+}
+
+// update refreshes c with the headers of a 304 response to its
+// revalidation, and returns the new entry.
+func (h *cacheHandler) update(c *cachedResponse, header http.Header) *cachedResponse {
+	merged := cloneHeader(c.header)
+	for k, vv := range header {
+		merged[k] = vv
+	}
+	h.store(c.key, c.status, merged, c.body, time.Now())
+	if n := h.get(c.key); n != nil {
+		return n
+	}
+	return c
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, vv := range h {
+		c[k] = append([]string(nil), vv...)
+	}
+	return c
+}
@@ -0,0 +1,246 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testBackend serves the responses queued on it, one per request,
+// and sends the requests it receives on reqs.
+type testBackend struct {
+	responses chan func(w http.ResponseWriter)
+	reqs      chan *http.Request
+}
+
+func newTestBackend() *testBackend {
+	return &testBackend{
+		responses: make(chan func(w http.ResponseWriter), 10),
+		reqs:      make(chan *http.Request, 10),
+	}
+}
+
+func (b *testBackend) respond(status int, cacheControl, etag, body string) {
+	b.responses <- func(w http.ResponseWriter) {
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func (b *testBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.reqs <- r
+	select {
+	case f := <-b.responses:
+		f(w)
+	default:
+		http.Error(w, "unexpected request", http.StatusTeapot)
+	}
+}
+
+// wait returns the next request received by b.
+func (b *testBackend) wait(t *testing.T) *http.Request {
+	t.Helper()
+	select {
+	case r := <-b.reqs:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received by the backend")
+		return nil
+	}
+}
+
+// assertNoRequest fails if b received a request.
+func (b *testBackend) assertNoRequest(t *testing.T) {
+	t.Helper()
+	select {
+	case r := <-b.reqs:
+		t.Fatalf("unexpected backend request %v %v", r.Method, r.URL)
+	default:
+	}
+}
+
+func cacheGet(t *testing.T, h http.Handler, header http.Header, wantCache string, wantStatus int, wantBody string) {
+	t.Helper()
+	r := httptest.NewRequest("GET", "http://example.com/a", nil)
+	for k, vv := range header {
+		r.Header[k] = vv
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("X-Cache"); got != wantCache {
+		t.Errorf("X-Cache = %q, want %q", got, wantCache)
+	}
+	if w.Code != wantStatus || w.Body.String() != wantBody {
+		t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), wantStatus, wantBody)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	b := newTestBackend()
+	h := newCacheHandler(1<<20, b)
+	b.respond(200, "max-age=60", "", "v1")
+	cacheGet(t, h, nil, "MISS", 200, "v1")
+	b.wait(t)
+	cacheGet(t, h, nil, "HIT", 200, "v1")
+	b.assertNoRequest(t)
+
+	// Requests with credentials bypass the cache.
+	b.respond(200, "max-age=60", "", "private")
+	cacheGet(t, h, http.Header{"Authorization": {"Bearer x"}}, "", 200, "private")
+	b.wait(t)
+}
+
+func TestCacheNotStored(t *testing.T) {
+	for _, cc := range []string{"", "no-store, max-age=60", "private, max-age=60"} {
+		b := newTestBackend()
+		h := newCacheHandler(1<<20, b)
+		b.respond(200, cc, "", "v1")
+		cacheGet(t, h, nil, "MISS", 200, "v1")
+		b.wait(t)
+		b.respond(200, cc, "", "v2")
+		cacheGet(t, h, nil, "MISS", 200, "v2")
+		b.wait(t)
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	b := newTestBackend()
+	h := newCacheHandler(1<<20, b)
+	b.respond(200, "max-age=0", `"e1"`, "v1")
+	cacheGet(t, h, nil, "MISS", 200, "v1")
+	b.wait(t)
+
+	b.respond(304, "max-age=0", `"e1"`, "")
+	cacheGet(t, h, nil, "REVALIDATED", 200, "v1")
+	if got := b.wait(t).Header.Get("If-None-Match"); got != `"e1"` {
+		t.Errorf("If-None-Match = %q, want %q", got, `"e1"`)
+	}
+
+	b.respond(200, "max-age=0", `"e2"`, "v2")
+	cacheGet(t, h, nil, "MISS", 200, "v2")
+	b.wait(t)
+	b.respond(304, "max-age=0", `"e2"`, "")
+	cacheGet(t, h, nil, "REVALIDATED", 200, "v2")
+	if got := b.wait(t).Header.Get("If-None-Match"); got != `"e2"` {
+		t.Errorf("If-None-Match = %q, want %q", got, `"e2"`)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	b := newTestBackend()
+	h := newCacheHandler(1<<20, b)
+	b.respond(200, "max-age=0, stale-if-error=60", "", "v1")
+	cacheGet(t, h, nil, "MISS", 200, "v1")
+	b.wait(t)
+	b.respond(503, "", "", "down")
+	cacheGet(t, h, nil, "STALE", 200, "v1")
+	b.wait(t)
+
+	// Without stale-if-error, the error is served.
+	b = newTestBackend()
+	h = newCacheHandler(1<<20, b)
+	b.respond(200, "max-age=0", "", "v1")
+	cacheGet(t, h, nil, "MISS", 200, "v1")
+	b.wait(t)
+	b.respond(503, "", "", "down")
+	cacheGet(t, h, nil, "MISS", 503, "down")
+	b.wait(t)
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	b := newTestBackend()
+	h := newCacheHandler(1<<20, b)
+	const cc = "max-age=0, stale-while-revalidate=60"
+	b.respond(200, cc, "", "v1")
+	cacheGet(t, h, nil, "MISS", 200, "v1")
+	b.wait(t)
+
+	// The stale response is served while refreshed in the background.
+	b.respond(200, cc, "", "v2")
+	cacheGet(t, h, nil, "STALE", 200, "v1")
+	b.wait(t)
+	waitRefreshed(t, h)
+	cacheGet(t, h, nil, "STALE", 200, "v2")
+	b.wait(t)
+	waitRefreshed(t, h)
+}
+
+// TestCacheRefreshNotStored checks that a refresh whose response is
+// not cached, or fails, does not block the later refreshes.
+func TestCacheRefreshNotStored(t *testing.T) {
+	b := newTestBackend()
+	h := newCacheHandler(1<<20, b)
+	b.respond(200, "max-age=0, stale-while-revalidate=60", "", "v1")
+	cacheGet(t, h, nil, "MISS", 200, "v1")
+	b.wait(t)
+
+	for _, status := range []int{200, 500, 200} {
+		b.respond(status, "no-store", "", "uncached")
+		cacheGet(t, h, nil, "STALE", 200, "v1")
+		b.wait(t)
+		waitRefreshed(t, h)
+	}
+}
+
+// waitRefreshed waits for the background refresh of the entry of h.
+func waitRefreshed(t *testing.T, h *cacheHandler) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.Lock()
+		refreshing := false
+		for e := h.lru.Front(); e != nil; e = e.Next() {
+			refreshing = refreshing || e.Value.(*cachedResponse).refreshing
+		}
+		h.mu.Unlock()
+		if !refreshing {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("refresh still in progress")
+}
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		in   string
+		want cacheControl
+	}{
+		{"", cacheControl{}},
+		{"no-store", cacheControl{noStore: true}},
+		{"No-Cache, private", cacheControl{noCache: true, private: true}},
+		{"max-age=60", cacheControl{maxAge: time.Minute, hasMaxAge: true}},
+		{`max-age="60"`, cacheControl{maxAge: time.Minute, hasMaxAge: true}},
+		{"max-age=60, max-age=10", cacheControl{maxAge: time.Minute, hasMaxAge: true}},
+		{"s-maxage=10, max-age=60", cacheControl{maxAge: 10 * time.Second, hasMaxAge: true}},
+		{"max-age=-1", cacheControl{hasMaxAge: true}},
+		{"max-age=x", cacheControl{hasMaxAge: true}},
+		{"stale-while-revalidate=30, stale-if-error=600", cacheControl{staleWhileRevalidate: 30 * time.Second, staleIfError: 10 * time.Minute}},
+	}
+	for _, tt := range tests {
+		if got := parseCacheControl(tt.in); got != tt.want {
+			t.Errorf("parseCacheControl(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
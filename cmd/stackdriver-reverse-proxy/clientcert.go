@@ -0,0 +1,47 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"go.opencensus.io/trace"
+)
+
+// clientAuth returns how the listener authenticates the clients with
+// certificates: required, or verified when presented.
+func clientAuth(require bool) tls.ClientAuthType {
+	if require {
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.VerifyClientCertIfGiven
+}
+
+// clientCertSpanHandler labels the server span of the requests with
+// the subject of the verified client certificate as
+// tls.client.subject. It must be installed inside ochttp.Handler.
+type clientCertSpanHandler struct {
+	handler http.Handler
+}
+
+func (h *clientCertSpanHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		trace.FromContext(r.Context()).SetAttributes(
+			trace.StringAttribute("tls.client.subject", r.TLS.VerifiedChains[0][0].Subject.String()),
+		)
+	}
+	h.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,330 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"go.opencensus.io/trace"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// loggingAPIEndpoint is the default host:port of the Cloud
+	// Logging API.
+	loggingAPIEndpoint = "logging.googleapis.com:443"
+
+	// logBatchSize is the number of entries written at once.
+	logBatchSize = 100
+
+	// logBufferSize is the number of entries kept while Cloud Logging
+	// is unreachable. Newer entries are dropped.
+	logBufferSize = 10000
+)
+
+// logEntry is a Cloud Logging LogEntry.
+type logEntry struct {
+	Timestamp   time.Time         `json:"timestamp"`
+	Severity    string            `json:"severity"`
+	Trace       string            `json:"trace,omitempty"`
+	SpanID      string            `json:"spanId,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	TextPayload string            `json:"textPayload,omitempty"`
+	JSONPayload json.RawMessage   `json:"jsonPayload,omitempty"`
+
+	HTTPRequest *httpRequestPayload `json:"httpRequest,omitempty"`
+}
+
+// reportedErrorEvent is the payload of the log entries ingested by
+// Error Reporting.
+type reportedErrorEvent struct {
+	Type           string `json:"@type"`
+	Message        string `json:"message"`
+	ServiceContext struct {
+		Service string `json:"service"`
+		Version string `json:"version"`
+	} `json:"serviceContext"`
+}
+
+// requestLogf logs like log.Printf, followed by the request labels
+// of ctx as key=value fields and by the trace and span IDs of the span
+// of ctx if any, so that the entries written to Cloud Logging, and the
+// errors reported from them, link to the trace.
+func requestLogf(ctx context.Context, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	labels := labelsFromContext(ctx)
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		msg += fmt.Sprintf(" %v=%q", k, labels[k])
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		sc := span.SpanContext()
+		msg += fmt.Sprintf(" trace=%v span=%v", sc.TraceID, sc.SpanID)
+	}
+	log.Print(msg)
+}
+
+// digits are replaced in the messages grouped by errorGroup.
+var digits = regexp.MustCompile(`[0-9]+`)
+
+// errorGroup returns a hint identifying the errors with the same
+// message except for numbers, such as addresses and durations.
+func errorGroup(msg string) string {
+	h := fnv.New64a()
+	h.Write([]byte(digits.ReplaceAllString(msg, "0")))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// monitoredResource is the resource the proxy logs are attached to.
+type monitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// cloudLogger is the writer of the standard logger shipping the
+// proxy logs to Cloud Logging in batches, for environments without
+// a logging agent.
+type cloudLogger struct {
+	client   *http.Client
+	url      string // of the entries:write method
+	project  string
+	logName  string
+	resource monitoredResource
+	labels   map[string]string
+
+	// service and version are the service context of the errors
+	// reported.
+	service string
+	version string
+
+	mu      sync.Mutex
+	entries []logEntry
+
+	// flushMu serializes the flushes.
+	flushMu sync.Mutex
+}
+
+// newCloudLogger returns a logger writing to the log named name of
+// the project, or of the project of the default credentials if empty,
+// entries with the static labels. Cloud Logging is reached with base
+// on endpoint, by default loggingAPIEndpoint. If insecure is set, it is
+// reached over plaintext without authentication, e.g. a fake in tests.
+func newCloudLogger(ctx context.Context, project, name string, labels map[string]string, base http.RoundTripper, endpoint string, insecure bool) (*cloudLogger, error) {
+	scheme, t := "https", base
+	if insecure {
+		if endpoint == "" {
+			return nil, errors.New("an insecure export needs an endpoint")
+		}
+		scheme = "http"
+	} else {
+		creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/logging.write")
+		if err != nil {
+			return nil, err
+		}
+		if project == "" {
+			project = creds.ProjectID
+		}
+		t = &oauth2.Transport{Source: creds.TokenSource, Base: base}
+	}
+	if project == "" {
+		return nil, errors.New("no project, set -project")
+	}
+	if endpoint == "" {
+		endpoint = loggingAPIEndpoint
+	}
+	return &cloudLogger{
+		client:   &http.Client{Transport: t, Timeout: 30 * time.Second},
+		url:      scheme + "://" + endpoint + "/v2/entries:write",
+		project:  project,
+		logName:  "projects/" + project + "/logs/" + strings.Replace(name, "/", "%2F", -1),
+		resource: detectResource(project),
+		labels:   labels,
+		service:  "stackdriver-reverse-proxy",
+		version:  version,
+	}, nil
+}
+
+// detectResource returns the resource the proxy runs on: the Cloud
+// Run revision, the GCE instance, or global elsewhere.
+func detectResource(project string) monitoredResource {
+	if !metadata.OnGCE() {
+		return monitoredResource{Type: "global", Labels: map[string]string{"project_id": project}}
+	}
+	zone, _ := metadata.Zone()
+	if service := os.Getenv("K_SERVICE"); service != "" {
+		region := zone
+		if i := strings.LastIndex(zone, "-"); i > 0 {
+			region = zone[:i]
+		}
+		return monitoredResource{Type: "cloud_run_revision", Labels: map[string]string{
+			"project_id":    project,
+			"service_name":  service,
+			"revision_name": os.Getenv("K_REVISION"),
+			"location":      region,
+		}}
+	}
+	id, _ := metadata.InstanceID()
+	return monitoredResource{Type: "gce_instance", Labels: map[string]string{
+		"project_id":  project,
+		"instance_id": id,
+		"zone":        zone,
+	}}
+}
+
+// Write buffers a line written by the standard logger.
+func (l *cloudLogger) Write(p []byte) (int, error) {
+	l.Add(l.parseLogLine(string(p)))
+	return len(p), nil
+}
+
+// Add buffers the entry e.
+func (l *cloudLogger) Add(e logEntry) {
+	l.mu.Lock()
+	queued := len(l.entries) < logBufferSize
+	if queued {
+		l.entries = append(l.entries, e)
+	}
+	full := len(l.entries) >= logBatchSize
+	l.mu.Unlock()
+	if queued {
+		recordExportQueue("cloud_logging", 1)
+	} else {
+		recordExportDropped("cloud_logging")
+	}
+	if full {
+		go l.flush()
+	}
+}
+
+// parseLogLine returns the entry of a line of the standard logger.
+// Messages that are JSON objects are written as JSON payloads. Errors
+// are written as Error Reporting events labeled with their
+// error_group hint.
+func (l *cloudLogger) parseLogLine(line string) logEntry {
+	ll := parseLine(line)
+	e := logEntry{Timestamp: ll.time, Severity: ll.severity, SpanID: ll.spanID}
+	if ll.traceID != "" {
+		e.Trace = "projects/" + l.project + "/traces/" + ll.traceID
+	}
+	if ll.severity == "ERROR" {
+		ev := reportedErrorEvent{
+			Type:    "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent",
+			Message: ll.message,
+		}
+		ev.ServiceContext.Service = l.service
+		ev.ServiceContext.Version = l.version
+		if b, err := json.Marshal(ev); err == nil {
+			e.JSONPayload = b
+			e.Labels = map[string]string{"error_group": errorGroup(ev.Message)}
+			return e
+		}
+	}
+	if strings.HasPrefix(ll.message, "{") && json.Valid([]byte(ll.message)) {
+		e.JSONPayload = json.RawMessage(ll.message)
+	} else {
+		e.TextPayload = ll.message
+	}
+	return e
+}
+
+// Queued returns the number of entries buffered.
+func (l *cloudLogger) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// Run writes the buffered entries every interval.
+func (l *cloudLogger) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		l.flush()
+	}
+}
+
+// flush writes the buffered entries, in batches. The entries are
+// kept for the next flush if Cloud Logging cannot be reached.
+func (l *cloudLogger) flush() {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	start := time.Now()
+	for sent := false; ; sent = true {
+		l.mu.Lock()
+		n := len(l.entries)
+		if n > logBatchSize {
+			n = logBatchSize
+		}
+		batch := append([]logEntry(nil), l.entries[:n]...)
+		l.mu.Unlock()
+		if n == 0 {
+			if sent {
+				recordExportFlush("cloud_logging", "ok", start)
+			}
+			return
+		}
+		if err := l.write(batch); err != nil {
+			// Logging the failure would buffer more entries.
+			fmt.Fprintf(os.Stderr, "ERROR: Cannot write logs to Cloud Logging: %v\n", err)
+			recordExportFlush("cloud_logging", "error", start)
+			return
+		}
+		l.mu.Lock()
+		l.entries = l.entries[n:]
+		l.mu.Unlock()
+		recordExportQueue("cloud_logging", -n)
+	}
+}
+
+func (l *cloudLogger) write(entries []logEntry) error {
+	body, err := json.Marshal(struct {
+		LogName  string            `json:"logName"`
+		Resource monitoredResource `json:"resource"`
+		Labels   map[string]string `json:"labels,omitempty"`
+		Entries  []logEntry        `json:"entries"`
+	}{l.logName, l.resource, l.labels, entries})
+	if err != nil {
+		return err
+	}
+	resp, err := l.client.Post(l.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
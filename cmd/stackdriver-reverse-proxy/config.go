@@ -0,0 +1,239 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadConfigFile sets the flags from the file at path, except the ones
+// set on the command line. The file maps the flag names, without dash,
+// to their values, e.g.
+//
+//	target: http://localhost:6060
+//	http: :6996
+//	trace-sampling: 0.5
+//	route-max-body-bytes: /upload/*=10MB
+//	request-quota:
+//	  - alice@example.com=10000/day
+//	  - "*=1000/day"
+//
+// in YAML, or the same object in JSON if the file name ends with .json.
+// The repeated flags take a list, the others are comma-separated
+// lists when given one, e.g. target. The values are scalars or lists
+// of scalars.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values, err := parseConfig(fs, path, b)
+	if err != nil {
+		return err
+	}
+	set := setFlags(fs)
+	for name, vv := range values {
+		if set[name] {
+			continue
+		}
+		for _, v := range vv {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("%v: invalid %v: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseConfig parses the config file at path of contents b into the
+// values of the flags of fs.
+func parseConfig(fs *flag.FlagSet, path string, b []byte) (map[string][]string, error) {
+	var values map[string][]string
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		values, err = parseJSONConfig(b)
+	} else {
+		values, err = parseYAMLConfig(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, vv := range values {
+		if name == "config" {
+			return nil, fmt.Errorf("%v: config cannot be set in a config file", path)
+		}
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%v: unknown flag %q", path, name)
+		}
+		if _, repeated := fs.Lookup(name).Value.(*repeatedFlag); !repeated && len(vv) > 1 {
+			// The other lists are comma-separated.
+			values[name] = []string{strings.Join(vv, ",")}
+		}
+	}
+	return values, nil
+}
+
+// setFlags returns the names of the flags of fs set so far.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// reloadConfigFile returns the function applying the changes of the
+// config file at path to the flags of fs, for the configReloader. It
+// is first called with the file loaded by loadConfigFile. The changes
+// of the reloadable flags are parsed by their function, and applied
+// together once all parsed; the flags removed from the file are reset
+// to their default. The other changes are logged, to be applied by a
+// restart. The flags of cmdline, set on the command line, are kept.
+func reloadConfigFile(fs *flag.FlagSet, path string, cmdline map[string]bool, reloadable map[string]func(v string) (apply func(), err error)) func(data [][]byte) error {
+	var prev map[string]string
+	return func(data [][]byte) error {
+		values, err := parseConfig(fs, path, data[0])
+		if err != nil {
+			return err
+		}
+		next := make(map[string]string, len(values))
+		for name, vv := range values {
+			if !cmdline[name] {
+				next[name] = strings.Join(vv, ",")
+			}
+		}
+		if prev == nil {
+			prev = next
+			return nil
+		}
+		type change struct {
+			name, v string
+			apply   func()
+		}
+		var changes []change
+		var restart []string
+		fs.VisitAll(func(f *flag.Flag) {
+			v, ok := next[f.Name]
+			old, wasSet := prev[f.Name]
+			if ok == wasSet && v == old {
+				return
+			}
+			if !ok {
+				v = f.DefValue
+			}
+			if reloadable[f.Name] == nil {
+				restart = append(restart, f.Name)
+				return
+			}
+			changes = append(changes, change{name: f.Name, v: v})
+		})
+		for i, c := range changes {
+			apply, err := reloadable[c.name](c.v)
+			if err != nil {
+				return fmt.Errorf("invalid %v: %v", c.name, err)
+			}
+			changes[i].apply = apply
+		}
+		for _, c := range changes {
+			c.apply()
+			fs.Set(c.name, c.v)
+		}
+		if len(restart) > 0 {
+			log.Printf("WARNING: %v changed %v, applied on restart only", path, strings.Join(restart, ", "))
+		}
+		prev = next
+		return nil
+	}
+}
+
+// reloadableFlags returns the parsers of the flags applied by
+// reloadConfigFile, changing the sampler s and the kill switch k.
+func reloadableFlags(s *routeSampler, k *killSwitch) map[string]func(v string) (apply func(), err error) {
+	return map[string]func(v string) (func(), error){
+		"trace-sampling": func(v string) (func(), error) {
+			fraction, err := strconv.ParseFloat(v, 64)
+			if err != nil || fraction < 0 || fraction > 1 {
+				return nil, fmt.Errorf("%q is not between 0 and 1", v)
+			}
+			return func() { s.SetFraction(fraction) }, nil
+		},
+		"route-sampling": func(v string) (func(), error) {
+			routes, err := parseRouteSampling(0, splitList(v))
+			if err != nil {
+				return nil, err
+			}
+			return func() { s.SetRoutes(routes) }, nil
+		},
+		"disable-routes": func(v string) (func(), error) {
+			disabled, err := parseDisabledRoutes(splitList(v))
+			if err != nil {
+				return nil, err
+			}
+			return func() { k.SetRoutes(disabled) }, nil
+		},
+	}
+}
+
+func parseJSONConfig(b []byte) (map[string][]string, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var doc map[string]interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return configValues(doc)
+}
+
+// parseYAMLConfig parses a YAML config. The duplicate keys are errors.
+func parseYAMLConfig(b []byte) (map[string][]string, error) {
+	var doc map[string]interface{}
+	if err := yaml.UnmarshalStrict(b, &doc); err != nil {
+		return nil, err
+	}
+	return configValues(doc)
+}
+
+// configValues returns the values of the flags of a config document,
+// whose values are scalars or lists of scalars. A null value is an
+// empty list, e.g. a YAML list without items.
+func configValues(doc map[string]interface{}) (map[string][]string, error) {
+	values := make(map[string][]string, len(doc))
+	for name, v := range doc {
+		items, ok := v.([]interface{})
+		if !ok && v != nil {
+			items = []interface{}{v}
+		}
+		values[name] = []string{}
+		for _, item := range items {
+			switch item.(type) {
+			case string, json.Number, bool, int, int64, uint64, float64:
+				values[name] = append(values[name], fmt.Sprint(item))
+			default:
+				return nil, fmt.Errorf("%v is not a string, number, boolean or list of them", name)
+			}
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("target", "", "")
+	fs.String("http", ":6996", "")
+	fs.String("config", "", "")
+	fs.Float64("trace-sampling", 1, "")
+	fs.Bool("debug", false, "")
+	fs.Var(&repeatedFlag{}, "request-quota", "")
+	return fs
+}
+
+func TestParseYAMLConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string][]string
+	}{
+		{
+			name: "scalars",
+			in:   "target: http://localhost:6060\nhttp: :6996\ntrace-sampling: 0.5\ndebug: true\n",
+			want: map[string][]string{
+				"target":         {"http://localhost:6060"},
+				"http":           {":6996"},
+				"trace-sampling": {"0.5"},
+				"debug":          {"true"},
+			},
+		},
+		{
+			name: "exponent",
+			in:   "trace-sampling: 1e-4",
+			want: map[string][]string{"trace-sampling": {"0.0001"}},
+		},
+		{
+			name: "quoted",
+			in:   "target: \"http://a\\tb\"\nhttp: ':6996'\n",
+			want: map[string][]string{"target": {"http://a\tb"}, "http": {":6996"}},
+		},
+		{
+			name: "single quote escape",
+			in:   "target: 'it''s'",
+			want: map[string][]string{"target": {"it's"}},
+		},
+		{
+			name: "comments",
+			in:   "# proxy\n---\ntarget: http://a # the backend\n",
+			want: map[string][]string{"target": {"http://a"}},
+		},
+		{
+			name: "hash in strings",
+			in:   "target: \"http://a/#x\"\nhttp: 'a # b'\n",
+			want: map[string][]string{"target": {"http://a/#x"}, "http": {"a # b"}},
+		},
+		{
+			name: "hash in plain scalar",
+			in:   "target: http://a/#x",
+			want: map[string][]string{"target": {"http://a/#x"}},
+		},
+		{
+			name: "block list",
+			in:   "request-quota:\n  - alice@example.com=10000/day\n  - \"*=1000/day\"\n",
+			want: map[string][]string{"request-quota": {"alice@example.com=10000/day", "*=1000/day"}},
+		},
+		{
+			name: "flow list",
+			in:   "request-quota: [a=1/day, 'b=2/hour']",
+			want: map[string][]string{"request-quota": {"a=1/day", "b=2/hour"}},
+		},
+		{
+			name: "comma-joined list",
+			in:   "target: [http://a, http://b]",
+			want: map[string][]string{"target": {"http://a,http://b"}},
+		},
+		{
+			name: "empty list",
+			in:   "request-quota: []\ntarget:\n",
+			want: map[string][]string{"request-quota": {}, "target": {}},
+		},
+		{
+			name: "empty",
+			in:   "",
+			want: map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseConfig(testFlagSet(), "proxy.yaml", []byte(tt.in))
+		if err != nil {
+			t.Errorf("%v: parseConfig(%q) failed: %v", tt.name, tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: parseConfig(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAMLConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"nested map", "target:\n  url: http://a\n"},
+		{"nested list", "request-quota:\n  - [a, b]\n"},
+		{"duplicate key", "target: http://a\ntarget: http://b\n"},
+		{"unknown flag", "no-such-flag: 1"},
+		{"config", "config: other.yaml"},
+		{"unterminated quote", "target: \"http://a"},
+		{"unterminated flow list", "request-quota: [a, b"},
+		{"list item outside of a list", "- a"},
+		{"tab indentation", "request-quota:\n\t- a\n"},
+		{"alias", "target: *=1/day"},
+	}
+	for _, tt := range tests {
+		if got, err := parseConfig(testFlagSet(), "proxy.yaml", []byte(tt.in)); err == nil {
+			t.Errorf("%v: parseConfig(%q) = %q, want an error", tt.name, tt.in, got)
+		}
+	}
+}
+
+func TestParseJSONConfig(t *testing.T) {
+	in := `{"target": "http://a", "trace-sampling": 0.25, "debug": true, "request-quota": ["a=1/day", "*=2/day"]}`
+	got, err := parseConfig(testFlagSet(), "proxy.json", []byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"target":         {"http://a"},
+		"trace-sampling": {"0.25"},
+		"debug":          {"true"},
+		"request-quota":  {"a=1/day", "*=2/day"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseConfig(%q) = %q, want %q", in, got, want)
+	}
+	if got, err := parseConfig(testFlagSet(), "proxy.json", []byte(`{"target": {"url": "http://a"}}`)); err == nil {
+		t.Errorf("parseConfig of a nested object = %q, want an error", got)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// connMetricsTransport records metrics of the connections
+// made to the backend.
+type connMetricsTransport struct {
+	base http.RoundTripper
+}
+
+func (t *connMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		dnsHost  string
+		dnsStart time.Time
+		tlsStart time.Time
+	)
+	ct := &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			dnsHost, dnsStart = info.Host, time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			recordDNSLookup(dnsHost, time.Since(dnsStart), info.Err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			// Tell which of the backend addresses served the request.
+			trace.FromContext(req.Context()).SetAttributes(
+				trace.StringAttribute("backend.address", info.Conn.RemoteAddr().String()),
+			)
+			debugf("Got connection to %v for %v %v, reused=%v idle=%v", info.Conn.RemoteAddr(), req.Method, req.URL, info.Reused, info.IdleTime)
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			recordTLSHandshake("backend", state, time.Since(tlsStart), err)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), ct))
+	return t.base.RoundTrip(req)
+}
+
+// recordDNSLookup records the latency and result of a DNS lookup.
+func recordDNSLookup(host string, latency time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	ctx, terr := tag.New(context.Background(),
+		tag.Upsert(hostKey, tagValue(host)),
+		tag.Upsert(resultKey, result),
+	)
+	if terr != nil {
+		return
+	}
+	stats.Record(ctx, dnsLatency.M(float64(latency)/float64(time.Millisecond)))
+}
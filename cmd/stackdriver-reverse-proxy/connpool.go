@@ -0,0 +1,113 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/stackdriver-reverse-proxy/sproxy"
+)
+
+// connLimiter limits the connections open to each backend host:port,
+// idle or in use, like http.Transport.MaxConnsPerHost of Go 1.11. The
+// dials over the limit wait for a connection to close, or for their
+// request to be done, e.g. once served by a connection becoming idle.
+type connLimiter struct {
+	max  int
+	dial sproxy.DialContextFunc
+
+	mu    sync.Mutex
+	open  map[string]int
+	freed chan struct{} // closed when a connection is closed
+}
+
+func newConnLimiter(max int, dial sproxy.DialContextFunc) *connLimiter {
+	return &connLimiter{
+		max:   max,
+		dial:  dial,
+		open:  make(map[string]int),
+		freed: make(chan struct{}),
+	}
+}
+
+// DialContext dials addr once fewer than max connections are open
+// to it.
+func (l *connLimiter) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		if l.open[addr] < l.max {
+			l.open[addr]++
+			l.mu.Unlock()
+			break
+		}
+		freed := l.freed
+		l.mu.Unlock()
+		debugf("Waiting for one of the %d connections to %v to close", l.max, addr)
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c, err := l.dial(ctx, network, addr)
+	if err != nil {
+		l.release(addr)
+		return nil, err
+	}
+	return &limitedConn{Conn: c, release: func() { l.release(addr) }}, nil
+}
+
+func (l *connLimiter) release(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[addr]--; l.open[addr] == 0 {
+		delete(l.open, addr)
+	}
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// statuszRows returns the statusz rows of the connections open per
+// backend address.
+func (l *connLimiter) statuszRows() []statuszRow {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var addrs []string
+	for addr := range l.open {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	rows := make([]statuszRow, len(addrs))
+	for i, addr := range addrs {
+		rows[i] = statuszRow{name: "Open to " + addr, value: l.open[addr]}
+	}
+	return rows
+}
+
+// limitedConn is a connection counted by a connLimiter until closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+// consoleExporter prints spans and view data instead of uploading
+// them, so the proxy can run without Google Cloud credentials.
+type consoleExporter struct {
+	json bool
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newConsoleExporter(w io.Writer, format string) (*consoleExporter, error) {
+	switch format {
+	case "text":
+		return &consoleExporter{w: w}, nil
+	case "json":
+		return &consoleExporter{w: w, json: true}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, want text or json", format)
+}
+
+type consoleSpan struct {
+	Kind         string                 `json:"kind"`
+	Name         string                 `json:"name"`
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	StartTime    time.Time              `json:"startTime"`
+	Duration     string                 `json:"duration"`
+	Status       int32                  `json:"status"`
+	Message      string                 `json:"message,omitempty"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Annotations  []string               `json:"annotations,omitempty"`
+}
+
+func (e *consoleExporter) ExportSpan(sd *trace.SpanData) {
+	s := consoleSpan{
+		Kind:        "span",
+		Name:        sd.Name,
+		TraceID:     sd.TraceID.String(),
+		SpanID:      sd.SpanID.String(),
+		StartTime:   sd.StartTime,
+		Duration:    sd.EndTime.Sub(sd.StartTime).String(),
+		Status:      sd.Code,
+		Message:     sd.Message,
+		Attributes:  sd.Attributes,
+		Annotations: make([]string, len(sd.Annotations)),
+	}
+	if sd.ParentSpanID != (trace.SpanID{}) {
+		s.ParentSpanID = sd.ParentSpanID.String()
+	}
+	for i, a := range sd.Annotations {
+		s.Annotations[i] = a.Message
+	}
+	if e.json {
+		e.writeJSON(s)
+		return
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "span %s trace=%s span=%s", s.Name, s.TraceID, s.SpanID)
+	if s.ParentSpanID != "" {
+		fmt.Fprintf(&b, " parent=%s", s.ParentSpanID)
+	}
+	fmt.Fprintf(&b, " duration=%s status=%d", s.Duration, s.Status)
+	if s.Message != "" {
+		fmt.Fprintf(&b, " message=%q", s.Message)
+	}
+	writeSorted(&b, s.Attributes)
+	for _, a := range s.Annotations {
+		fmt.Fprintf(&b, "\n  annotation %q", a)
+	}
+	e.write(b.Bytes())
+}
+
+type consoleRow struct {
+	Kind  string            `json:"kind"`
+	View  string            `json:"view"`
+	Start time.Time         `json:"start"`
+	End   time.Time         `json:"end"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Data  interface{}       `json:"data"`
+}
+
+func (e *consoleExporter) ExportView(vd *view.Data) {
+	for _, r := range vd.Rows {
+		row := consoleRow{
+			Kind:  "view",
+			View:  vd.View.Name,
+			Start: vd.Start,
+			End:   vd.End,
+			Tags:  make(map[string]string, len(r.Tags)),
+			Data:  r.Data,
+		}
+		for _, t := range r.Tags {
+			row.Tags[t.Key.Name()] = t.Value
+		}
+		if e.json {
+			e.writeJSON(row)
+			continue
+		}
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "view %s", row.View)
+		tags := make(map[string]interface{}, len(row.Tags))
+		for k, v := range row.Tags {
+			tags[k] = v
+		}
+		writeSorted(&b, tags)
+		fmt.Fprintf(&b, " %s", formatAggregation(r.Data))
+		e.write(b.Bytes())
+	}
+}
+
+func formatAggregation(d view.AggregationData) string {
+	switch d := d.(type) {
+	case *view.CountData:
+		return fmt.Sprintf("count=%d", int64(*d))
+	case *view.SumData:
+		return fmt.Sprintf("sum=%g", float64(*d))
+	case *view.MeanData:
+		return fmt.Sprintf("count=%d mean=%g", d.Count, d.Mean)
+	case *view.DistributionData:
+		return fmt.Sprintf("count=%d min=%g mean=%g max=%g buckets=%v", d.Count, d.Min, d.Mean, d.Max, d.CountPerBucket)
+	}
+	return fmt.Sprint(d)
+}
+
+// writeSorted writes m as key=value pairs sorted by key.
+func writeSorted(b *bytes.Buffer, m map[string]interface{}) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, " %s=%q", k, fmt.Sprint(m[k]))
+	}
+}
+
+func (e *consoleExporter) writeJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"error": %q}`, err.Error()))
+	}
+	e.write(b)
+}
+
+func (e *consoleExporter) write(b []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(b, '\n'))
+}
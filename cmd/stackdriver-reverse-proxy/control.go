@@ -0,0 +1,233 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// controlPrincipal is the audited principal of the commands received
+// on the control subscription.
+const controlPrincipal = "control-subscription"
+
+const (
+	pubsubURL          = "https://pubsub.googleapis.com/v1/"
+	controlMaxMessages = 10
+	controlRetryDelay  = 10 * time.Second
+)
+
+// controlCommand applies a command with its arguments.
+type controlCommand func(args map[string]string) error
+
+// controlChannel pulls commands from a Pub/Sub subscription, so a
+// fleet of proxies, each with its own subscription to the same topic,
+// can be controlled at once. The messages are JSON objects such as
+//
+//	{"command": "sampling", "args": {"route": "/api/*", "fraction": "1"}}
+//
+// Every message is acknowledged, and every applied command audit logged.
+type controlChannel struct {
+	client       *http.Client
+	subscription string
+	audit        *auditLogger
+	commands     map[string]registeredCommand
+}
+
+type registeredCommand struct {
+	method string
+	apply  controlCommand
+}
+
+// newControlChannel returns a channel pulling from subscription, e.g.
+// projects/<p>/subscriptions/<s>. Pub/Sub is reached with base.
+func newControlChannel(ctx context.Context, subscription string, audit *auditLogger, base http.RoundTripper) (*controlChannel, error) {
+	if !strings.HasPrefix(subscription, "projects/") || !strings.Contains(subscription, "/subscriptions/") {
+		return nil, fmt.Errorf("%q is not projects/<project>/subscriptions/<subscription>", subscription)
+	}
+	ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/pubsub")
+	if err != nil {
+		return nil, err
+	}
+	return &controlChannel{
+		client: &http.Client{
+			Transport: &oauth2.Transport{Source: ts, Base: base},
+			Timeout:   2 * time.Minute,
+		},
+		subscription: subscription,
+		audit:        audit,
+		commands:     make(map[string]registeredCommand),
+	}, nil
+}
+
+// Handle registers a command. Applied commands are audit logged as
+// method.
+func (c *controlChannel) Handle(name, method string, apply controlCommand) {
+	c.commands[name] = registeredCommand{method: method, apply: apply}
+}
+
+type pubsubMessage struct {
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+	MessageID  string            `json:"messageId"`
+}
+
+// Run pulls and applies the commands until the process exits.
+func (c *controlChannel) Run() {
+	for {
+		if err := c.pull(); err != nil {
+			log.Printf("ERROR: Cannot pull from the control subscription %v: %v", c.subscription, err)
+			time.Sleep(controlRetryDelay)
+		}
+	}
+}
+
+func (c *controlChannel) pull() error {
+	var resp struct {
+		ReceivedMessages []struct {
+			AckID   string        `json:"ackId"`
+			Message pubsubMessage `json:"message"`
+		} `json:"receivedMessages"`
+	}
+	if err := c.call("pull", map[string]interface{}{"maxMessages": controlMaxMessages}, &resp); err != nil {
+		return err
+	}
+	if len(resp.ReceivedMessages) == 0 {
+		return nil
+	}
+	ackIDs := make([]string, len(resp.ReceivedMessages))
+	for i, m := range resp.ReceivedMessages {
+		ackIDs[i] = m.AckID
+		if err := c.apply(m.Message); err != nil {
+			log.Printf("ERROR: Cannot apply control message %v: %v", m.Message.MessageID, err)
+		}
+	}
+	return c.call("acknowledge", map[string]interface{}{"ackIds": ackIDs}, nil)
+}
+
+func (c *controlChannel) apply(m pubsubMessage) error {
+	var msg struct {
+		Command string                 `json:"command"`
+		Args    map[string]interface{} `json:"args"`
+	}
+	if err := json.Unmarshal(m.Data, &msg); err != nil {
+		return err
+	}
+	cmd, ok := c.commands[msg.Command]
+	if !ok {
+		return fmt.Errorf("unknown command %q", msg.Command)
+	}
+	args := make(map[string]string, len(msg.Args))
+	fields := map[string]interface{}{"messageId": m.MessageID}
+	for k, v := range msg.Args {
+		args[k] = fmt.Sprint(v)
+		fields[k] = args[k]
+	}
+	if err := cmd.apply(args); err != nil {
+		return err
+	}
+	c.audit.LogMessage(controlPrincipal, cmd.method, c.subscription, fields)
+	return nil
+}
+
+// call calls the method of the subscription with req, decoding the
+// response into resp unless nil.
+func (c *controlChannel) call(method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := c.client.Post(pubsubURL+c.subscription+":"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(r.Body)
+		return fmt.Errorf("%v: %s", r.Status, bytes.TrimSpace(msg))
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// samplingCommand sets the sampling fraction of the route argument,
+// or the default one without it. Without fraction, the fraction of the
+// route is removed.
+func samplingCommand(s *routeSampler) controlCommand {
+	return func(args map[string]string) error {
+		route := args["route"]
+		if args["fraction"] == "" {
+			if route == "" {
+				return errors.New("missing fraction")
+			}
+			s.DeleteRoute(route)
+			log.Printf("Removed the trace sampling fraction of %v", route)
+			return nil
+		}
+		fraction, err := strconv.ParseFloat(args["fraction"], 64)
+		if err != nil || fraction < 0 || fraction > 1 {
+			return errors.New("fraction must be between 0 and 1")
+		}
+		if route == "" {
+			s.SetFraction(fraction)
+			log.Printf("Set the trace sampling fraction to %v", fraction)
+		} else {
+			s.SetRoute(route, fraction)
+			log.Printf("Set the trace sampling fraction of %v to %v", route, fraction)
+		}
+		return nil
+	}
+}
+
+// logLevelCommand sets the log level to the level argument.
+func logLevelCommand(args map[string]string) error {
+	level, err := severityLevel(args["level"])
+	if err != nil {
+		return err
+	}
+	setLogLevel(level)
+	log.Printf("Set the log level to %v", severities[level])
+	return nil
+}
+
+// maintenanceCommand enters maintenance mode, or leaves it if the
+// enabled argument is false.
+func maintenanceCommand(h *maintenanceHandler) controlCommand {
+	return func(args map[string]string) error {
+		enabled := true
+		if s, ok := args["enabled"]; ok {
+			var err error
+			if enabled, err = strconv.ParseBool(s); err != nil {
+				return errors.New("enabled must be true or false")
+			}
+		}
+		h.SetEnabled(enabled)
+		return nil
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+// deltaExporter exports the change of the views since their previous
+// report instead of their cumulative values.
+//
+// Stackdriver Monitoring doesn't accept DELTA custom metrics, so the
+// deltas are still written as CUMULATIVE points but their intervals
+// start when the previous report ended, i.e. each point resets the
+// metric. Aligners and dashboards then see one value per interval.
+type deltaExporter struct {
+	telemetryExporter
+
+	mu   sync.Mutex
+	last map[string]deltaRow // by view name and tags
+}
+
+type deltaRow struct {
+	data view.AggregationData
+	end  time.Time
+}
+
+func newDeltaExporter(e telemetryExporter) *deltaExporter {
+	return &deltaExporter{
+		telemetryExporter: e,
+		last:              make(map[string]deltaRow),
+	}
+}
+
+func (e *deltaExporter) ExportView(vd *view.Data) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, r := range vd.Rows {
+		key := vd.View.Name + fmt.Sprint(r.Tags)
+		prev, ok := e.last[key]
+		e.last[key] = deltaRow{data: r.Data, end: vd.End}
+
+		c := *vd
+		c.Rows = []*view.Row{r}
+		if ok {
+			c.Start = prev.end
+			c.Rows = []*view.Row{{Tags: r.Tags, Data: subtractData(r.Data, prev.data)}}
+		}
+		e.telemetryExporter.ExportView(&c)
+	}
+}
+
+// subtractData returns the aggregation of the values
+// recorded in cur but not in prev.
+func subtractData(cur, prev view.AggregationData) view.AggregationData {
+	switch cur := cur.(type) {
+	case *view.CountData:
+		if prev, ok := prev.(*view.CountData); ok {
+			d := *cur - *prev
+			return &d
+		}
+	case *view.SumData:
+		if prev, ok := prev.(*view.SumData); ok {
+			d := *cur - *prev
+			return &d
+		}
+	case *view.MeanData:
+		if prev, ok := prev.(*view.MeanData); ok {
+			d := &view.MeanData{Count: cur.Count - prev.Count}
+			if d.Count > 0 {
+				d.Mean = (cur.Mean*float64(cur.Count) - prev.Mean*float64(prev.Count)) / float64(d.Count)
+			}
+			return d
+		}
+	case *view.DistributionData:
+		if prev, ok := prev.(*view.DistributionData); ok && len(prev.CountPerBucket) == len(cur.CountPerBucket) {
+			// Copy cur for its bucket bounds. Min and Max
+			// stay cumulative, they cannot be subtracted.
+			d := *cur
+			d.Count = cur.Count - prev.Count
+			d.CountPerBucket = make([]int64, len(cur.CountPerBucket))
+			for i := range cur.CountPerBucket {
+				d.CountPerBucket[i] = cur.CountPerBucket[i] - prev.CountPerBucket[i]
+			}
+			d.Mean, d.SumOfSquaredDev = 0, 0
+			if d.Count > 0 {
+				n, n1, n2 := float64(cur.Count), float64(prev.Count), float64(d.Count)
+				d.Mean = (cur.Mean*n - prev.Mean*n1) / n2
+				// Reverse the parallel variance algorithm combining
+				// prev and the delta into cur.
+				diff := d.Mean - prev.Mean
+				d.SumOfSquaredDev = cur.SumOfSquaredDev - prev.SumOfSquaredDev - diff*diff*n1*n2/n
+				if d.SumOfSquaredDev < 0 {
+					d.SumOfSquaredDev = 0 // rounding errors
+				}
+			}
+			return &d
+		}
+	}
+	return cur
+}
+
+// addData returns the aggregation of the values recorded in a or b,
+// e.g. of the rows whose tags collide once scrubbed.
+func addData(a, b view.AggregationData) view.AggregationData {
+	switch a := a.(type) {
+	case *view.CountData:
+		if b, ok := b.(*view.CountData); ok {
+			d := *a + *b
+			return &d
+		}
+	case *view.SumData:
+		if b, ok := b.(*view.SumData); ok {
+			d := *a + *b
+			return &d
+		}
+	case *view.MeanData:
+		if b, ok := b.(*view.MeanData); ok {
+			d := &view.MeanData{Count: a.Count + b.Count}
+			if d.Count > 0 {
+				d.Mean = (a.Mean*float64(a.Count) + b.Mean*float64(b.Count)) / float64(d.Count)
+			}
+			return d
+		}
+	case *view.DistributionData:
+		if b, ok := b.(*view.DistributionData); ok && len(a.CountPerBucket) == len(b.CountPerBucket) {
+			switch {
+			case a.Count == 0:
+				return b
+			case b.Count == 0:
+				return a
+			}
+			d := *a
+			d.Count = a.Count + b.Count
+			d.Min = math.Min(a.Min, b.Min)
+			d.Max = math.Max(a.Max, b.Max)
+			d.CountPerBucket = make([]int64, len(a.CountPerBucket))
+			for i := range a.CountPerBucket {
+				d.CountPerBucket[i] = a.CountPerBucket[i] + b.CountPerBucket[i]
+			}
+			// The parallel variance algorithm.
+			n, na, nb := float64(d.Count), float64(a.Count), float64(b.Count)
+			diff := b.Mean - a.Mean
+			d.Mean = (a.Mean*na + b.Mean*nb) / n
+			d.SumOfSquaredDev = a.SumOfSquaredDev + b.SumOfSquaredDev + diff*diff*na*nb/n
+			return &d
+		}
+	}
+	return a
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultDrainTimeout is how long a drain waits for the in-flight
+// requests without a timeout query parameter.
+const defaultDrainTimeout = 30 * time.Second
+
+// drainer tracks the in-flight requests of the proxy and answers the
+// readiness probes, failing them while warming up and once draining so
+// the load balancer only sends requests to a ready proxy.
+type drainer struct {
+	readyPath string
+	exit      func() // flushes the telemetry and exits
+	handler   http.Handler
+
+	mu       sync.Mutex
+	warming  bool
+	draining bool
+	inflight int
+	idle     chan struct{} // closed when draining without in-flight requests
+}
+
+func newDrainer(readyPath string, exit func(), h http.Handler) *drainer {
+	return &drainer{
+		readyPath: readyPath,
+		exit:      exit,
+		handler:   h,
+		idle:      make(chan struct{}),
+	}
+}
+
+func (d *drainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.readyPath != "" && r.URL.Path == d.readyPath {
+		d.serveReady(w)
+		return
+	}
+	d.mu.Lock()
+	d.inflight++
+	d.mu.Unlock()
+	defer d.done()
+	d.handler.ServeHTTP(w, r)
+}
+
+func (d *drainer) serveReady(w http.ResponseWriter) {
+	if reason := d.notReady(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// notReady returns why the proxy is not ready, warming up or draining,
+// or "" if it is.
+func (d *drainer) notReady() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case d.warming:
+		return "warming up"
+	case d.draining:
+		return "draining"
+	}
+	return ""
+}
+
+func (d *drainer) done() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inflight--
+	d.closeIdle()
+}
+
+// closeIdle closes idle when draining without in-flight requests.
+// d.mu must be held.
+func (d *drainer) closeIdle() {
+	if !d.draining || d.inflight > 0 {
+		return
+	}
+	select {
+	case <-d.idle:
+	default:
+		close(d.idle)
+	}
+}
+
+// SetWarming fails the readiness probes until the proxy is warmed up.
+func (d *drainer) SetWarming(warming bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.warming = warming
+}
+
+// Inflight returns the number of requests in flight.
+func (d *drainer) Inflight() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inflight
+}
+
+// Drain fails the readiness probes and waits up to timeout for the
+// in-flight requests to finish. It returns the requests still in
+// flight. Draining can't be undone.
+func (d *drainer) Drain(timeout time.Duration) int {
+	d.mu.Lock()
+	if !d.draining {
+		log.Printf("Draining %d in-flight requests", d.inflight)
+	}
+	d.draining = true
+	d.closeIdle()
+	d.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-d.idle:
+	case <-t.C:
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inflight
+}
+
+// ShutdownOnSignal shuts down server on SIGTERM or SIGINT: it stops
+// accepting connections, waits up to timeout for the in-flight
+// requests, then flushes the telemetry and exits. A second signal
+// exits right away.
+func (d *drainer) ShutdownOnSignal(server *http.Server, timeout time.Duration) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	sig := <-c
+	log.Printf("Received %v, shutting down", sig)
+	go func() {
+		<-c
+		log.Print("WARNING: Received a second signal, exiting without draining")
+		os.Exit(1)
+	}()
+
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("WARNING: Shutdown timed out after %v with %d in-flight requests", timeout, d.Inflight())
+	} else {
+		log.Print("Drained the in-flight requests")
+	}
+	d.exit()
+}
+
+// drainHandler serves the drain admin endpoint, called from preStop
+// hooks. POST drains the proxy for up to the timeout query parameter,
+// by default 30s, then exits it if the exit query parameter is true.
+type drainHandler struct {
+	d *drainer
+}
+
+func (h drainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	timeout := defaultDrainTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil {
+			http.Error(w, "invalid timeout: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	exit := r.URL.Query().Get("exit") == "true"
+
+	inflight := h.d.Drain(timeout)
+	if inflight > 0 {
+		log.Printf("WARNING: Drain timed out after %v with %d in-flight requests", timeout, inflight)
+	} else {
+		log.Print("Drained the in-flight requests")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"drained":  inflight == 0,
+		"inflight": inflight,
+	})
+	if exit {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		go h.d.exit()
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// listenNetwork returns the network to listen on for
+// the -listen-family family.
+func listenNetwork(family string) (string, error) {
+	switch family {
+	case "any":
+		return "tcp", nil
+	case "ipv4":
+		return "tcp4", nil
+	case "ipv6":
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("unknown family %q, want any, ipv4 or ipv6", family)
+}
+
+// connListener records the accepted connections by address family.
+// Like http.ListenAndServe, it enables TCP keep-alives on them.
+type connListener struct {
+	net.Listener
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(3 * time.Minute)
+	}
+	recordConnection("listener", c.RemoteAddr())
+	return c, nil
+}
+
+// dialFallbackDelay is how long a dial attempt runs alone before
+// the next address is dialed in parallel, as in Happy Eyeballs
+// (RFC 8305).
+const dialFallbackDelay = 300 * time.Millisecond
+
+// backendDialer dials the backend addresses of a family, or
+// preferring a family. When the backend resolves to several
+// addresses, they are dialed Happy Eyeballs style: the next address
+// is dialed if the previous one failed or didn't connect quickly,
+// and the first connection wins.
+type backendDialer struct {
+	dialer *net.Dialer
+	family string // any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6
+}
+
+func newBackendDialer(family string, timeout, keepAlive time.Duration) (*backendDialer, error) {
+	switch family {
+	case "any", "ipv4", "ipv6", "prefer-ipv4", "prefer-ipv6":
+	default:
+		return nil, fmt.Errorf("unknown family %q, want any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6", family)
+	}
+	if keepAlive == 0 {
+		keepAlive = -1 // disabled by all Go versions, unlike 0
+	}
+	return &backendDialer{
+		dialer: &net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: keepAlive,
+		},
+		family: family,
+	}, nil
+}
+
+func (d *backendDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = orderAddrs(ips, d.family)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no %v address for %v", d.family, host)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	c, err := d.dialParallel(ctx, network, addrs)
+	if err != nil {
+		return nil, err
+	}
+	recordConnection("backend", c.RemoteAddr())
+	return c, nil
+}
+
+func (d *backendDialer) dialParallel(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	if len(addrs) == 1 {
+		return d.dialer.DialContext(ctx, network, addrs[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // aborts the losing attempts
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result)
+	dial := func(addr string) {
+		c, err := d.dialer.DialContext(ctx, network, addr)
+		select {
+		case results <- result{c, err}:
+		case <-ctx.Done():
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+
+	next := time.NewTimer(0)
+	defer next.Stop()
+	var (
+		started, pending int
+		lastErr          error
+	)
+	for {
+		select {
+		case <-next.C:
+			go dial(addrs[started])
+			started++
+			pending++
+			if started < len(addrs) {
+				next.Reset(dialFallbackDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.c, nil
+			}
+			lastErr = r.err
+			if started < len(addrs) {
+				// Don't wait for the delay to try the next address.
+				if !next.Stop() {
+					select {
+					case <-next.C:
+					default:
+					}
+				}
+				next.Reset(0)
+			} else if pending == 0 {
+				return nil, lastErr
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// orderAddrs filters or orders addrs by family. With any, the
+// families are interleaved starting with the first address family.
+func orderAddrs(addrs []net.IPAddr, family string) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	switch family {
+	case "ipv4":
+		return v4
+	case "ipv6":
+		return v6
+	case "prefer-ipv4":
+		return append(v4, v6...)
+	case "prefer-ipv6":
+		return append(v6, v4...)
+	}
+	first, second := v6, v4
+	if len(addrs) > 0 && addrs[0].IP.To4() != nil {
+		first, second = v4, v6
+	}
+	ordered := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// addrFamily returns ipv4 or ipv6 for TCP addresses.
+func addrFamily(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "other"
+	}
+	if tcp.IP.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// recordConnection counts a connection of the listener or backend side.
+func recordConnection(side string, remote net.Addr) {
+	ctx, err := tag.New(context.Background(),
+		tag.Upsert(sideKey, side),
+		tag.Upsert(familyKey, addrFamily(remote)),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, connections.M(1))
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// egressProxyScopes returns whether the forward proxy set by the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables is used
+// for the backend and exporter traffic, given the -egress-proxy scope.
+func egressProxyScopes(scope string) (backend, exporter bool, err error) {
+	switch scope {
+	case "all":
+		return true, true, nil
+	case "backend":
+		return true, false, nil
+	case "exporter":
+		return false, true, nil
+	case "none":
+		return false, false, nil
+	}
+	return false, false, fmt.Errorf("unknown scope %q, want all, backend, exporter or none", scope)
+}
+
+// withoutProxy is a dial option connecting directly, since gRPC
+// otherwise connects through the HTTPS_PROXY of the environment.
+func withoutProxy() grpc.DialOption {
+	return grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, timeout)
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// Default endpoints of the Stackdriver APIs, as dialed by their clients.
+const (
+	traceAPIEndpoint      = "cloudtrace.googleapis.com:443"
+	monitoringAPIEndpoint = "monitoring.googleapis.com:443"
+)
+
+// exporterClientOptions returns the client options pointing the
+// Stackdriver exporter to the given endpoints instead of the
+// Google APIs, typically fakes or emulators in tests. The dial
+// options are applied to the connections to both APIs.
+//
+// The exporter shares its client options between the Trace and
+// Monitoring clients, so the endpoints are picked by a dialer
+// redirecting the default endpoints. If insecure is set, plaintext
+// connections without authentication are used and both APIs must
+// be served from the same endpoint.
+func exporterClientOptions(traceEndpoint, monitoringEndpoint string, insecure bool, dialOpts ...grpc.DialOption) ([]option.ClientOption, error) {
+	if insecure {
+		endpoint := traceEndpoint
+		if endpoint == "" {
+			endpoint = monitoringEndpoint
+		}
+		if endpoint == "" {
+			return nil, errors.New("an insecure export needs an endpoint")
+		}
+		if monitoringEndpoint != "" && monitoringEndpoint != endpoint {
+			return nil, errors.New("an insecure export needs the same trace and monitoring endpoints")
+		}
+		conn, err := grpc.Dial(endpoint, append(dialOpts, grpc.WithInsecure())...)
+		if err != nil {
+			return nil, err
+		}
+		return []option.ClientOption{option.WithGRPCConn(conn)}, nil
+	}
+	var opts []option.ClientOption
+	for _, o := range dialOpts {
+		opts = append(opts, option.WithGRPCDialOption(o))
+	}
+	if traceEndpoint == "" && monitoringEndpoint == "" {
+		return opts, nil
+	}
+	redirects := map[string]string{
+		traceAPIEndpoint:      traceEndpoint,
+		monitoringAPIEndpoint: monitoringEndpoint,
+	}
+	dial := func(addr string, timeout time.Duration) (net.Conn, error) {
+		if to := redirects[addr]; to != "" {
+			addr = to
+		}
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	return append(opts, option.WithGRPCDialOption(grpc.WithDialer(dial))), nil
+}
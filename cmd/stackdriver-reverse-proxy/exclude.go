@@ -0,0 +1,61 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type excludedKey struct{}
+
+// telemetryExcluded reports whether the request of ctx
+// must not be traced, measured nor logged.
+func telemetryExcluded(ctx context.Context) bool {
+	excluded, _ := ctx.Value(excludedKey{}).(bool)
+	return excluded
+}
+
+// excludeHandler serves the requests to the excluded routes, such as
+// health checks, with excluded instead of handler, the same chain
+// without the telemetry middleware.
+type excludeHandler struct {
+	routes   []string
+	excluded http.Handler
+	handler  http.Handler
+}
+
+func (h *excludeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if matchRoute(h.routes, r.URL.Path) < 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), excludedKey{}, true))
+	h.excluded.ServeHTTP(w, r)
+}
+
+// excludeTransport skips the traced transport for the backend
+// requests of excluded requests.
+type excludeTransport struct {
+	base   http.RoundTripper
+	traced http.RoundTripper
+}
+
+func (t *excludeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if telemetryExcluded(req.Context()) {
+		return t.base.RoundTrip(req)
+	}
+	return t.traced.RoundTrip(req)
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+)
+
+// exemplar is a traced request representative of a latency bucket.
+type exemplar struct {
+	LowerMs   float64   `json:"lowerMs"`
+	UpperMs   float64   `json:"upperMs,omitempty"` // unbounded if zero
+	TraceID   string    `json:"traceId"`
+	LatencyMs float64   `json:"latencyMs"`
+	Path      string    `json:"path"`
+	Time      time.Time `json:"time"`
+}
+
+// exemplars keeps the latest sampled trace of each bucket of the
+// server latency distribution of ochttp, for a debug page of the
+// admin API listing traces representative of each latency range.
+//
+// They are not attached to the exported distribution points: the
+// Monitoring API and exporter vendored here predate exemplars, so
+// Cloud Monitoring charts can't link to the traces yet.
+type exemplars struct {
+	scrub  *scrubber
+	bounds []float64
+
+	mu      sync.Mutex
+	buckets map[int]*exemplar
+}
+
+func newExemplars(s *scrubber) *exemplars {
+	return &exemplars{
+		scrub:   s,
+		bounds:  ochttp.DefaultLatencyDistribution,
+		buckets: make(map[int]*exemplar),
+	}
+}
+
+// Handler returns the middleware recording exemplars of the requests
+// served by h. It must be installed inside ochttp.Handler.
+func (e *exemplars) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		span := trace.FromContext(r.Context())
+		if span == nil || !span.SpanContext().IsSampled() {
+			return
+		}
+		latency := float64(time.Since(start)) / float64(time.Millisecond)
+		// Bucket i holds the latencies in [bounds[i-1], bounds[i]).
+		i := sort.Search(len(e.bounds), func(i int) bool { return latency < e.bounds[i] })
+		ex := &exemplar{
+			TraceID:   span.SpanContext().TraceID.String(),
+			LatencyMs: latency,
+			Path:      e.scrub.Scrub(r.URL.Path),
+			Time:      start.UTC(),
+		}
+		if i > 0 {
+			ex.LowerMs = e.bounds[i-1]
+		}
+		if i < len(e.bounds) {
+			ex.UpperMs = e.bounds[i]
+		}
+		e.mu.Lock()
+		e.buckets[i] = ex
+		e.mu.Unlock()
+	})
+}
+
+// ServeHTTP lists the exemplars by increasing latency.
+func (e *exemplars) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	list := make([]*exemplar, 0, len(e.buckets))
+	for _, ex := range e.buckets {
+		list = append(list, ex)
+	}
+	e.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].LatencyMs < list[j].LatencyMs })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Backoff between the attempts of a failed export.
+const (
+	exportInitialBackoff = time.Second
+	exportMaxBackoff     = 30 * time.Second
+)
+
+// retryableExportCodes are the codes of the export failures
+// worth retrying, i.e. network, quota and server errors.
+var retryableExportCodes = map[codes.Code]bool{
+	codes.Unavailable:       true,
+	codes.ResourceExhausted: true,
+	codes.DeadlineExceeded:  true,
+	codes.Aborted:           true,
+}
+
+// exportRetrier returns an interceptor of the exporter RPCs to project,
+// empty for the detected one, retrying the retryable failures with
+// exponential backoff up to retries times. Failures left after the
+// retries are counted and logged as errors.
+func exportRetrier(retries int, project string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		backoff := exportInitialBackoff
+		name := strings.TrimPrefix(method, "/")
+		for attempt := 0; ; attempt++ {
+			stats.Record(context.Background(), exportRPCs.M(1))
+			start := time.Now()
+			err := invoker(ctx, method, req, reply, cc, opts...)
+			stats.Record(context.Background(), exportRPCs.M(-1))
+			code := grpc.Code(err)
+			recordExportRPC(name, code.String(), start)
+			if err == nil {
+				return nil
+			}
+			if attempt >= retries || !retryableExportCodes[code] {
+				log.Printf("ERROR: Cannot export telemetry%s, %v failed after %d attempts: %v", toProject(project), name, attempt+1, err)
+				recordExportFailure(name, code.String())
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > exportMaxBackoff {
+				backoff = exportMaxBackoff
+			}
+		}
+	}
+}
+
+// exportErrorHandler returns the handler of the errors of the exporter
+// to project reporting those not coming from the RPCs intercepted by
+// exportRetrier, e.g. full buffers.
+func exportErrorHandler(project string) func(error) {
+	return func(err error) {
+		if _, ok := status.FromError(err); ok {
+			return // already reported by exportRetrier
+		}
+		log.Printf("ERROR: Cannot export telemetry%s: %v", toProject(project), err)
+		recordExportFailure("exporter", codes.Unknown.String())
+	}
+}
+
+// toProject names the destination project in the export errors.
+func toProject(project string) string {
+	if project == "" {
+		return ""
+	}
+	return " to " + project
+}
+
+// recordExportFailure counts a telemetry export failure.
+func recordExportFailure(method, code string) {
+	ctx, err := tag.New(context.Background(),
+		tag.Upsert(methodKey, method),
+		tag.Upsert(codeKey, code),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, exportFailures.M(1))
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// healthCheckTimeout bounds the health checks of the targets.
+const healthCheckTimeout = 5 * time.Second
+
+// failoverHandler proxies the requests to the first healthy target
+// of an ordered list, e.g. a primary region followed by secondary
+// ones. It fails back to a preferred target once it is healthy again.
+type failoverHandler struct {
+	targets    []*url.URL
+	proxies    []http.Handler
+	healthPath string
+	client     *http.Client
+	audit      *auditLogger
+
+	mu     sync.Mutex
+	active int
+}
+
+// newFailoverHandler returns a handler failing over between targets,
+// reached with the reverse proxies returned by newProxy. Targets are
+// healthy if their healthPath serves a 2xx or 3xx response. The target
+// switches are recorded in the audit log.
+func newFailoverHandler(targets []*url.URL, newProxy func(*url.URL) http.Handler, healthPath string, t http.RoundTripper, audit *auditLogger) *failoverHandler {
+	h := &failoverHandler{
+		targets:    targets,
+		healthPath: healthPath,
+		client:     &http.Client{Transport: t, Timeout: healthCheckTimeout},
+		audit:      audit,
+	}
+	for _, u := range targets {
+		h.proxies = append(h.proxies, newProxy(u))
+	}
+	return h
+}
+
+// Run checks the health of the targets every interval.
+func (h *failoverHandler) Run(interval time.Duration) {
+	for {
+		h.check()
+		time.Sleep(interval)
+	}
+}
+
+func (h *failoverHandler) check() {
+	for i, u := range h.targets {
+		if err := h.healthy(u); err != nil {
+			log.Printf("Target %v is unhealthy: %v", u, err)
+			continue
+		}
+		debugf("Target %v is healthy", u)
+		h.activate(i)
+		return
+	}
+	log.Printf("ERROR: No healthy target, keep proxying to %v", h.targets[h.current()])
+}
+
+func (h *failoverHandler) healthy(u *url.URL) error {
+	hu := *u
+	hu.Path = singleJoiningSlash(u.Path, h.healthPath)
+	resp, err := h.client.Get(hu.String())
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return &statusError{resp.StatusCode}
+	}
+	return nil
+}
+
+// statuszRows returns the statusz rows of the active target.
+func (h *failoverHandler) statuszRows() []statuszRow {
+	return []statuszRow{{name: "Active target", value: h.targets[h.current()]}}
+}
+
+func (h *failoverHandler) current() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.active
+}
+
+func (h *failoverHandler) activate(i int) {
+	h.mu.Lock()
+	from := h.active
+	h.active = i
+	h.mu.Unlock()
+	if from == i {
+		return
+	}
+	reason := "failback"
+	if i > from {
+		reason = "failover"
+		log.Printf("ERROR: Failing over from %v to %v", h.targets[from], h.targets[i])
+	} else {
+		log.Printf("Failing back from %v to %v", h.targets[from], h.targets[i])
+	}
+	h.audit.LogLocal("proxy.SwitchTarget", h.targets[i].String(), map[string]interface{}{
+		"from":   h.targets[from].String(),
+		"reason": reason,
+	})
+	recordFailover(h.targets[i].Host)
+}
+
+func (h *failoverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.proxies[h.current()].ServeHTTP(w, r)
+}
+
+// statusError is an unexpected HTTP response status.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status " + http.StatusText(e.code)
+}
+
+// singleJoiningSlash joins URL paths like httputil.ReverseProxy.
+func singleJoiningSlash(a, b string) string {
+	aslash := len(a) > 0 && a[len(a)-1] == '/'
+	bslash := len(b) > 0 && b[0] == '/'
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// recordFailover counts a failover to the target host.
+func recordFailover(target string) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(targetKey, tagValue(target)))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, failovers.M(1))
+}
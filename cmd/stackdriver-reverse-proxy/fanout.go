@@ -0,0 +1,38 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+// fanoutExporter exports the same spans and view data to each of its
+// exporters, e.g. one per project. The Stackdriver exporters buffer
+// and send on their own, so a failing destination doesn't hold the
+// others.
+type fanoutExporter []telemetryExporter
+
+func (f fanoutExporter) ExportSpan(sd *trace.SpanData) {
+	for _, e := range f {
+		e.ExportSpan(sd)
+	}
+}
+
+func (f fanoutExporter) ExportView(vd *view.Data) {
+	for _, e := range f {
+		e.ExportView(vd)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardingHeaders are the headers proxies in front tell the client
+// and original request with.
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+// trustedProxies are the peers whose forwarding headers are trusted.
+type trustedProxies struct {
+	all  bool
+	nets []*net.IPNet
+}
+
+// parseTrustedProxies parses all, none or comma-separated IPs and
+// CIDRs.
+func parseTrustedProxies(spec string) (*trustedProxies, error) {
+	switch spec {
+	case "all":
+		return &trustedProxies{all: true}, nil
+	case "", "none":
+		return &trustedProxies{}, nil
+	}
+	t := &trustedProxies{}
+	for _, s := range splitList(spec) {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		t.nets = append(t.nets, n)
+	}
+	return t, nil
+}
+
+func (t *trustedProxies) trusts(addr string) bool {
+	if t.all {
+		return true
+	}
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedHeaders parses the comma-separated optional forwarding
+// headers added to the requests, x-forwarded-host and forwarded.
+func parseForwardedHeaders(items []string) (host, rfc7239 bool, err error) {
+	for _, item := range items {
+		switch strings.ToLower(item) {
+		case "x-forwarded-host":
+			host = true
+		case "forwarded":
+			rfc7239 = true
+		default:
+			return false, false, fmt.Errorf("unknown header %q, want x-forwarded-host or forwarded", item)
+		}
+	}
+	return host, rfc7239, nil
+}
+
+type (
+	clientIPKey       struct{}
+	forwardedProtoKey struct{}
+)
+
+// forwardedHandler removes the forwarding headers of the requests
+// from untrusted peers, so that clients can't spoof them when the
+// proxy is edge-facing, and resolves the client IP of the requests
+// forwarded by the listed trusted proxies as the last untrusted
+// address of X-Forwarded-For. X-Forwarded-For itself is appended the
+// peer address by the reverse proxy. The protocol of the client is
+// resolved as the last X-Forwarded-Proto of the trusted peers, see
+// isHTTPS.
+type forwardedHandler struct {
+	trusted *trustedProxies
+	host    bool // add X-Forwarded-Host
+	rfc7239 bool // append to the RFC 7239 Forwarded header
+	handler http.Handler
+}
+
+func (h *forwardedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	peer := peerIP(r)
+	switch {
+	case !h.trusted.trusts(peer):
+		for _, name := range forwardingHeaders {
+			if _, ok := r.Header[name]; ok {
+				debugf("Removed %v of untrusted peer %v", name, peer)
+				r.Header.Del(name)
+			}
+		}
+	case !h.trusted.all:
+		if ip := h.forwardedFor(r); ip != "" {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+		}
+	}
+	// Only the trusted peers have their X-Forwarded-Proto left.
+	var protos []string
+	for _, v := range r.Header["X-Forwarded-Proto"] {
+		protos = append(protos, splitList(v)...)
+	}
+	if len(protos) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), forwardedProtoKey{}, strings.ToLower(protos[len(protos)-1])))
+	}
+	if h.host && r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if h.rfc7239 {
+		proto := "http"
+		if isHTTPS(r) {
+			proto = "https"
+		}
+		forwarded := fmt.Sprintf("for=%s;host=%q;proto=%s", forwardedNode(peer), r.Host, proto)
+		if prior := r.Header["Forwarded"]; len(prior) > 0 {
+			forwarded = strings.Join(prior, ", ") + ", " + forwarded
+		}
+		r.Header.Set("Forwarded", forwarded)
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// forwardedFor returns the last address of X-Forwarded-For not of a
+// trusted proxy, or the first one if all are.
+func (h *forwardedHandler) forwardedFor(r *http.Request) string {
+	var addrs []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		addrs = append(addrs, splitList(v)...)
+	}
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if !h.trusted.trusts(addrs[i]) {
+			return addrs[i]
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+// forwardedNode formats ip as a node of the Forwarded header, quoting
+// the IPv6 addresses.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
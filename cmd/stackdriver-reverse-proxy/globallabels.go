@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// parseGlobalLabels returns the static labels of the key=value items.
+func parseGlobalLabels(items []string) (map[string]string, error) {
+	labels := make(map[string]string, len(items))
+	for _, item := range items {
+		k, v, err := splitPair(item)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tag.NewKey(k); err != nil {
+			return nil, err
+		}
+		labels[k] = tagValue(v)
+	}
+	return labels, nil
+}
+
+// labelExporter adds static labels to the spans, as attributes, and
+// to the view data, as tags, before handing them to the underlying
+// exporter. The labels don't replace the attributes and tags of the
+// same name.
+type labelExporter struct {
+	keys   []tag.Key
+	labels map[string]string
+	e      telemetryExporter
+}
+
+func newLabelExporter(labels map[string]string, e telemetryExporter) *labelExporter {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	le := &labelExporter{labels: labels, e: e}
+	for _, name := range names {
+		k, _ := tag.NewKey(name)
+		le.keys = append(le.keys, k)
+	}
+	return le
+}
+
+func (e *labelExporter) ExportSpan(sd *trace.SpanData) {
+	// SpanData is shared between the registered exporters,
+	// modify a copy.
+	c := *sd
+	c.Attributes = make(map[string]interface{}, len(sd.Attributes)+len(e.labels))
+	for k, v := range e.labels {
+		c.Attributes[k] = v
+	}
+	for k, v := range sd.Attributes {
+		c.Attributes[k] = v
+	}
+	e.e.ExportSpan(&c)
+}
+
+func (e *labelExporter) ExportView(vd *view.Data) {
+	v := *vd.View
+	var added []tag.Key
+	for _, k := range e.keys {
+		if !hasKey(v.TagKeys, k) {
+			added = append(added, k)
+		}
+	}
+	v.TagKeys = append(append([]tag.Key(nil), v.TagKeys...), added...)
+	c := *vd
+	c.View = &v
+	c.Rows = make([]*view.Row, len(vd.Rows))
+	for i, r := range vd.Rows {
+		tags := append([]tag.Tag(nil), r.Tags...)
+		for _, k := range added {
+			tags = append(tags, tag.Tag{Key: k, Value: e.labels[k.Name()]})
+		}
+		c.Rows[i] = &view.Row{Tags: tags, Data: r.Data}
+	}
+	e.e.ExportView(&c)
+}
+
+func hasKey(keys []tag.Key, k tag.Key) bool {
+	for _, key := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// grpcStatsHandler records the RPCs proxied by handler in the gRPC
+// server views, and sets the status of their spans to the gRPC status
+// returned by the backend, rather than the HTTP one, always 200.
+type grpcStatsHandler struct {
+	handler http.Handler
+}
+
+func (h *grpcStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	h.handler.ServeHTTP(w, r)
+
+	// The status is a trailer, or a header of the trailers-only
+	// responses, both copied to the header map by ReverseProxy.
+	code := codes.Unknown
+	if v := w.Header().Get("Grpc-Status"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			code = codes.Code(n)
+		}
+	} else if v := w.Header().Get(http.TrailerPrefix + "Grpc-Status"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			code = codes.Code(n)
+		}
+	}
+	if span := trace.FromContext(r.Context()); span != nil {
+		span.SetAttributes(trace.StringAttribute("grpc.status", grpcStatusName(code)))
+		if code != codes.OK {
+			span.SetStatus(trace.Status{Code: int32(code), Message: w.Header().Get("Grpc-Message")})
+		}
+	}
+	recordGRPCServerRPC(r.Context(), strings.TrimPrefix(r.URL.Path, "/"), code, start)
+}
+
+// recordGRPCServerRPC records an RPC to method, e.g.
+// helloworld.Greeter/SayHello, started at start and ended with code.
+func recordGRPCServerRPC(ctx context.Context, method string, code codes.Code, start time.Time) {
+	ctx, err := tag.New(ctx,
+		tag.Upsert(grpcMethodKey, tagValue(method)),
+		tag.Upsert(grpcStatusKey, grpcStatusName(code)),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, grpcLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+}
+
+// grpcStatusName returns the name of code as ocgrpc tags it, e.g.
+// NOT_FOUND.
+func grpcStatusName(code codes.Code) string {
+	if code == codes.Canceled {
+		return "CANCELLED"
+	}
+	name := code.String()
+	var b []byte
+	for i, c := range name {
+		if i > 0 && c >= 'A' && c <= 'Z' && name[i-1] >= 'a' {
+			b = append(b, '_')
+		}
+		b = append(b, byte(c))
+	}
+	return strings.ToUpper(string(b))
+}
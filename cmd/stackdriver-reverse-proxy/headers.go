@@ -0,0 +1,183 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.opencensus.io/trace"
+)
+
+// headerRule rewrites a header of the requests to the backend or of
+// the responses to the clients.
+type headerRule struct {
+	Name     string `json:"name"`
+	Response bool   `json:"response,omitempty"` // rewrite the response instead of the request
+	Action   string `json:"action"`             // add, set or remove
+	Header   string `json:"header"`             // header name, or name prefix ending with * to remove
+	Value    string `json:"value,omitempty"`    // value template of add and set
+	Path     string `json:"path,omitempty"`     // regexp matched against the URL path
+
+	path *regexp.Regexp
+}
+
+// parseHeaderRules parses a JSON list of rules.
+func parseHeaderRules(b []byte) ([]*headerRule, error) {
+	var rules []*headerRule
+	err := json.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.Header == "" {
+			return nil, fmt.Errorf("rule %v: no header", rule.Name)
+		}
+		switch rule.Action {
+		case "add", "set":
+			if strings.HasSuffix(rule.Header, "*") {
+				return nil, fmt.Errorf("rule %v: header prefixes can only be removed", rule.Name)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("rule %v: unknown action %q, want add, set or remove", rule.Name, rule.Action)
+		}
+		if rule.Path != "" {
+			if rule.path, err = regexp.Compile(rule.Path); err != nil {
+				return nil, fmt.Errorf("rule %v: %v", rule.Name, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// apply rewrites h with the rule, expanding its value with vars.
+func (rule *headerRule) apply(h http.Header, vars *strings.Replacer) {
+	switch rule.Action {
+	case "add":
+		h.Add(rule.Header, vars.Replace(rule.Value))
+	case "set":
+		h.Set(rule.Header, vars.Replace(rule.Value))
+	case "remove":
+		if !strings.HasSuffix(rule.Header, "*") {
+			h.Del(rule.Header)
+			return
+		}
+		prefix := http.CanonicalHeaderKey(strings.TrimSuffix(rule.Header, "*"))
+		for name := range h {
+			if strings.HasPrefix(name, prefix) {
+				delete(h, name)
+			}
+		}
+	}
+}
+
+// headerVars returns the replacer of the variables of the header
+// value templates: {client_ip}, {trace_id}, {span_id}, {method},
+// {host} and {path}.
+func headerVars(r *http.Request) *strings.Replacer {
+	var traceID, spanID string
+	if span := trace.FromContext(r.Context()); span != nil {
+		sc := span.SpanContext()
+		traceID, spanID = sc.TraceID.String(), sc.SpanID.String()
+	}
+	return strings.NewReplacer(
+		"{client_ip}", clientIP(r),
+		"{trace_id}", traceID,
+		"{span_id}", spanID,
+		"{method}", r.Method,
+		"{host}", r.Host,
+		"{path}", r.URL.Path,
+	)
+}
+
+// headerRulesHandler rewrites the headers of the requests and
+// responses with the rules, in order, e.g. to strip internal headers
+// before the backend. It must be installed inside ochttp.Handler for
+// {trace_id} and {span_id}.
+type headerRulesHandler struct {
+	handler http.Handler
+
+	mu    sync.RWMutex
+	rules []*headerRule
+}
+
+// SetRules replaces the rules.
+func (h *headerRulesHandler) SetRules(rules []*headerRule) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rules = rules
+}
+
+func (h *headerRulesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	rules := h.rules
+	h.mu.RUnlock()
+	var response []*headerRule
+	var vars *strings.Replacer
+	for _, rule := range rules {
+		if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+			continue
+		}
+		if rule.Response {
+			response = append(response, rule)
+			continue
+		}
+		if vars == nil {
+			vars = headerVars(r)
+		}
+		rule.apply(r.Header, vars)
+	}
+	if len(response) > 0 {
+		if vars == nil {
+			vars = headerVars(r)
+		}
+		w = withFlusher(&headerRulesWriter{ResponseWriter: w, rules: response, vars: vars}, r)
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// headerRulesWriter rewrites the response headers with the rules
+// once written.
+type headerRulesWriter struct {
+	http.ResponseWriter
+	rules   []*headerRule
+	vars    *strings.Replacer
+	written bool
+}
+
+func (w *headerRulesWriter) WriteHeader(code int) {
+	if !w.written {
+		w.written = true
+		for _, rule := range w.rules {
+			rule.apply(w.Header(), w.vars)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerRulesWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// version is the version of the proxy, set at build time with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// defaultInstance identifies the proxy instance if -instance is not set.
+func defaultInstance() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// heartbeat records a heartbeat every interval, independently
+// of the traffic, until ctx is done. Alert on the absence of
+// the heartbeat metric to detect instances that stopped reporting.
+func heartbeat(ctx context.Context, interval time.Duration, instance string) {
+	ctx, err := tag.New(ctx,
+		tag.Upsert(versionKey, tagValue(version)),
+		tag.Upsert(instanceKey, tagValue(instance)),
+	)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		stats.Record(ctx, heartbeats.M(1), uptime.M(time.Since(start).Seconds()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSignedBodyBytes is the largest body that is buffered
+// to verify its signature.
+const maxSignedBodyBytes = 10 << 20
+
+// hmacAlgorithms are the supported signature algorithms.
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// hmacVerifier rejects requests that are not signed with the shared
+// secret, as webhook senders usually do. The signature header holds
+// the hex encoded HMAC of the body, optionally prefixed by
+// "<algorithm>=". If timestampHeader is set, the signed payload is
+// "<timestamp>.<body>" where timestamp is in Unix seconds and must
+// be within maxSkew of the proxy clock. Otherwise, nothing prevents
+// captured requests from being replayed.
+//
+// If keyIDHeader is set, the senders have secrets of their own, named
+// by the key ID in keyIDHeader, and are identified as hmac:<key ID>.
+// Otherwise, secrets has the shared secret as "", and the holders of
+// the shared secret are a single identity, hmac.
+type hmacVerifier struct {
+	hash            func() hash.Hash
+	algorithm       string
+	secrets         map[string][]byte
+	header          string
+	keyIDHeader     string
+	timestampHeader string
+	maxSkew         time.Duration
+	handler         http.Handler
+}
+
+func (v *hmacVerifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keyID := ""
+	if v.keyIDHeader != "" {
+		keyID = r.Header.Get(v.keyIDHeader)
+	}
+	if reason := v.verify(r, keyID); reason != "" {
+		recordRejection(r.Context(), reason)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	id := "hmac"
+	if keyID != "" {
+		id += ":" + keyID
+	}
+	v.handler.ServeHTTP(w, withVerifiedIdentity(r, id))
+}
+
+// verify returns the rejection reason if the request is not
+// properly signed with the secret of keyID. The body is replaced with
+// a buffered copy.
+func (v *hmacVerifier) verify(r *http.Request, keyID string) string {
+	sig := strings.TrimPrefix(r.Header.Get(v.header), v.algorithm+"=")
+	if sig == "" {
+		return "signature_missing"
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return "signature_invalid"
+	}
+	if v.keyIDHeader != "" && keyID == "" {
+		return "signature_missing"
+	}
+	secret, ok := v.secrets[keyID]
+	if !ok {
+		return "signature_key_unknown"
+	}
+
+	mac := hmac.New(v.hash, secret)
+	if v.timestampHeader != "" {
+		ts := r.Header.Get(v.timestampHeader)
+		if ts == "" {
+			return "signature_missing"
+		}
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return "signature_timestamp_invalid"
+		}
+		skew := time.Since(time.Unix(sec, 0))
+		if skew > v.maxSkew || skew < -v.maxSkew {
+			return "signature_stale"
+		}
+		fmt.Fprintf(mac, "%s.", ts)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBodyBytes))
+		r.Body.Close()
+		if err != nil {
+			return "signature_body_too_large"
+		}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return "signature_invalid"
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"go.opencensus.io/stats"
+)
+
+// httpsHandler enforces HTTPS. Plaintext requests are either redirected
+// to their https:// URL or rejected, and the Strict-Transport-Security
+// header is added to the responses over HTTPS, the only ones it
+// applies to (RFC 6797, section 7.2).
+//
+// Requests forwarded by a load balancer terminating TLS are recognized
+// by the X-Forwarded-Proto header it set, see isHTTPS.
+type httpsHandler struct {
+	mode    string // "redirect", "reject" or "" to allow plaintext
+	hsts    string // Strict-Transport-Security value, if not empty
+	handler http.Handler
+}
+
+func (h *httpsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isHTTPS(r) {
+		if h.hsts != "" {
+			w.Header().Set("Strict-Transport-Security", h.hsts)
+		}
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	switch h.mode {
+	case "redirect":
+		stats.Record(r.Context(), httpsRedirects.M(1))
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	case "reject":
+		recordRejection(r.Context(), "plaintext")
+		http.Error(w, "HTTPS required", http.StatusForbidden)
+	default:
+		h.handler.ServeHTTP(w, r)
+	}
+}
+
+// isHTTPS reports whether the client used HTTPS to send r, either to
+// the proxy or to a trusted proxy in front, as resolved by
+// forwardedHandler.
+func isHTTPS(r *http.Request) bool {
+	proto, _ := r.Context().Value(forwardedProtoKey{}).(string)
+	return r.TLS != nil || proto == "https"
+}
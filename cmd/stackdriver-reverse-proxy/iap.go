@@ -0,0 +1,244 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// iapHeader carries the JWT signed by IAP for each request.
+	iapHeader = "X-Goog-IAP-JWT-Assertion"
+
+	// iapIssuer is the issuer of the IAP JWTs.
+	iapIssuer = "https://cloud.google.com/iap"
+
+	// iapKeysURL serves the PEM public keys of the IAP JWTs by key ID.
+	iapKeysURL = "https://www.gstatic.com/iap/verify/public_key"
+
+	// iapKeysMaxAge is how long the IAP keys are used before being
+	// fetched again. Unknown key IDs are fetched at most every
+	// iapKeysMinAge, and failed fetches retried with a backoff
+	// doubling from 1s up to iapKeysMinAge.
+	iapKeysMaxAge = time.Hour
+	iapKeysMinAge = time.Minute
+
+	// iapClockSkew is the clock skew tolerated on the JWT times.
+	iapClockSkew = 30 * time.Second
+)
+
+// iapKeys fetches and caches the public keys of the IAP JWTs. A single
+// fetch is in flight at a time, and the failed fetches are retried
+// with backoff.
+type iapKeys struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]*ecdsa.PublicKey
+	fetched  time.Time
+	fetching chan struct{} // closed when the fetch in flight is done
+	retry    time.Time     // of the next fetch after a failure
+	backoff  time.Duration
+}
+
+// key returns the public key of ID kid.
+func (k *iapKeys) key(kid string) (*ecdsa.PublicKey, error) {
+	k.mu.Lock()
+	now := time.Now()
+	key, ok := k.keys[kid]
+	switch {
+	case ok && now.Sub(k.fetched) < iapKeysMaxAge:
+	case k.fetching != nil:
+		done := k.fetching
+		k.mu.Unlock()
+		<-done
+		k.mu.Lock()
+	case now.Before(k.retry):
+	case ok || k.keys == nil || now.Sub(k.fetched) >= iapKeysMinAge:
+		done := make(chan struct{})
+		k.fetching = done
+		k.mu.Unlock()
+		keys, err := k.fetch()
+		k.mu.Lock()
+		if err != nil {
+			k.backoff *= 2
+			if k.backoff == 0 {
+				k.backoff = time.Second
+			}
+			if k.backoff > iapKeysMinAge {
+				k.backoff = iapKeysMinAge
+			}
+			k.retry = time.Now().Add(k.backoff)
+			log.Printf("ERROR: Cannot fetch the IAP keys, retrying in %v: %v", k.backoff, err)
+		} else {
+			k.keys, k.fetched, k.backoff = keys, time.Now(), 0
+		}
+		k.fetching = nil
+		close(done)
+	}
+	key, ok = k.keys[kid]
+	k.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (k *iapKeys) fetch() (map[string]*ecdsa.PublicKey, error) {
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{resp.StatusCode}
+	}
+	var pems map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&pems); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*ecdsa.PublicKey, len(pems))
+	for kid, p := range pems {
+		block, _ := pem.Decode([]byte(p))
+		if block == nil {
+			return nil, fmt.Errorf("key %q is not PEM", kid)
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", kid, err)
+		}
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key %q is not an ECDSA key", kid)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+// iapVerifier rejects with 401 the requests without a valid JWT signed
+// by Identity-Aware Proxy for audience, e.g. the requests reaching the
+// backend service around IAP. The requests are labeled with the email
+// of the verified identity as iap.email.
+type iapVerifier struct {
+	audience string
+	keys     *iapKeys
+	handler  http.Handler
+}
+
+func (v *iapVerifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get(iapHeader)
+	if token == "" {
+		recordRejection(r.Context(), "iap_missing")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	claims, err := v.verify(token, time.Now())
+	if err != nil {
+		debugf("Invalid IAP JWT for %v %v: %v", r.Method, r.URL.Path, err)
+		recordRejection(r.Context(), "iap_invalid")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if email := claimString(claims["email"]); email != "" {
+		r = r.WithContext(withLabels(r.Context(), map[string]string{"iap.email": email}))
+		r = withVerifiedIdentity(r, email)
+	}
+	if sub := claimString(claims["sub"]); sub != "" {
+		r = withVerifiedSubject(r, sub)
+	}
+	v.handler.ServeHTTP(w, r)
+}
+
+// verify returns the claims of token once its ES256 signature, issuer,
+// audience and times are verified.
+func (v *iapVerifier) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %v", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %v", err)
+	}
+	if header.Alg != "ES256" {
+		return nil, fmt.Errorf("unexpected algorithm %q", header.Alg)
+	}
+	key, err := v.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return nil, errors.New("malformed JWT signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, errors.New("invalid signature")
+	}
+	claims, err := jwtClaims(token)
+	if err != nil {
+		return nil, err
+	}
+	if iss := claimString(claims["iss"]); iss != iapIssuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if aud := claimString(claims["aud"]); aud != v.audience {
+		return nil, fmt.Errorf("unexpected audience %q", aud)
+	}
+	exp, err := claimTime(claims["exp"])
+	if err != nil || now.After(exp.Add(iapClockSkew)) {
+		return nil, errors.New("expired")
+	}
+	iat, err := claimTime(claims["iat"])
+	if err != nil || now.Add(iapClockSkew).Before(iat) {
+		return nil, errors.New("issued in the future")
+	}
+	return claims, nil
+}
+
+// claimTime parses a NumericDate claim.
+func claimTime(v interface{}) (time.Time, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, errors.New("not a number")
+	}
+	sec, err := n.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(sec), 0), nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
+)
+
+const (
+	// iamCredentialsURL is the IAM Credentials API minting the ID
+	// tokens of impersonated service accounts.
+	iamCredentialsURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/"
+
+	// idTokenRefreshMargin is how long before their expiry the ID
+	// tokens are refreshed, so that none expires on its way to the
+	// backend.
+	idTokenRefreshMargin = 5 * time.Minute
+)
+
+// newIDTokenSource returns the source of the Google-signed OIDC ID
+// tokens for audience, e.g. the URL of a Cloud Run service or the
+// client ID of an IAP-protected one. The tokens are minted for the
+// service account impersonated by the default credentials if
+// serviceAccount is set, or for the default credentials themselves:
+// a service account key file, or the metadata server on Google Cloud.
+// Google APIs are reached with base.
+func newIDTokenSource(ctx context.Context, audience, serviceAccount string, base http.RoundTripper) (oauth2.TokenSource, error) {
+	var fetch func() (string, error)
+	switch {
+	case serviceAccount != "":
+		ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{
+			Transport: &oauth2.Transport{Source: ts, Base: base},
+			Timeout:   30 * time.Second,
+		}
+		fetch = func() (string, error) {
+			return impersonatedIDToken(ctx, client, serviceAccount, audience)
+		}
+	default:
+		creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			return nil, err
+		}
+		var key serviceAccountKey
+		if len(creds.JSON) > 0 {
+			if err := json.Unmarshal(creds.JSON, &key); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case key.Type == "service_account":
+			client := &http.Client{Transport: base, Timeout: 30 * time.Second}
+			fetch = func() (string, error) {
+				return key.idToken(ctx, client, audience)
+			}
+		case len(creds.JSON) == 0 && metadata.OnGCE():
+			fetch = func() (string, error) {
+				return metadata.Get("instance/service-accounts/default/identity?format=full&audience=" + url.QueryEscape(audience))
+			}
+		default:
+			return nil, errors.New("the default credentials can't mint ID tokens, impersonate a service account")
+		}
+	}
+	return oauth2.ReuseTokenSource(nil, &idTokenSource{fetch: fetch}), nil
+}
+
+// idTokenSource returns the ID tokens fetched by fetch, expiring
+// idTokenRefreshMargin before their exp claim.
+type idTokenSource struct {
+	fetch func() (string, error)
+}
+
+func (s *idTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("cannot mint ID token: %v", err)
+	}
+	claims, err := jws.Decode(token)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode ID token: %v", err)
+	}
+	debugf("Minted ID token for %v expiring at %v", claims.Aud, time.Unix(claims.Exp, 0))
+	return &oauth2.Token{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		Expiry:      time.Unix(claims.Exp, 0).Add(-idTokenRefreshMargin),
+	}, nil
+}
+
+// impersonatedIDToken mints an ID token for audience of serviceAccount
+// with the IAM Credentials API.
+func impersonatedIDToken(ctx context.Context, client *http.Client, serviceAccount, audience string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"audience":     audience,
+		"includeEmail": true,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", iamCredentialsURL+serviceAccount+":generateIdToken", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot impersonate %v: %v", serviceAccount, resp.Status)
+	}
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Token, nil
+}
+
+// serviceAccountKey is a service account key file of the default
+// credentials.
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// idToken mints an ID token for audience by exchanging a JWT signed
+// with the key at the OAuth 2.0 token endpoint.
+func (k *serviceAccountKey) idToken(ctx context.Context, client *http.Client, audience string) (string, error) {
+	key, err := parseRSAKey([]byte(k.PrivateKey))
+	if err != nil {
+		return "", err
+	}
+	tokenURI := k.TokenURI
+	if tokenURI == "" {
+		tokenURI = google.JWTTokenURL
+	}
+	now := time.Now()
+	assertion, err := jws.Encode(&jws.Header{
+		Algorithm: "RS256",
+		Typ:       "JWT",
+		KeyID:     k.PrivateKeyID,
+	}, &jws.ClaimSet{
+		Iss:           k.ClientEmail,
+		Aud:           tokenURI,
+		Iat:           now.Unix(),
+		Exp:           now.Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{"target_audience": audience},
+	}, key)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequest("POST", tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot exchange the JWT of %v: %v", k.ClientEmail, resp.Status)
+	}
+	var out struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	if out.IDToken == "" {
+		return "", errors.New("no id_token in the token response")
+	}
+	return out.IDToken, nil
+}
+
+// parseRSAKey parses a PEM PKCS #8 or PKCS #1 RSA private key.
+func parseRSAKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("private key is not PEM")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return key, nil
+}
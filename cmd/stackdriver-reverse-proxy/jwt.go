@@ -0,0 +1,102 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// jwtClaims decodes the claims of a JWT without verifying its signature.
+func jwtClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %v", err)
+	}
+	var claims map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %v", err)
+	}
+	return claims, nil
+}
+
+// bearerToken returns the token in the named header, with
+// the optional "Bearer " prefix removed.
+func bearerToken(r *http.Request, header string) string {
+	v := r.Header.Get(header)
+	if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+		v = v[7:]
+	}
+	return strings.TrimSpace(v)
+}
+
+// claimString formats a claim value as a label value.
+// Lists, such as multiple audiences, are comma-separated.
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, item := range v {
+			s[i] = claimString(item)
+		}
+		return strings.Join(s, ",")
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// claimLabelsHandler labels requests with selected claims of the
+// JWT they carry. The JWT is not verified, the labels are only used
+// for telemetry.
+type claimLabelsHandler struct {
+	header  string
+	claims  []string
+	handler http.Handler
+}
+
+// claimLabel is the label name for the named claim.
+func claimLabel(claim string) string {
+	return "jwt." + claim
+}
+
+func (h *claimLabelsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if token := bearerToken(r, h.header); token != "" {
+		if claims, err := jwtClaims(token); err == nil {
+			labels := make(map[string]string, len(h.claims))
+			for _, c := range h.claims {
+				if v, ok := claims[c]; ok {
+					labels[claimLabel(c)] = claimString(v)
+				}
+			}
+			r = r.WithContext(withLabels(r.Context(), labels))
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// killSwitch answers the requests of the disabled routes with their
+// status, 503 by default, without proxying them. Routes can be
+// disabled and enabled at runtime through the admin API.
+type killSwitch struct {
+	handler http.Handler
+
+	mu       sync.RWMutex
+	routes   []string
+	statuses []int
+}
+
+// parseDisabledRoutes parses route or route=status items,
+// e.g. /upload/*=404.
+func parseDisabledRoutes(items []string) (*killSwitch, error) {
+	k := &killSwitch{}
+	for _, item := range items {
+		route, status := item, http.StatusServiceUnavailable
+		if strings.Contains(item, "=") {
+			var v string
+			var err error
+			if route, v, err = splitPair(item); err != nil {
+				return nil, err
+			}
+			if status, err = parseDisabledStatus(v); err != nil {
+				return nil, fmt.Errorf("invalid status for %v: %v", route, err)
+			}
+		}
+		k.Disable(route, status)
+	}
+	return k, nil
+}
+
+func parseDisabledStatus(s string) (int, error) {
+	status, err := strconv.Atoi(s)
+	if err != nil || status < 400 || status > 599 {
+		return 0, fmt.Errorf("%q is not a 4xx or 5xx status", s)
+	}
+	return status, nil
+}
+
+// Disable makes route answered with status.
+func (k *killSwitch) Disable(route string, status int) {
+	prefix := routePrefix(route)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, r := range k.routes {
+		if r == prefix {
+			k.statuses[i] = status
+			return
+		}
+	}
+	k.routes = append(k.routes, prefix)
+	k.statuses = append(k.statuses, status)
+}
+
+// SetRoutes replaces the disabled routes with those of from, e.g.
+// parsed from a reloaded -disable-routes.
+func (k *killSwitch) SetRoutes(from *killSwitch) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.routes, k.statuses = from.routes, from.statuses
+}
+
+// Enable makes route proxied again.
+func (k *killSwitch) Enable(route string) {
+	prefix := routePrefix(route)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, r := range k.routes {
+		if r == prefix {
+			k.routes = append(k.routes[:i:i], k.routes[i+1:]...)
+			k.statuses = append(k.statuses[:i:i], k.statuses[i+1:]...)
+			return
+		}
+	}
+}
+
+func (k *killSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.RLock()
+	status := 0
+	if i := matchRoute(k.routes, r.URL.Path); i >= 0 {
+		status = k.statuses[i]
+	}
+	k.mu.RUnlock()
+	if status == 0 {
+		k.handler.ServeHTTP(w, r)
+		return
+	}
+	recordRejection(r.Context(), "route_disabled")
+	http.Error(w, http.StatusText(status), status)
+}
+
+// killSwitchAdmin serves the disabled routes admin endpoint. GET
+// returns the disabled routes, POST disables the route query parameter
+// with the optional status one, and DELETE enables it again.
+type killSwitchAdmin struct {
+	k *killSwitch
+}
+
+func (a killSwitchAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := r.URL.Query().Get("route")
+	if r.Method != "GET" && route == "" {
+		http.Error(w, "missing route", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		status := http.StatusServiceUnavailable
+		if s := r.URL.Query().Get("status"); s != "" {
+			var err error
+			if status, err = parseDisabledStatus(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		a.k.Disable(route, status)
+		log.Printf("WARNING: Disabled the route %v, answered with %d", route, status)
+	case "DELETE":
+		a.k.Enable(route)
+		log.Printf("Enabled the route %v", route)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	a.k.mu.RLock()
+	out := make(map[string]int, len(a.k.routes))
+	for i, r := range a.k.routes {
+		out[r+"*"] = a.k.statuses[i]
+	}
+	a.k.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// Labels are request dimensions, such as JWT claims, that are added
+// to the server span as attributes, to the stats as tags and to the
+// request logs as fields.
+//
+// Labels must be added to the request context before ochttp.Handler
+// starts recording stats for the request.
+
+type labelsKey struct{}
+
+// withLabels returns a copy of ctx carrying labels in addition
+// to the labels already in ctx.
+func withLabels(ctx context.Context, labels map[string]string) context.Context {
+	merged := make(map[string]string)
+	for k, v := range labelsFromContext(ctx) {
+		merged[k] = v
+	}
+	var mutators []tag.Mutator
+	for k, v := range labels {
+		merged[k] = v
+		key, err := tag.NewKey(k)
+		if err != nil {
+			continue
+		}
+		mutators = append(mutators, tag.Upsert(key, tagValue(v)))
+	}
+	ctx, _ = tag.New(ctx, mutators...)
+	return context.WithValue(ctx, labelsKey{}, merged)
+}
+
+// labelsFromContext returns the labels added to ctx, it must not be modified.
+func labelsFromContext(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(labelsKey{}).(map[string]string)
+	return labels
+}
+
+// tagValue makes v a valid tag value by replacing
+// non-printable ASCII and truncating it.
+func tagValue(v string) string {
+	b := []byte(v)
+	if len(b) > 255 {
+		b = b[:255]
+	}
+	for i, c := range b {
+		if c < 0x20 || c > 0x7e {
+			b[i] = '?'
+		}
+	}
+	return string(b)
+}
+
+// labelSpanHandler adds the request labels to the server span.
+// It must be installed inside ochttp.Handler.
+type labelSpanHandler struct {
+	handler http.Handler
+}
+
+func (h *labelSpanHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	labels := labelsFromContext(r.Context())
+	if len(labels) > 0 {
+		attrs := make([]trace.Attribute, 0, len(labels))
+		for k, v := range labels {
+			attrs = append(attrs, trace.StringAttribute(k, v))
+		}
+		trace.FromContext(r.Context()).SetAttributes(attrs...)
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// labeledViews returns views breaking down the server request count
+// and latency by the named labels.
+func labeledViews(names []string) []*view.View {
+	var keys []tag.Key
+	for _, name := range names {
+		k, err := tag.NewKey(name)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return []*view.View{
+		{
+			Name:        "stackdriver-reverse-proxy/request_count_by_label",
+			Description: "Count of requests by request label",
+			TagKeys:     keys,
+			Measure:     ochttp.ServerRequestCount,
+			Aggregation: view.CountAggregation{},
+		},
+		{
+			Name:        "stackdriver-reverse-proxy/latency_by_label",
+			Description: "Latency distribution of requests by request label and status code",
+			TagKeys:     append(keys, ochttp.StatusCode),
+			Measure:     ochttp.ServerLatency,
+			Aggregation: ochttp.DefaultLatencyDistribution,
+		},
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// limitHandler rejects requests whose URL is longer than the
+// configured limit. The size of the header block is limited by the
+// MaxHeaderBytes of the http.Server.
+type limitHandler struct {
+	maxURLLength int
+	handler      http.Handler
+}
+
+func (h *limitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.maxURLLength > 0 && len(r.RequestURI) > h.maxURLLength {
+		recordRejection(r.Context(), "url_too_long")
+		http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// byteSizeUnits are the suffixes of byte sizes.
+var byteSizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteSize parses a number of bytes with an optional KB, MB or
+// GB suffix, e.g. 64KB.
+func parseByteSize(s string) (int64, error) {
+	num, unit := s, int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(strings.ToUpper(s), u.suffix) {
+			num, unit = s[:len(s)-len(u.suffix)], u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * unit, nil
+}
+
+// bodyLimits are the maximum sizes of the request bodies per route,
+// or max elsewhere. Zero is unlimited.
+type bodyLimits struct {
+	max    int64
+	routes []string
+	limits []int64
+}
+
+// parseBodyLimits parses route=size items, e.g. /upload/*=10MB.
+func parseBodyLimits(max int64, items []string) (*bodyLimits, error) {
+	b := &bodyLimits{max: max}
+	for _, item := range items {
+		route, v, err := splitPair(item)
+		if err != nil {
+			return nil, err
+		}
+		n, err := parseByteSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit for %v: %v", route, err)
+		}
+		b.routes = append(b.routes, routePrefix(route))
+		b.limits = append(b.limits, n)
+	}
+	return b, nil
+}
+
+// match returns the route of path, as its prefix followed by *, or
+// other, and its limit.
+func (b *bodyLimits) match(path string) (route string, limit int64) {
+	if i := matchRoute(b.routes, path); i >= 0 {
+		return b.routes[i] + "*", b.limits[i]
+	}
+	return "other", b.max
+}
+
+// bodyLimitHandler rejects the requests whose body is larger than
+// the limit of their route with 413, and records the body sizes by
+// route.
+type bodyLimitHandler struct {
+	limits  *bodyLimits
+	handler http.Handler
+}
+
+func (h *bodyLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, limit := h.limits.match(r.URL.Path)
+	if limit > 0 && r.ContentLength > limit {
+		recordRejection(r.Context(), "body_too_large")
+		recordRequestBody(r.Context(), route, r.ContentLength)
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		recordRequestBody(r.Context(), route, 0)
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = body
+	if limit > 0 {
+		// Bodies of unknown length fail to be read past the limit.
+		r.Body = http.MaxBytesReader(w, body, limit)
+	}
+	h.handler.ServeHTTP(w, r)
+	recordRequestBody(r.Context(), route, body.n)
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "64KB", want: 64 << 10},
+		{in: "64kb", want: 64 << 10},
+		{in: "10 MB", want: 10 << 20},
+		{in: "2GB", want: 2 << 30},
+		{in: "9223372036854775807", want: math.MaxInt64},
+		{in: "8589934591GB", want: 8589934591 << 30},
+		{in: "8589934592GB", wantErr: true},
+		{in: "9223372036854775808", wantErr: true},
+		{in: "9007199254740992KB", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "KB", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1.5MB", wantErr: true},
+		{in: "1TB", wantErr: true},
+		{in: "1 K", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseByteSize(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestLimitHandler(t *testing.T) {
+	h := &limitHandler{
+		maxURLLength: 16,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	}
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/0123456789abcde", http.StatusNoContent},
+		{"/0123456789abcdef", http.StatusRequestURITooLong},
+		{"/?q=" + strings.Repeat("x", 16), http.StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %v = %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	b, err := parseBodyLimits(1<<10, []string{"/upload/*=10MB", "/small=1B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		route string
+		limit int64
+	}{
+		{"/upload/a", "/upload/*", 10 << 20},
+		{"/small", "/small*", 1},
+		{"/", "other", 1 << 10},
+	}
+	for _, tt := range tests {
+		if route, limit := b.match(tt.path); route != tt.route || limit != tt.limit {
+			t.Errorf("match(%q) = %q, %v, want %q, %v", tt.path, route, limit, tt.route, tt.limit)
+		}
+	}
+	for _, items := range [][]string{{"/upload"}, {"/upload=10XB"}, {"/upload=99999999999GB"}} {
+		if _, err := parseBodyLimits(0, items); err == nil {
+			t.Errorf("parseBodyLimits(%q) succeeded, want an error", items)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const loadtestUsage = `stackdriver-reverse-proxy loadtest [opts...] -target=<url>
+
+Sends synthetic traffic to the target, typically a deployed proxy,
+and prints the latency percentiles.
+
+Options:
+  -target         URL of the proxy, e.g. http://localhost:6996.
+  -qps            Requests per second, by default 10.
+  -duration       How long to send requests, by default 10s.
+  -paths          Comma-separated paths with optional weights, e.g. /=1,/api=3.
+  -method         HTTP method, by default GET.
+  -concurrency    Maximum requests in flight, by default 100. The requests due
+                  while they are all in flight are skipped, and counted.
+`
+
+// weightedPath is a path requested with the given relative weight.
+type weightedPath struct {
+	path   string
+	weight int
+}
+
+func parseWeightedPaths(v string) ([]weightedPath, error) {
+	var paths []weightedPath
+	for _, item := range splitList(v) {
+		wp := weightedPath{path: item, weight: 1}
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			w, err := strconv.Atoi(item[i+1:])
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight in %q", item)
+			}
+			wp = weightedPath{path: item[:i], weight: w}
+		}
+		paths = append(paths, wp)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no path")
+	}
+	return paths, nil
+}
+
+// pick returns a random path according to the weights.
+func pick(paths []weightedPath, total int) string {
+	n := rand.Intn(total)
+	for _, p := range paths {
+		if n < p.weight {
+			return p.path
+		}
+		n -= p.weight
+	}
+	return paths[len(paths)-1].path
+}
+
+// loadResult is the outcome of a single request.
+type loadResult struct {
+	latency time.Duration
+	status  int
+	err     error
+}
+
+func loadtestMain(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(loadtestUsage)
+	}
+	target := fs.String("target", "", "URL of the proxy")
+	qps := fs.Float64("qps", 10, "requests per second")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send requests")
+	pathList := fs.String("paths", "/", "paths with optional weights")
+	method := fs.String("method", "GET", "HTTP method")
+	concurrency := fs.Int("concurrency", 100, "maximum requests in flight")
+	fs.Parse(args)
+	if *target == "" || *qps <= 0 || *concurrency < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	paths, err := parseWeightedPaths(*pathList)
+	if err != nil {
+		log.Fatalf("Invalid -paths: %v", err)
+	}
+	total := 0
+	for _, p := range paths {
+		total += p.weight
+	}
+	base := strings.TrimSuffix(*target, "/")
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: *concurrency,
+		},
+		Timeout: 30 * time.Second,
+	}
+	start := time.Now()
+	results, skipped := sendLoad(*qps, *duration, *concurrency, func() loadResult {
+		return fire(client, *method, base+pick(paths, total))
+	})
+	printLoadResults(results, skipped, time.Since(start))
+}
+
+// sendLoad calls send qps times per second for duration, with at most
+// concurrency calls in flight. It returns their results and the number
+// of calls skipped because concurrency calls were in flight.
+func sendLoad(qps float64, duration time.Duration, concurrency int, send func() loadResult) (results []loadResult, skipped int) {
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, concurrency)
+	)
+	tick := time.NewTicker(time.Duration(float64(time.Second) / qps))
+	defer tick.Stop()
+	end := time.After(duration)
+loop:
+	for {
+		select {
+		case <-end:
+			break loop
+		case <-tick.C:
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			// Waiting for a slot would hide the latency of the
+			// target behind a lower rate.
+			skipped++
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			res := send()
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results, skipped
+}
+
+func fire(client *http.Client, method, url string) loadResult {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return loadResult{err: err}
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return loadResult{err: err, latency: time.Since(start)}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return loadResult{latency: time.Since(start), status: resp.StatusCode}
+}
+
+func printLoadResults(results []loadResult, skipped int, elapsed time.Duration) {
+	if skipped > 0 {
+		fmt.Printf("Skipped: %d, -concurrency requests were in flight\n", skipped)
+	}
+	if len(results) == 0 {
+		fmt.Println("No requests sent")
+		return
+	}
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	errors := 0
+	for _, r := range results {
+		if r.err != nil {
+			errors++
+			continue
+		}
+		statuses[r.status]++
+		latencies = append(latencies, r.latency)
+	}
+	fmt.Printf("Requests: %d in %v (%.1f/s), errors: %d\n",
+		len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds(), errors)
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("  %d: %d\n", code, statuses[code])
+	}
+
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Println("Latency:")
+	for _, p := range []float64{50, 90, 95, 99} {
+		fmt.Printf("  p%v: %v\n", p, percentile(latencies, p))
+	}
+	fmt.Printf("  max: %v\n", latencies[len(latencies)-1])
+}
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
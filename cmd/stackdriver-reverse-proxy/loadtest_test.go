@@ -0,0 +1,81 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendLoadConcurrency(t *testing.T) {
+	var (
+		mu             sync.Mutex
+		inflight, peak int
+	)
+	results, skipped := sendLoad(1000, 100*time.Millisecond, 3, func() loadResult {
+		mu.Lock()
+		inflight++
+		if inflight > peak {
+			peak = inflight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		return loadResult{status: 200}
+	})
+	if peak > 3 {
+		t.Errorf("%d calls in flight, want at most 3", peak)
+	}
+	if len(results) == 0 || skipped == 0 {
+		t.Errorf("%d results, %d skipped, want both, the calls are slower than the rate", len(results), skipped)
+	}
+}
+
+func TestSendLoadRate(t *testing.T) {
+	results, skipped := sendLoad(100, 200*time.Millisecond, 10, func() loadResult {
+		return loadResult{status: 200}
+	})
+	if skipped != 0 {
+		t.Errorf("%d calls skipped, want none", skipped)
+	}
+	if n := len(results); n < 10 || n > 21 {
+		t.Errorf("%d calls in 200ms at 100 qps, want about 20", n)
+	}
+}
+
+func TestParseWeightedPaths(t *testing.T) {
+	paths, err := parseWeightedPaths("/=1,/api=3,/a=b")
+	if err == nil {
+		t.Errorf("parseWeightedPaths with a non-numeric weight = %v, want an error", paths)
+	}
+	paths, err = parseWeightedPaths("/,/api=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []weightedPath{{"/", 1}, {"/api", 3}}
+	if len(paths) != 2 || paths[0] != want[0] || paths[1] != want[1] {
+		t.Errorf("parseWeightedPaths = %v, want %v", paths, want)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[pick(paths, 4)]++
+	}
+	if counts["/api"] < 2*counts["/"] {
+		t.Errorf("picked %v, want /api about 3 times as often as /", counts)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFileFlushPeriod is how long compressed lines can be buffered
+// before they reach the file.
+const logFileFlushPeriod = time.Second
+
+// logFiles opens the files written by the proxy, rolled over and
+// compressed as configured, and closes them on exit.
+type logFiles struct {
+	maxSize  int64 // bytes on disk, 0 for no rollover
+	compress bool
+
+	mu    sync.Mutex
+	files []*logFile
+}
+
+// open opens the file to append to. Without rollover nor compression,
+// it is a plain file.
+func (l *logFiles) open(path string) (io.WriteCloser, error) {
+	if l.maxSize == 0 && !l.compress {
+		return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	if l.compress {
+		// The last gzip member of the file is incomplete if the
+		// proxy did not exit cleanly, start a new segment.
+		if fi, err := os.Stat(path); err == nil && fi.Size() > 0 {
+			if err := os.Rename(path, segmentName(path)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	lf := &logFile{path: path, maxSize: l.maxSize, compress: l.compress}
+	if err := lf.openSegment(); err != nil {
+		return nil, err
+	}
+	if l.compress {
+		go lf.flushLoop()
+	}
+	l.mu.Lock()
+	l.files = append(l.files, lf)
+	l.mu.Unlock()
+	return lf, nil
+}
+
+// Close closes the files opened, completing the compressed streams.
+func (l *logFiles) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, lf := range l.files {
+		lf.Close()
+	}
+}
+
+// logFile appends to a file that is renamed with a timestamp when it
+// reaches the maximum size, optionally gzip compressed on the fly.
+// The segments of a compressed file are concatenated gzip members,
+// read as a whole by gzip and zcat.
+type logFile struct {
+	path     string
+	maxSize  int64
+	compress bool
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	gz   *gzip.Writer
+}
+
+func (lf *logFile) openSegment() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f, lf.size, lf.gz = f, fi.Size(), nil
+	if lf.compress {
+		lf.gz = gzip.NewWriter(lf.file())
+	}
+	return nil
+}
+
+// file returns the writer of the current segment counting its size.
+func (lf *logFile) file() io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		n, err := lf.f.Write(p)
+		lf.size += int64(n)
+		return n, err
+	})
+}
+
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		// A previous rollover failed; try again.
+		if err := lf.openSegment(); err != nil {
+			return 0, err
+		}
+	}
+	var (
+		n   int
+		err error
+	)
+	if lf.gz != nil {
+		n, err = lf.gz.Write(p)
+	} else {
+		n, err = lf.file().Write(p)
+	}
+	if err != nil {
+		return n, err
+	}
+	if lf.maxSize > 0 && lf.size >= lf.maxSize {
+		err = lf.rollOver()
+	}
+	return n, err
+}
+
+// rollOver closes the current segment, renames it and opens a new one.
+func (lf *logFile) rollOver() error {
+	if err := lf.closeSegment(); err != nil {
+		return err
+	}
+	if err := os.Rename(lf.path, segmentName(lf.path)); err != nil {
+		return err
+	}
+	return lf.openSegment()
+}
+
+// segmentName returns the name of a segment of the file rolled over
+// now, <name>-<UTC timestamp><ext>.
+func segmentName(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + time.Now().UTC().Format("20060102T150405.000") + ext
+}
+
+func (lf *logFile) closeSegment() error {
+	var err error
+	if lf.gz != nil {
+		err = lf.gz.Close()
+	}
+	if cerr := lf.f.Close(); err == nil {
+		err = cerr
+	}
+	lf.f, lf.gz = nil, nil
+	return err
+}
+
+// flushLoop writes the buffered compressed lines to the file
+// periodically, so it can be followed with zcat, and rolls it over
+// once they reach the maximum size.
+func (lf *logFile) flushLoop() {
+	for range time.Tick(logFileFlushPeriod) {
+		lf.mu.Lock()
+		if lf.gz != nil {
+			lf.gz.Flush()
+			if lf.maxSize > 0 && lf.size >= lf.maxSize {
+				lf.rollOver()
+			}
+		}
+		lf.mu.Unlock()
+	}
+}
+
+// Close completes the compressed stream and closes the file.
+func (lf *logFile) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	return lf.closeSegment()
+}
+
+// writerFunc is a function writer.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
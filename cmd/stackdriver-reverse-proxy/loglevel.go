@@ -0,0 +1,95 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// logLevel is the rank of the lowest severity logged, adjustable at
+// runtime through the admin API and signals. It is INFO by default.
+var logLevel int32 = 1
+
+// setLogLevel sets the lowest severity logged.
+func setLogLevel(level int) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// logLevelEnabled reports whether the lines of level are logged.
+func logLevelEnabled(level int) bool {
+	return int32(level) >= atomic.LoadInt32(&logLevel)
+}
+
+// debugf logs a DEBUG line if the DEBUG level is enabled, without
+// formatting it otherwise.
+func debugf(format string, v ...interface{}) {
+	if logLevelEnabled(0) {
+		log.Printf("DEBUG: "+format, v...)
+	}
+}
+
+// handleLogLevelSignals makes SIGUSR1 log one more severity, down to
+// DEBUG, and SIGUSR2 one less, up to ERROR. The changes are audited.
+func handleLogLevelSignals(audit *auditLogger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range c {
+		level := int(atomic.LoadInt32(&logLevel))
+		if sig == syscall.SIGUSR1 && level > 0 {
+			level--
+		}
+		if sig == syscall.SIGUSR2 && level < len(severities)-1 {
+			level++
+		}
+		setLogLevel(level)
+		audit.LogLocal("proxy.SetLogLevel", "log-level", map[string]interface{}{
+			"signal": sig.String(),
+			"level":  severities[level],
+		})
+		log.Printf("Set the log level to %v on %v", severities[level], sig)
+	}
+}
+
+// logLevelHandler serves the log level admin endpoint. GET returns
+// the level, POST sets it to the level query parameter.
+type logLevelHandler struct{}
+
+func (logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		level, err := severityLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setLogLevel(level)
+		log.Printf("Set the log level to %v", severities[level])
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"level": severities[atomic.LoadInt32(&logLevel)],
+	})
+}
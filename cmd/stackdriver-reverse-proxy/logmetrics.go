@@ -0,0 +1,196 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+)
+
+const logmetricsUsage = `stackdriver-reverse-proxy setup-logmetrics [opts...]
+
+Creates or updates log-based metrics counting the proxy errors, failed
+backend requests, exceeded latency budgets, failovers and 5xx responses
+by route from the logs written with -cloud-logging.
+
+Options:
+  -project        Project of the logs and metrics, by default the project
+                  of the application default credentials.
+  -log            Name of the log written by the proxy, by default
+                  stackdriver-reverse-proxy.
+  -dry-run        Print the metric definitions instead of creating them.
+`
+
+const loggingMetricsURL = "https://logging.googleapis.com/v2/projects/"
+
+// logMetric is a Cloud Logging LogMetric.
+type logMetric struct {
+	Name             string            `json:"name"`
+	Description      string            `json:"description"`
+	Filter           string            `json:"filter"`
+	MetricDescriptor metricDescriptor  `json:"metricDescriptor"`
+	LabelExtractors  map[string]string `json:"labelExtractors,omitempty"`
+}
+
+type metricDescriptor struct {
+	MetricKind string            `json:"metricKind"`
+	ValueType  string            `json:"valueType"`
+	Labels     []labelDescriptor `json:"labels,omitempty"`
+}
+
+type labelDescriptor struct {
+	Key       string `json:"key"`
+	ValueType string `json:"valueType"`
+}
+
+// counter returns a log-based metric counting the entries of the log
+// matching filter, with string labels extracted by extractors.
+func counter(name, description, logName, filter string, extractors map[string]string) logMetric {
+	m := logMetric{
+		Name:             "stackdriver-reverse-proxy/" + name,
+		Description:      description,
+		Filter:           fmt.Sprintf("logName=%q AND %v", logName, filter),
+		MetricDescriptor: metricDescriptor{MetricKind: "DELTA", ValueType: "INT64"},
+		LabelExtractors:  extractors,
+	}
+	for k := range extractors {
+		m.MetricDescriptor.Labels = append(m.MetricDescriptor.Labels, labelDescriptor{Key: k, ValueType: "STRING"})
+	}
+	return m
+}
+
+// proxyLogMetrics returns the log-based metrics of the entries written
+// by the proxy to logName.
+func proxyLogMetrics(logName string) []logMetric {
+	return []logMetric{
+		counter("errors", "Count of the proxy errors by error group",
+			logName, "severity>=ERROR",
+			map[string]string{"error_group": "EXTRACT(labels.error_group)"}),
+		counter("backend_request_failures", "Count of the failed backend requests by host",
+			logName, `jsonPayload.message=~"^Request to \\S+ failed"`,
+			map[string]string{"host": `REGEXP_EXTRACT(jsonPayload.message, "^Request to (\\S+) failed")`}),
+		counter("latency_budgets_exceeded", "Count of the requests over their latency budget by route",
+			logName, `severity=WARNING AND textPayload:"budget of"`,
+			map[string]string{"route": `REGEXP_EXTRACT(textPayload, "budget of (\\S+),")`}),
+		counter("failovers", "Count of the failovers by target failed over to",
+			logName, `jsonPayload.message:"Failing over from"`,
+			map[string]string{"target": `REGEXP_EXTRACT(jsonPayload.message, " to (\\S+)$")`}),
+		counter("responses_5xx", "Count of the 5xx responses by route, the first path segment",
+			logName, "httpRequest.status>=500",
+			map[string]string{"route": `REGEXP_EXTRACT(httpRequest.requestUrl, "^(?:[a-z]+://[^/]+)?(/[^/?]*)")`}),
+	}
+}
+
+func logmetricsMain(args []string) {
+	fs := flag.NewFlagSet("setup-logmetrics", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(logmetricsUsage)
+	}
+	project := fs.String("project", "", "project of the logs and metrics")
+	name := fs.String("log", "stackdriver-reverse-proxy", "name of the log written by the proxy")
+	dryRun := fs.Bool("dry-run", false, "print the metric definitions")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil && !*dryRun {
+		log.Fatal(err)
+	}
+	if *project == "" && creds != nil {
+		*project = creds.ProjectID
+	}
+	if *project == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	logName := "projects/" + *project + "/logs/" + strings.Replace(*name, "/", "%2F", -1)
+	metrics := proxyLogMetrics(logName)
+	if *dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(metrics)
+		return
+	}
+
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := false
+	for _, m := range metrics {
+		created, err := upsertLogMetric(client, *project, m)
+		switch {
+		case err != nil:
+			log.Printf("Cannot set up %v: %v", m.Name, err)
+			failed = true
+		case created:
+			fmt.Printf("Created %v\n", m.Name)
+		default:
+			fmt.Printf("Updated %v\n", m.Name)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// upsertLogMetric creates the metric m in project, or updates it if
+// it exists.
+func upsertLogMetric(client *http.Client, project string, m logMetric) (created bool, err error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Post(loggingMetricsURL+project+"/metrics", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusConflict {
+		return true, checkResponse(resp)
+	}
+	resp.Body.Close()
+	req, err := http.NewRequest("PUT", loggingMetricsURL+project+"/metrics/"+url.PathEscape(m.Name), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	return false, checkResponse(resp)
+}
+
+// checkResponse closes resp and returns an error unless it is a 200.
+func checkResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(msg))
+}
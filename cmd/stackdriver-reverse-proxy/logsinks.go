@@ -0,0 +1,178 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// severities are the log severities, from the lowest.
+var severities = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+// severityLevel returns the rank of the named severity. WARN is
+// WARNING.
+func severityLevel(name string) (int, error) {
+	if strings.EqualFold(name, "warn") {
+		name = "WARNING"
+	}
+	for i, s := range severities {
+		if strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %q, want %v", name, strings.Join(severities, ", "))
+}
+
+// logTimestampLayout is the prefix of the lines of the standard
+// logger with the default flags.
+const logTimestampLayout = "2006/01/02 15:04:05 "
+
+// traceSuffix matches the IDs appended by requestLogf.
+var traceSuffix = regexp.MustCompile(` trace=([0-9a-f]{32}) span=([0-9a-f]{16})$`)
+
+// logLine is a line of the standard logger.
+type logLine struct {
+	time     time.Time
+	severity string
+	message  string
+	traceID  string
+	spanID   string
+}
+
+// parseLine parses a line of the standard logger with the default
+// flags. The severity is given by the ERROR:, WARNING: and DEBUG:
+// prefixes of the message, INFO otherwise, and the trace by the IDs appended
+// by requestLogf.
+func parseLine(line string) logLine {
+	ll := logLine{time: time.Now(), severity: "INFO"}
+	line = strings.TrimRight(line, "\n")
+	if len(line) >= len(logTimestampLayout) {
+		if t, err := time.ParseInLocation(logTimestampLayout, line[:len(logTimestampLayout)], time.Local); err == nil {
+			ll.time = t
+			line = line[len(logTimestampLayout):]
+		}
+	}
+	if m := traceSuffix.FindStringSubmatch(line); m != nil {
+		ll.traceID, ll.spanID = m[1], m[2]
+		line = line[:len(line)-len(m[0])]
+	}
+	switch {
+	case strings.HasPrefix(line, "ERROR: "):
+		ll.severity = "ERROR"
+		line = line[len("ERROR: "):]
+	case strings.HasPrefix(line, "WARNING: "):
+		ll.severity = "WARNING"
+		line = line[len("WARNING: "):]
+	case strings.HasPrefix(line, "DEBUG: "):
+		ll.severity = "DEBUG"
+		line = line[len("DEBUG: "):]
+	}
+	ll.message = line
+	return ll
+}
+
+// logSink is a destination of the lines of at least a severity.
+type logSink struct {
+	w   io.Writer
+	min int
+}
+
+// logRouter is the writer of the standard logger routing the lines
+// to the sinks by severity. The lines below the log level are dropped
+// and the others are scrubbed first.
+type logRouter struct {
+	scrub *scrubber
+	sinks []logSink
+}
+
+// newLogRouter returns a router to the sinks of the form
+// <sink>=<min severity>, where sink is stderr, cloud-logging, the URL
+// of a syslog or GELF server, or the path of a file to append to.
+// Without sinks, all the lines are written to stderr, and to cl if
+// not nil. The lines written to log servers carry the static labels,
+// and the files are rolled over and compressed with files.
+func newLogRouter(sinks []string, cl *cloudLogger, scrub *scrubber, labels map[string]string, files *logFiles) (*logRouter, error) {
+	if len(sinks) == 0 {
+		r := &logRouter{scrub: scrub, sinks: []logSink{{w: os.Stderr}}}
+		if cl != nil {
+			r.sinks = append(r.sinks, logSink{w: cl})
+		}
+		return r, nil
+	}
+	r := &logRouter{scrub: scrub}
+	for _, item := range sinks {
+		name, severity, err := splitPair(item)
+		if err != nil {
+			return nil, err
+		}
+		min, err := severityLevel(severity)
+		if err != nil {
+			return nil, err
+		}
+		var w io.Writer
+		switch name {
+		case "stderr":
+			w = os.Stderr
+		case "cloud-logging":
+			if cl == nil {
+				return nil, errors.New("the cloud-logging sink requires -cloud-logging")
+			}
+			w = cl
+		case "":
+			return nil, fmt.Errorf("no sink in %q", item)
+		default:
+			if strings.Contains(name, "://") {
+				u, err := url.Parse(name)
+				if err != nil {
+					return nil, err
+				}
+				if w, err = newNetLogSink(u, labels); err != nil {
+					return nil, err
+				}
+				break
+			}
+			f, err := files.open(name)
+			if err != nil {
+				return nil, err
+			}
+			w = f
+		}
+		r.sinks = append(r.sinks, logSink{w: w, min: min})
+	}
+	return r, nil
+}
+
+// Write writes a line of the standard logger to the sinks of its
+// severity. The standard logger serializes the writes.
+func (r *logRouter) Write(p []byte) (int, error) {
+	level, _ := severityLevel(parseLine(string(p)).severity)
+	if !logLevelEnabled(level) {
+		return len(p), nil
+	}
+	line := r.scrub.Scrub(string(p))
+	for _, s := range r.sinks {
+		if level >= s.min {
+			s.w.Write([]byte(line))
+		}
+	}
+	return len(p), nil
+}
@@ -18,95 +18,1999 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/GoogleCloudPlatform/stackdriver-reverse-proxy/sproxy"
 	"go.opencensus.io/exporter/stackdriver"
-	"go.opencensus.io/exporter/stackdriver/propagation"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 )
 
 var (
-	projectID string
+	configFile string
 
-	listen    string
-	target    string
-	tlsCert   string
-	tlsKey    string
-	traceFrac float64
+	projectID      string
+	exportProjects string
+	exportTo       string
+	telemetry      string
+	exportFormat   string
+
+	traceEndpoint      string
+	monitoringEndpoint string
+	loggingEndpoint    string
+	collectorEndpoint  string
+	exportInsecure     bool
+	exportRetries      int
+	egressProxy        string
+	metricKind         string
+
+	listen            string
+	target            string
+	tlsCert           string
+	tlsKey            string
+	clientCA          string
+	requireClientCert bool
+	acmeDomains       string
+	acmeCache         string
+	acmeEmail         string
+	acmeDirectory     string
+
+	grpcTarget       string
+	targetServerName string
+	targetTLSCert    string
+	targetTLSKey     string
+	targetCA         string
+	targetInsecure   bool
+	targetIDAudience string
+	targetIDAccount  string
+	targetSOCKS5     string
+	targetFamily     string
+	failoverTargets  string
+	healthPath       string
+	healthInterval   time.Duration
+	shutdownTimeout  time.Duration
+	balancePolicy    string
+	breakerFailures  int
+	breakerTimeout   time.Duration
+	retries          int
+	retryBackoff     time.Duration
+	readinessPath    string
+	warmupPaths      string
+	warmupCount      int
+	warmupTimeout    time.Duration
+	listenFamily     string
+	traceFrac        float64
+	routeSampling    string
+
+	traceMaxQPS         float64
+	traceForceHeader    string
+	traceHeaders        bool
+	backendTraceFormats string
+	propagationFormats  string
+	excludePaths        string
+
+	normalizeIDs  bool
+	pathTemplates string
+
+	heartbeatInterval time.Duration
+	instance          string
+
+	maxHeaderBytes int
+	maxURLLength   int
+	maxBodyBytes   string
+	routeBodyBytes string
+
+	dialTimeout           time.Duration
+	backendTLSTimeout     time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+	requestTimeout        time.Duration
+	readTimeout           time.Duration
+	writeTimeout          time.Duration
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	tcpKeepAlive        time.Duration
+	disableKeepAlives   bool
+
+	cacheSize string
+
+	auditLogFile    string
+	accessLog       string
+	report5xx       bool
+	errorService    string
+	errorVersion    string
+	cloudLogging    bool
+	globalLabels    string
+	logSinks        string
+	logFileMaxSize  string
+	logFileCompress bool
+
+	recordFile string
+	recordBody bool
+
+	debugTiming    time.Duration
+	debugTraceURLs bool
+
+	latencyBudgetList     string
+	latencyBudgetAnnotate bool
+
+	adminListen      string
+	prometheusListen string
+	adminTokenSecret string
+	controlSub       string
+	configRefresh    time.Duration
+
+	scrubPatterns repeatedFlag
+	scrubFields   string
+
+	opaURL        string
+	opaHeaderList string
+
+	jwtHeader      string
+	jwtClaimLabels string
+	baggageKeys    string
+	baggageSet     string
+	tenantSpec     string
+	tenantHash     bool
+
+	rateLimit         float64
+	rateLimitBurst    int
+	rateLimitIdentity string
+	rateLimitQuotas   repeatedFlag
+	rateLimitRedis    string
+	rateLimitRedisCA  string
+	globalRateLimit   float64
+	globalRateBurst   int
+	requestQuotas     repeatedFlag
+
+	hmacSecret          string
+	hmacAlgorithm       string
+	hmacHeader          string
+	hmacKeyIDHeader     string
+	hmacTimestampHeader string
+	hmacMaxSkew         time.Duration
+
+	apiKeys      string
+	apiKeyHeader string
+
+	iapAudience string
+
+	spiffeSocket    string
+	spiffeBackendID string
+
+	httpsOnly string
+	hsts      string
+
+	trustedProxySpec string
+	forwardedHeaders string
+
+	blockRulesFile string
+	headerRules    string
+	blockBodyLimit int64
+	disableRoutes  string
+
+	shed             bool
+	shedInitialLimit int
+	shedMaxLimit     int
 
 	disableMonitoring bool
-	monitoringPeriod  string
+	monitoringPeriod  time.Duration
+	viewPeriods       repeatedFlag
+	subscribedViews   string
 )
 
 const usage = `stackdriver-reverse-proxy [opts...] -target=<host:port>
+stackdriver-reverse-proxy replay [opts...] -target=<host:port> <file>
+stackdriver-reverse-proxy loadtest [opts...] -target=<url>
+stackdriver-reverse-proxy setup-logmetrics [opts...]
 
 For example, to start at localhost:6996 to proxy requests to localhost:6060,
   $ stackdriver-reverse-proxy -target=http://localhost:6060
 
 Options:
   -http           hostname:port to start the proxy server, by default localhost:6996.
-  -target         hostname:port where the app server is running.
+  -target         hostname:port where the app server is running, or comma-separated
+                  URLs of several app servers to balance the requests across. The
+                  server spans are labeled with the target as backend.target.
+                  The WebSocket, gRPC and warm-up requests go to the first one.
+  -balance-policy How requests are spread across the targets: round-robin
+                  (default) or least-connections.
+  -target-server-name
+                  Server name sent with SNI to and verified against an https
+                  -target, by default its hostname.
+  -target-tls-cert
+                  Certificate file presented to the https targets that request
+                  client certificates, for mutual TLS. Reloaded with -tls-cert.
+  -target-tls-key Key file of -target-tls-cert.
+  -target-ca      File of the PEM CA certificates the https targets are verified
+                  against, instead of the system roots. Read at startup.
+  -target-insecure-skip-verify
+                  INSECURE, for development only: don't verify the certificates
+                  of the https targets, exposing the traffic to them to
+                  man-in-the-middle attacks.
+  -target-id-token-audience
+                  Audience of the Google-signed OIDC ID tokens sent to the targets
+                  as Authorization: Bearer, e.g. the URL of a Cloud Run service or
+                  the OAuth client ID of an IAP-protected one. The tokens are minted
+                  with the default credentials, a service account key file or the
+                  metadata server, and refreshed 5m before they expire.
+  -target-id-token-service-account
+                  Email of the service account the ID tokens are minted for,
+                  impersonated by the default credentials with the IAM
+                  Credentials API, e.g. when running with user credentials.
+  -failover-targets
+                  Comma-separated URLs of the targets to fail over to, in order,
+                  when -target fails its health checks.
+  -health-path    Path of the health checks of the failover targets, by default /healthz.
+  -health-interval
+                  Interval of the health checks of the failover targets, by default 10s.
+  -retries        Times an idempotent request without body, e.g. a GET, is retried
+                  when the target fails with a transport error, e.g. connection
+                  refused, or responds 502, 503 without Retry-After, or 504.
+                  Disabled by default. The retries are traced as Retry spans and
+                  counted in backend_retries.
+  -retry-backoff  Backoff before the first retry, doubled at each retry up to 5s,
+                  by default 100ms.
+  -breaker-failures
+                  Consecutive failures, transport errors, timeouts or 5xx responses,
+                  opening the circuit breaker of a target, disabled by default.
+                  While open, the requests to the target fail fast with 503.
+  -breaker-open-timeout
+                  Time the circuit breaker of a target stays open before a probe
+                  request is let through, closing it if it succeeds, by default 30s.
+  -readiness-path
+                  Path answering the readiness probes on the proxy port, e.g. /readyz,
+                  instead of proxying them. They fail while the proxy warms up and
+                  once it is draining.
+  -warmup-paths   Comma-separated paths requested from the target on startup, before
+                  the proxy is ready, to prime the backend and the connections to it.
+                  Without -readiness-path, the proxy listens once warmed up.
+  -warmup-count   Concurrent warm-up requests per path, by default 1.
+  -warmup-timeout
+                  Time after which the warm-up is given up, by default 30s.
+  -shutdown-timeout
+                  How long the in-flight requests have to finish on SIGTERM or
+                  SIGINT, by default 30s. The proxy then flushes the telemetry
+                  and exits.
+  -listen-family  Address family listened on: any (default), ipv4 or ipv6.
+  -target-family  Address family of the target addresses dialed: any (default), ipv4,
+                  ipv6, prefer-ipv4 or prefer-ipv6. The target addresses are dialed
+                  Happy Eyeballs style, the first to connect serves the request.
+  -target-socks5  SOCKS5 proxy the target is reached through, e.g. an SSH tunnel,
+                  as socks5://[user:password@]host:port.
   -project        Google Cloud Platform project ID if running outside of GCP.
+  -config         YAML or JSON (.json) file of flag values by flag name, e.g.
+                  target: http://localhost:6060
+                  trace-sampling: 0.5
+                  request-quota: [alice@example.com=10000/day]
+                  so that deployments can be versioned. The repeated flags take
+                  a list, the lists of the others are comma-joined, e.g. target.
+                  The flags set on the command line override the file.
+                  Re-read on SIGHUP and with -config-refresh: the changes of
+                  trace-sampling, route-sampling and disable-routes are applied,
+                  the others are logged and applied on restart.
+
+Export options:
+  -export             Where spans and metrics are exported: stackdriver (default)
+                      or stdout, to run locally without Google Cloud credentials,
+                      or the spans only to zipkin or jaeger, for the clusters that
+                      can't reach the Stackdriver Trace API, or none.
+  -telemetry          Local and dry-run shorthand of -export: stackdriver (default),
+                      stdout to print the spans and metrics instead of uploading
+                      them, or none to drop them. The metrics are still served by
+                      -prometheus and the admin API. Can't be used with -export.
+  -export-format      Format of the stdout export, text (default) or json.
+  -export-projects    Comma-separated projects the spans and metrics are also exported
+                      to, e.g. a central observability project. Each project is
+                      buffered and retried on its own, and its failures are logged
+                      with its name, so an unavailable project doesn't hold the others.
+  -trace-endpoint     host:port of the Stackdriver Trace API, e.g. a fake in tests.
+  -monitoring-endpoint
+                      host:port of the Stackdriver Monitoring API.
+  -logging-endpoint   host:port of the Cloud Logging API of -cloud-logging.
+  -collector-endpoint
+                      Zipkin v2 API URL of the Zipkin server or Jaeger collector
+                      (with its Zipkin port enabled) the spans are sent to with
+                      -export=zipkin or jaeger, by default
+                      http://localhost:9411/api/v2/spans.
+  -export-insecure    Export over plaintext without authentication, to a fake or an
+                      emulator serving both APIs, and to -logging-endpoint with
+                      -cloud-logging. Requires -project.
+  -monitoring-period  Period metrics are reported at, by default 10s.
+  -view-period        view=duration reporting period of a view, e.g.
+                      opencensus.io/http/server/latency=10s, overriding -monitoring-period.
+                      A trailing * matches view name prefixes. Can be repeated.
+  -views              Comma-separated names of the views subscribed to, to pay only
+                      for the metrics used. A trailing * matches view name prefixes.
+                      By default the opencensus.io/http/* and stackdriver-reverse-proxy/*
+                      views but the extra stackdriver-reverse-proxy/latency_by_status,
+                      latency_by_method and backend_latency_by_status views.
+  -metric-kind        cumulative (default) to export the metrics since the start of the
+                      proxy, or delta to export their change since the previous report.
+  -prometheus         hostname:port serving the subscribed views on /metrics in the
+                      Prometheus text format besides -export, e.g. :9464. The views
+                      are cumulative and updated every -monitoring-period.
+  -export-retries     Times a failed export is retried with backoff, by default 3.
+                      Failed exports are logged and counted in export_failures.
+  -egress-proxy       Traffic sent through the forward proxy of the HTTP_PROXY, HTTPS_PROXY
+                      and NO_PROXY environment variables: all (default), backend,
+                      exporter or none. The exporter traffic includes the other Google
+                      APIs, e.g. Secret Manager, and the side services, e.g. OPA.
 
 Tracing options:
   -trace-sampling     Tracing sampling fraction, between 0 and 1.0.
+  -route-sampling     Comma-separated route=fraction sampling fractions overriding
+                      -trace-sampling, e.g. /api/*=0.1,/checkout/*=1, the longest
+                      matching route applying. They can be changed at runtime with
+                      the /sampling admin endpoint.
+  -trace-max-qps      Maximum number of traces sampled per second, on top of the
+                      sampling fraction, unlimited by default.
+  -trace-force-header
+                      Header, e.g. X-Force-Trace, of the requests always sampled
+                      whatever its value, to trace a request on demand.
+  -trace-headers      Add X-Trace-Id and X-Trace-Sampled headers to the responses.
+  -propagation        Comma-separated formats of the trace headers accepted from the
+                      clients, the first present continuing the trace: stackdriver
+                      (X-Cloud-Trace-Context), tracecontext (W3C traceparent), b3
+                      (Zipkin X-B3-*) or b3-single (Zipkin and Istio b3). By default
+                      stackdriver. The tracestate header is forwarded
+                      to the backend as is.
+  -backend-trace-formats
+                      Comma-separated formats of the trace headers sent to the
+                      backend, all at once so that any instrumentation finds one:
+                      stackdriver (X-Cloud-Trace-Context), tracecontext (W3C
+                      traceparent), b3 (X-B3-*) or b3-single (b3). By default
+                      stackdriver,tracecontext.
+  -exclude-paths      Comma-separated path prefixes, e.g. /healthz,/favicon.ico, whose
+                      requests are proxied without traces, metrics and logs.
+
+Telemetry options:
+  -labels             Comma-separated key=value labels, e.g. env=prod,team=payments,
+                      added to all the spans, metrics, log entries written to Cloud
+                      Logging and log servers, and error reports.
+  -jwt-claims         Comma-separated JWT claims, e.g. sub,aud,tenant, added as
+                      jwt.<claim> labels to spans and metrics. The JWT is not verified.
+  -jwt-header         Header carrying the JWT, by default Authorization.
+  -tenant            Tenant of the requests, header:<name> or jwt:<claim> for a claim of
+                      the -jwt-header JWT, added as the tenant label to spans, metrics
+                      and logs.
+  -tenant-hash        Label the requests with a hash of their tenant instead.
+  -baggage-keys       Comma-separated keys of the W3C baggage, e.g. tenant,experiment,
+                      added as baggage.<key> labels to spans, metrics and logs.
+  -baggage-set        Comma-separated key=value entries set in the W3C baggage
+                      forwarded to the backend, replacing the received ones.
+  -normalize-ids      Replace the numeric, UUID and hex segments of the paths in span
+                      names and metric labels with {id}.
+  -path-templates     Comma-separated route templates, e.g. /users/{id}/orders/{order},
+                      replacing the matching paths in span names and metric labels.
+                      Either enables the response size distribution by path.
+  -heartbeat          Interval of the heartbeat metric, by default 1m. Alert on its
+                      absence to detect instances that stopped reporting. 0 disables it.
+  -instance           Instance label of the heartbeat metric, by default the hostname.
+
+Limit options:
+  -max-header-bytes   Maximum size of the request line and headers, by default 1MB.
+                      Larger requests are rejected with 431 by the HTTP server, with
+                      4KB of slack, and are not counted in the rejection metric.
+  -max-url-length     Maximum length of the request URL, unlimited by default.
+                      Longer requests are rejected with 414.
+  -max-body-bytes     Maximum size of the request bodies, e.g. 64KB, unlimited by default.
+                      Larger requests are rejected with 413.
+  -route-max-body-bytes
+                      Comma-separated route=size maximum sizes of the request bodies
+                      overriding -max-body-bytes, e.g. /upload/*=10MB. The body sizes
+                      are recorded in request_body_bytes by route.
+
+Timeout options:
+  -dial-timeout       Timeout of the connections to the targets, by default 30s.
+  -tls-handshake-timeout
+                      Timeout of the TLS handshakes with https targets, by default 10s.
+  -response-header-timeout
+                      Time the targets have to send the response headers once the
+                      request is sent, unlimited by default. Timed out requests are
+                      answered with 502.
+  -idle-conn-timeout  Time the idle connections to the targets are kept, by default 90s.
+  -request-timeout    Time a request has to be proxied, up to the end of its response,
+                      unlimited by default. Requests timed out before the response
+                      headers are answered with 504. The WebSocket and gRPC requests
+                      are not bounded.
+  -read-timeout       Time the clients have to send a request, body included,
+                      unlimited by default.
+  -write-timeout      Time the proxy has to write a response, from the end of the
+                      request headers, unlimited by default. It also bounds the
+                      WebSocket and gRPC streams.
+
+Connection pool options:
+  -max-idle-conns     Maximum number of idle connections to the targets, by default 100.
+  -max-idle-conns-per-host
+                      Maximum number of idle connections to each target, by default 100.
+  -max-conns-per-host Maximum number of connections open to each target, idle or in
+                      use, unlimited by default. The requests over it wait for a
+                      connection to be available, e.g. to avoid exhausting the
+                      ephemeral ports of the proxy under high load.
+  -tcp-keep-alive     Period of the TCP keep-alives of the connections to the targets,
+                      by default 30s, or 0 to disable them.
+  -disable-keep-alives
+                      Use a connection per request to the targets instead of reusing
+                      them.
+
+Cache options:
+  -cache-size         Size of the in-memory cache of the GET responses, e.g. 64MB,
+                      disabled by default. Responses are cached per their
+                      Cache-Control max-age, revalidated with If-None-Match and
+                      If-Modified-Since once stale, and served stale while
+                      revalidated in the background per stale-while-revalidate,
+                      or when the backend fails per stale-if-error. The X-Cache
+                      response header and cache_lookups record the result.
+
+Blocking options:
+  -block-rules        JSON file listing rules of requests to reject with 403, e.g.
+                      [{"name": "wp", "path": "^/wp-admin"},
+                       {"name": "sqli", "method": "POST", "body": "UNION SELECT"}]
+                      Rules can match method, path regexp, header and header_pattern
+                      regexp, and body substring.
+  -block-body-limit   Bytes of the body inspected by body rules, by default 64KB.
+  -disable-routes     Comma-separated routes answered with 503 without being proxied,
+                      or with the status of route=status, e.g. /upload/*=404, to cut
+                      off a broken or compromised endpoint. See also the admin API.
+
+Header rewriting options:
+  -header-rules       JSON file listing rules rewriting the headers of the requests to
+                      the backend, or of the responses if response is true, in order, e.g.
+                      [{"action": "remove", "header": "X-Internal-*"},
+                       {"action": "set", "header": "X-Real-IP", "value": "{client_ip}"},
+                       {"response": true, "action": "add", "header": "X-Trace",
+                        "value": "{trace_id}", "path": "^/api/"}]
+                      The actions are add, set and remove, of a header name or prefix
+                      ending with *. The values can use {client_ip}, {trace_id},
+                      {span_id}, {method}, {host} and {path}.
+
+Rate limiting options:
+  -rate-limit           Requests per second allowed per client identity, unlimited by default.
+  -rate-limit-burst     Requests allowed in a burst per client identity, by default 1.
+  -rate-limit-identity  How clients are identified for the rate limits and quotas: ip
+                        (default), verified for the identity verified by the proxy,
+                        the user email with -iap-audience, the certificate subject with
+                        -client-ca, apikey:<name> with -api-keys, or hmac:<key id>
+                        with -hmac-key-id-header and hmac otherwise, sub for the
+                        subject of the JWT with -iap-audience, or apikey for
+                        apikey:<name> only. The requests without the identity are
+                        identified by IP. The limits apply after the authentication.
+                        The identities are hashed in the metrics.
+  -rate-limit-quota     identity=rate overriding -rate-limit for a client. Can be repeated.
+  -rate-limit-redis     Redis server, e.g. Memorystore, enforcing the rate limits across
+                        the replicas of the proxy, as host:port or
+                        redis[s]://[:password@]host:port. The replicas enforce them
+                        on their own while Redis is unreachable.
+  -rate-limit-redis-ca  CA certs file verifying the rediss:// server, e.g. the server CA
+                        of a Memorystore instance with in-transit encryption.
+  -global-rate-limit    Requests per second allowed from all the clients together, per
+                        replica, unlimited by default. The requests within the client
+                        rate limits and quotas are counted against it.
+  -global-rate-limit-burst
+                        Requests allowed in a burst from all the clients, by default 1.
+  -request-quota        identity=count/period quota of requests of a client per hour
+                        or day, e.g. alice@example.com=10000/day, in UTC aligned windows.
+                        * applies to each identity without its own quotas. Can be
+                        repeated. Requests over quota are rejected with 429, and
+                        the quota is returned in the X-RateLimit-Limit,
+                        X-RateLimit-Remaining and X-RateLimit-Reset headers. Each
+                        replica counts on its own, up to 100000 counters. The usage
+                        is counted in quota_usage by identity with its own quotas,
+                        and as * for the others.
+
+Load shedding options:
+  -shed               Limit concurrent backend requests adaptively, shedding the excess
+                      with 503 when the backend latency degrades. The latency is the
+                      backend round trip up to the response headers; cache hits are
+                      not sampled. WebSocket and gRPC streams are not limited.
+  -shed-initial-limit Initial concurrency limit, by default 20.
+  -shed-max-limit     Maximum concurrency limit, by default 1000.
+
+Debugging options:
+  -record             File to append the proxied requests to, without credentials
+                      and scrubbed, to replay them later with the replay command.
+  -record-body        Record the first 64KB of the request bodies too.
+  -latency-budget     Comma-separated route=duration latency budgets, e.g. /api/*=200ms.
+                      Slower requests are logged as warnings.
+  -latency-budget-annotate
+                      Also annotate the spans of the requests over budget.
+  -debug-timing       Log the timing breakdown (queue, DNS, dial, TLS, time to first
+                      byte, body copy) of the backend requests slower than this, e.g. 500ms.
+  -debug-trace-urls   Log the Cloud Console URL of the trace of each sampled request.
+
+Admin options:
+  -admin              host:port to start the admin API on, disabled by default.
+  -admin-token        Secret Manager version (projects/<p>/secrets/<s>/versions/<v>)
+                      or file holding the bearer token required by the admin API.
+
+  The admin API serves, without the token:
+    /healthz          200 while the proxy process runs, for liveness probes.
+    /readyz           200 once the proxy is warmed up, until it drains, while one of
+                      the targets or failover targets accepts connections, for the
+                      readiness probes and load balancer health checks. The
+                      application isn't requested.
+
+  and, with the token:
+    /tap              Server-sent events of the proxied requests. The optional
+                      sampling query parameter is the fraction of requests streamed.
+    /exemplars        Debug page of the latest sampled trace of each server latency
+                      bucket, to find traces representative of latency spikes. The
+                      exported latency distributions have no exemplars.
+    /sampling         The trace sampling fractions. POST with fraction=<0..1> sets
+                      the default fraction, or with route=<prefix> the fraction of
+                      a route, e.g. to sample all the traces during an incident.
+                      DELETE with route=<prefix> removes the fraction of a route.
+    /disabled-routes  The routes answered without being proxied. POST with
+                      route=<prefix> and optionally status=<4xx or 5xx>, by default
+                      503, disables a route. DELETE with route=<prefix> enables it.
+    /log-level        The log level. POST with level=debug, info, warn or error sets
+                      it. SIGUSR1 and SIGUSR2 also lower and raise the level.
+    /monitoring       Whether the metrics are exported. POST with enabled=false stops
+                      exporting them, e.g. while Monitoring quota runs out, and with
+                      enabled=true resumes.
+    /config           The value of every flag, from the command line, the -config file
+                      or its default, with the passwords of the URLs redacted.
+    /drain            POST from a preStop hook fails the -readiness-path probes and
+                      waits up to timeout=<duration>, by default 30s, for the in-flight
+                      requests to finish. With exit=true, the proxy then exits.
+    /upgrade          POST starts a new process of the proxy, e.g. after installing a new
+                      binary in place, handing the listening sockets over to it. Once
+                      the new process is ready, this one finishes its in-flight
+                      requests, flushes its telemetry and exits.
+    /statusz          Human-readable live counters: requests in flight and by status
+                      class, connections, failover target and exporter queues.
+    /maintenance      The maintenance mode, rejecting all requests with 503. POST with
+                      enabled=true or false enters or leaves it.
+
+  -control-subscription
+                      Pub/Sub subscription, as projects/<p>/subscriptions/<s>, to pull
+                      commands from. Give each proxy of a fleet its own subscription
+                      to the control topic. The messages are JSON objects such as
+                      {"command": "sampling", "args": {"fraction": "0.1"}}, with the
+                      commands sampling (fraction, route), log-level (level),
+                      maintenance (enabled) and reload. Applied commands are audit
+                      logged.
+  -config-refresh     Interval the -config, -block-rules, -header-rules, -tls-cert,
+                      -tls-key, -target-tls-cert and -target-tls-key files are re-read at, e.g.
+                      1m, for files pushed by configuration management tools.
+                      Disabled by default. SIGHUP also re-reads them. The changed
+                      files are applied, logged, audit logged and counted in
+                      config_reloads.
+
+Logging options:
+  -cloud-logging      Also write the proxy logs to Cloud Logging, batched and attached
+                      to the detected GCE instance or Cloud Run revision, for
+                      environments without a logging agent.
+  -access-log         Where each request is logged with its httpRequest (method, URL,
+                      status, latency, sizes, remote IP), linked to its trace:
+                      cloud-logging, in the proxy log with -cloud-logging, or stdout
+                      or the path of a file, as the structured logging lines read by
+                      the GKE and Cloud Run logging agents. Disabled by default.
+  -report-5xx         Log the 5xx responses as errors, reported to Error Reporting
+                      with -cloud-logging like the other proxy errors, e.g. the
+                      failed backend requests.
+  -error-reporting-service
+                      Service the errors are reported for, by default
+                      stackdriver-reverse-proxy.
+  -error-reporting-version
+                      Version the errors are reported for, by default the proxy
+                      version.
+  -log-sinks          Comma-separated sinks of the proxy logs with their minimum
+                      severity (DEBUG, INFO, WARNING or ERROR), e.g.
+                      cloud-logging=INFO,stderr=ERROR. Sinks are stderr,
+                      cloud-logging, the path of a file, or a syslog (RFC 5424)
+                      or GELF server: syslog://host:514, gelf://host:12201 over
+                      UDP, syslog+tcp:// and gelf+tcp:// over TCP. By default all
+                      the logs are written to stderr, and to Cloud Logging if enabled.
+  -log-file-max-size  Size at which the files written to by -log-sinks, -access-log,
+                      -audit-log and -record are renamed with a UTC timestamp suffix,
+                      e.g. proxy-20180102T150405.000.log, and a new one started.
+                      By default the files grow unbounded.
+  -log-file-compress  Gzip compress the files written to by -log-sinks, -access-log,
+                      -audit-log and -record. The lines are flushed every second and the
+                      existing file is rolled over on start, read them with zcat.
+
+Audit options:
+  -audit-log          File to append audit log entries to, by default stderr.
+
+Scrubbing options:
+  -scrub-pattern      Regular expression whose matches are redacted from spans,
+                      metric labels and logs. Can be repeated. Emails, tokens and
+                      card numbers with a valid Luhn checksum are always redacted.
+  -scrub-fields       Comma-separated span attributes, metric labels and log fields
+                      whose values are always redacted, e.g. http.user_agent.
+
+Authorization options:
+  -opa-url            URL of a decision of an external Open Policy Agent server, for
+                      example http://localhost:8181/v1/data/proxy/allow. Requests are
+                      forwarded only if the Rego policy allows them. The input has
+                      the method, path, path_segments, query, client_ip and the
+                      identity verified by the proxy of the requests, and the
+                      -opa-headers. The policies are loaded and reloaded by the OPA
+                      server, e.g. a sidecar run with opa run --server --watch.
+  -opa-headers        Comma-separated headers of the requests sent to OPA as headers,
+                      e.g. user-agent. The credential headers can't be sent.
+
+Signature options:
+  -hmac-secret            Secret to verify request signatures with, either a Secret Manager
+                          version (projects/<p>/secrets/<s>/versions/<v>) or a file.
+                          Unsigned requests are rejected with 401.
+  -hmac-algorithm         sha1, sha256 (default) or sha512.
+  -hmac-header            Header carrying the hex signature, by default X-Signature.
+  -hmac-key-id-header     Header carrying the ID of the key the request is signed with,
+                          e.g. X-Key-Id. If set, -hmac-secret holds a key_id=secret line
+                          per sender, and the senders are identified by key ID.
+  -hmac-timestamp-header  Header carrying the Unix time the request was signed at.
+                          If set, "<timestamp>.<body>" is signed instead of the body.
+                          Without it, captured requests can be replayed at any time:
+                          set it unless the senders can't sign a timestamp.
+  -hmac-max-skew          Maximum age of signed requests, by default 5m.
+
+API key options:
+  -api-keys           API keys of the clients, one name=key line per client, either a
+                      Secret Manager version (projects/<p>/secrets/<s>/versions/<v>)
+                      or a file. Requests without one of the keys are rejected with 401.
+  -api-key-header     Header carrying the API key, by default X-Api-Key.
+
+Identity-Aware Proxy options:
+  -iap-audience       Audience of the JWTs signed by IAP, e.g.
+                      /projects/<number>/global/backendServices/<id>. If set, the
+                      requests without a valid X-Goog-IAP-JWT-Assertion header, e.g.
+                      bypassing IAP, are rejected with 401, and the others are labeled
+                      with the email of the user as iap.email.
+
+SPIFFE options:
+  -spiffe-socket      SPIFFE Workload API socket, e.g. /run/spire/sockets/agent.sock,
+                      by default $SPIFFE_ENDPOINT_SOCKET if set. The proxy presents its
+                      SVID to the backend and only accepts backend SVIDs from the bundle.
+  -spiffe-backend-id  SPIFFE ID the backend must present, e.g. spiffe://example.org/backend,
+                      or ID prefix ending with /, e.g. spiffe://example.org/ns/prod/.
 
 HTTPS options:
   -tls-cert TLS cert file to start an HTTPS proxy.
   -tls-key  TLS key file to start an HTTPS proxy.
+  -acme-domains       Comma separated domains the HTTPS proxy obtains and renews
+                      certificates for from Let's Encrypt, instead of -tls-cert and
+                      -tls-key. The TLS-ALPN-01 challenge is answered on -http, which
+                      the CA must reach on port 443.
+  -acme-cache         Directory the ACME certificates and account key are cached in,
+                      or Secret Manager project, projects/<project>, they are kept in
+                      the secrets acme-* of, shared by the replicas. Required with
+                      -acme-domains.
+  -acme-email         Contact email of the ACME account, notified of expiring
+                      certificates.
+  -acme-directory     Directory URL of the ACME CA, e.g. the Let's Encrypt staging
+                      https://acme-staging-v02.api.letsencrypt.org/directory.
+  -client-ca          File of the PEM CA certificates the client certificates are
+                      verified against. The clients presenting an invalid certificate
+                      are refused, and the server spans of the others are labeled
+                      with their certificate subject as tls.client.subject.
+  -require-client-cert
+                      Refuse the clients without a certificate verified by -client-ca.
+  -grpc-target        URL of the backend of the gRPC requests, by default -target.
+                      HTTP/1.1, HTTP/2 and gRPC are served on the same port, negotiated
+                      with ALPN. gRPC requests are proxied over HTTP/2, with prior
+                      knowledge to http:// backends. Their latency and status are
+                      recorded in the stackdriver-reverse-proxy/grpc_latency and
+                      grpc_requests views, and their spans take the gRPC status.
+  -https-only         Redirect or reject plaintext requests. Requests with
+                      X-Forwarded-Proto: https from -trusted-proxies are considered
+                      secure, so -trusted-proxies must not be all.
+  -hsts               Strict-Transport-Security header added to the HTTPS responses,
+                      e.g. "max-age=31536000; includeSubDomains".
+  -trusted-proxies    Peers whose X-Forwarded-For, X-Forwarded-Proto,
+                      X-Forwarded-Host and Forwarded headers are kept: all (default),
+                      none when edge-facing, or comma-separated IPs and CIDRs of the
+                      load balancers in front, e.g. 130.211.0.0/22,35.191.0.0/16.
+                      The headers of the other peers are removed. Behind listed
+                      proxies, the client IP of the rate limits, logs and
+                      {client_ip} is the last untrusted X-Forwarded-For address
+                      instead of the peer. The peer is always appended to
+                      X-Forwarded-For, and X-Forwarded-Proto set if missing.
+  -forwarded-headers  Comma-separated headers also added to the requests to the
+                      backend: x-forwarded-host, the Host of the request if missing,
+                      and forwarded, the RFC 7239 for, host and proto of the request.
 `
 
 func main() {
-	flag.Usage = func() {
-		fmt.Println(usage)
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
 	}
 
-	flag.StringVar(&projectID, "project", "", "")
-	flag.StringVar(&listen, "http", ":6996", "host:port proxy listens")
-	flag.StringVar(&target, "target", "", "target server")
-	flag.Float64Var(&traceFrac, "trace-sampling", 1, "sampling fraction for tracing")
-	flag.StringVar(&tlsCert, "tls-cert", "", "TLS cert file to start an HTTPS proxy")
-	flag.StringVar(&tlsKey, "tls-key", "", "TLS key file to start an HTTPS proxy")
+	flag.Usage = func() {
+		fmt.Print(usage)
+	}
+	registerFlags(flag.CommandLine)
 	flag.Parse()
+	cmdline := setFlags(flag.CommandLine)
+	if configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, configFile); err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+	}
 
 	if target == "" {
 		usageExit()
 	}
+	addSensitiveHeaders(apiKeyHeader, hmacHeader, jwtHeader)
 
-	exporter, err := stackdriver.NewExporter(stackdriver.Options{
-		ProjectID: projectID,
-	})
+	scrub, err := newScrubber(scrubPatterns, splitList(scrubFields))
+	if err != nil {
+		log.Fatalf("Cannot compile -scrub-pattern: %v", err)
+	}
+
+	logFileMax, err := parseByteSize(logFileMaxSize)
+	if err != nil {
+		log.Fatalf("Invalid -log-file-max-size: %v", err)
+	}
+	files := &logFiles{maxSize: logFileMax, compress: logFileCompress}
+	var auditOut io.Writer = os.Stderr
+	if auditLogFile != "" {
+		f, err := files.open(auditLogFile)
+		if err != nil {
+			log.Fatalf("Cannot open -audit-log: %v", err)
+		}
+		defer f.Close()
+		auditOut = f
+	}
+	audit := newAuditLogger(auditOut, scrub)
+	reloader := newConfigReloader(audit)
+
+	backendViaProxy, exporterViaProxy, err := egressProxyScopes(egressProxy)
+	if err != nil {
+		log.Fatalf("Invalid -egress-proxy: %v", err)
+	}
+	secretTransport := sproxy.NewHTTPTransport(nil)
+	if !exporterViaProxy {
+		secretTransport.Proxy = nil
+	}
+
+	labels, err := parseGlobalLabels(splitList(globalLabels))
+	if err != nil {
+		log.Fatalf("Invalid -labels: %v", err)
+	}
+
+	var cl *cloudLogger
+	if cloudLogging {
+		t := sproxy.NewHTTPTransport(nil)
+		if !exporterViaProxy {
+			t.Proxy = nil
+		}
+		cl, err = newCloudLogger(context.Background(), projectID, "stackdriver-reverse-proxy", labels, t, loggingEndpoint, exportInsecure)
+		if err != nil {
+			log.Fatalf("Cannot write logs to Cloud Logging: %v", err)
+		}
+		cl.service, cl.version = errorService, errorVersion
+		go cl.Run(5 * time.Second)
+	}
+	router, err := newLogRouter(splitList(logSinks), cl, scrub, labels, files)
+	if err != nil {
+		log.Fatalf("Invalid -log-sinks: %v", err)
+	}
+	log.SetOutput(router)
+	go handleLogLevelSignals(audit)
+
+	if telemetry != "" {
+		switch telemetry {
+		case "stackdriver", "stdout", "none":
+		default:
+			log.Fatalf("Invalid -telemetry %q, want stackdriver, stdout or none", telemetry)
+		}
+		if setFlags(flag.CommandLine)["export"] {
+			log.Fatal("-telemetry can't be used with -export")
+		}
+		exportTo = telemetry
+	}
+	var exporter telemetryExporter
+	flushExporter := func() {}
+	switch exportTo {
+	case "stackdriver":
+		if exportInsecure && projectID == "" {
+			err = errors.New("-export-insecure requires -project")
+			break
+		}
+		var (
+			fanout fanoutExporter
+			sds    []*stackdriver.Exporter
+		)
+		for _, project := range append([]string{projectID}, splitList(exportProjects)...) {
+			dialOpts := []grpc.DialOption{grpc.WithUnaryInterceptor(exportRetrier(exportRetries, project))}
+			if !exporterViaProxy {
+				dialOpts = append(dialOpts, withoutProxy())
+			}
+			var opts []option.ClientOption
+			opts, err = exporterClientOptions(traceEndpoint, monitoringEndpoint, exportInsecure, dialOpts...)
+			if err != nil {
+				break
+			}
+			var sd *stackdriver.Exporter
+			sd, err = stackdriver.NewExporter(stackdriver.Options{
+				ProjectID:     project,
+				OnError:       exportErrorHandler(project),
+				ClientOptions: opts,
+			})
+			if err != nil {
+				break
+			}
+			fanout = append(fanout, sd)
+			sds = append(sds, sd)
+		}
+		if err != nil {
+			break
+		}
+		exporter = fanout
+		if len(fanout) == 1 {
+			exporter = fanout[0]
+		}
+		flushExporter = func() {
+			for _, sd := range sds {
+				sd.Flush()
+			}
+		}
+	case "stdout":
+		exporter, err = newConsoleExporter(os.Stdout, exportFormat)
+	case "zipkin", "jaeger":
+		t := sproxy.NewHTTPTransport(nil)
+		if !exporterViaProxy {
+			t.Proxy = nil
+		}
+		z := newZipkinExporter(collectorEndpoint, "stackdriver-reverse-proxy", t)
+		go z.Run(time.Second)
+		exporter, flushExporter = z, z.flush
+	case "none":
+		// No exporter, the spans and view data are dropped.
+		exporter = fanoutExporter(nil)
+	default:
+		err = fmt.Errorf("unknown -export %q, want stackdriver, stdout, zipkin, jaeger or none", exportTo)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	exporter = &scrubExporter{s: scrub, e: exporter}
+	if len(labels) > 0 {
+		exporter = newLabelExporter(labels, exporter)
+	}
+	switch metricKind {
+	case "cumulative":
+	case "delta":
+		exporter = newDeltaExporter(exporter)
+	default:
+		log.Fatalf("Unknown -metric-kind %q, want cumulative or delta", metricKind)
+	}
+	periods, err := newPeriodExporter(exporter, monitoringPeriod, viewPeriods)
+	if err != nil {
+		log.Fatalf("Invalid -view-period: %v", err)
+	}
+	monitoring := &monitoringSwitch{e: periods}
+	exporter = monitoring
+	view.SetReportingPeriod(periods.minPeriod())
 	view.RegisterExporter(exporter)
 	trace.RegisterExporter(exporter)
-	view.Subscribe(ochttp.DefaultViews...)
-	trace.SetDefaultSampler(trace.ProbabilitySampler(traceFrac))
+	var prometheus *prometheusExporter
+	if prometheusListen != "" {
+		prometheus = newPrometheusExporter()
+		view.RegisterExporter(&scrubExporter{s: scrub, e: prometheus})
+	}
+	defaultViews := append(append([]*view.View(nil), ochttp.DefaultViews...), proxyViews...)
+	views, err := selectViews(defaultViews, append(defaultViews, extraViews...), splitList(subscribedViews))
+	if err != nil {
+		log.Fatalf("Invalid -views: %v", err)
+	}
+	view.Subscribe(views...)
+
+	var labelNames []string
+	claims := splitList(jwtClaimLabels)
+	for _, c := range claims {
+		labelNames = append(labelNames, claimLabel(c))
+	}
+	if tenantSpec != "" {
+		labelNames = append(labelNames, tenantLabel)
+	}
+	baggage := splitList(baggageKeys)
+	for _, k := range baggage {
+		labelNames = append(labelNames, baggageLabel(k))
+	}
+	view.Subscribe(labeledViews(labelNames)...)
+
+	var normalizer *pathNormalizer
+	if normalizeIDs || pathTemplates != "" {
+		normalizer = newPathNormalizer(splitList(pathTemplates), normalizeIDs)
+		view.Subscribe(pathViews...)
+	}
+	if heartbeatInterval > 0 {
+		go heartbeat(context.Background(), heartbeatInterval, instance)
+	}
+	routeSampler, err := parseRouteSampling(traceFrac, splitList(routeSampling))
+	if err != nil {
+		log.Fatalf("Invalid -route-sampling: %v", err)
+	}
+	sampler := trace.Sampler(routeSampler.Sample)
+	if traceMaxQPS > 0 {
+		sampler = sproxy.RateLimitedSampler(sampler, traceMaxQPS)
+	}
+	trace.SetDefaultSampler(sampler)
+
+	var excluded []string
+	for _, p := range splitList(excludePaths) {
+		excluded = append(excluded, routePrefix(p))
+	}
+	env := &proxyEnv{
+		audit:            audit,
+		reloader:         reloader,
+		scrub:            scrub,
+		files:            files,
+		cl:               cl,
+		backendViaProxy:  backendViaProxy,
+		exporterViaProxy: exporterViaProxy,
+		secretTransport:  secretTransport,
+		cmdline:          cmdline,
+		routeSampler:     routeSampler,
+		monitoring:       monitoring,
+		normalizer:       normalizer,
+		excluded:         excluded,
+		flushExporter:    flushExporter,
+	}
+	backend := env.newBackendTransport()
+	audit.LogLocal("proxy.Start", target, map[string]interface{}{
+		"listen":         listen,
+		"target":         target,
+		"trace-sampling": traceFrac,
+		"trace-max-qps":  traceMaxQPS,
+	})
+	handler := env.newProxyHandler(backend)
+	drain, admin := handler.drain, handler.admin
+
+	up, err := newUpgrader()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ready := up.Ready
+	if paths := splitList(warmupPaths); len(paths) > 0 {
+		if readinessPath == "" {
+			warmUp(backend.base, backend.targets[0], paths, warmupCount, warmupTimeout)
+		} else {
+			drain.SetWarming(true)
+			ready = func() {}
+			go func() {
+				warmUp(backend.base, backend.targets[0], paths, warmupCount, warmupTimeout)
+				drain.SetWarming(false)
+				up.Ready()
+			}()
+		}
+	}
+
+	server := &http.Server{
+		Addr:           listen,
+		MaxHeaderBytes: maxHeaderBytes,
+		ReadTimeout:    readTimeout,
+		WriteTimeout:   writeTimeout,
+		Handler:        handler,
+	}
+	server.RegisterOnShutdown(handler.ws.Shutdown)
+	if admin != nil {
+		adminHTTP := &http.Server{Handler: admin}
+		admin.Handle("/upgrade", "admin.Upgrade", upgradeHandler{up, func() {
+			up.Close()
+			server.SetKeepAlivesEnabled(false)
+			time.Sleep(upgradeGrace)
+			ctx, cancel := context.WithTimeout(context.Background(), defaultDrainTimeout)
+			defer cancel()
+			server.Shutdown(ctx)
+			adminHTTP.Shutdown(ctx)
+			drain.exit()
+		}})
+		l, err := up.Listen("admin", "tcp", adminListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			err := adminHTTP.Serve(l)
+			if !up.HandedOver() {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if prometheus != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", prometheus)
+		l, err := up.Listen("prometheus", "tcp", prometheusListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			err := http.Serve(l, mux)
+			if !up.HandedOver() {
+				log.Fatal(err)
+			}
+		}()
+	}
+	ln := env.newListener(server, func(network, addr string) (net.Listener, error) {
+		return up.Listen("http", network, addr)
+	})
+	go reloader.HandleSignals()
+	if configRefresh > 0 {
+		go reloader.Run(configRefresh)
+	}
+	go drain.ShutdownOnSignal(server, shutdownTimeout)
+	ready()
+	err = server.Serve(ln)
+	if err != http.ErrServerClosed && !up.HandedOver() {
+		log.Fatal(err)
+	}
+	// Upgraded or shutting down, the process exits once drained.
+	select {}
+}
+
+// proxyEnv is what main sets up before building the parts of the
+// proxy: the loggers, the configuration reloader and the telemetry.
+type proxyEnv struct {
+	audit            *auditLogger
+	reloader         *configReloader
+	scrub            *scrubber
+	files            *logFiles
+	cl               *cloudLogger // nil without -cloud-logging
+	backendViaProxy  bool
+	exporterViaProxy bool
+	secretTransport  http.RoundTripper // to Secret Manager
+	cmdline          map[string]bool   // the flags set on the command line
+	routeSampler     *routeSampler
+	monitoring       *monitoringSwitch
+	normalizer       *pathNormalizer // nil without -normalize-ids and -path-templates
+	excluded         []string        // the route prefixes of -exclude-paths
+	flushExporter    func()
+}
+
+// backendTransport is the transport of the requests to the targets.
+type backendTransport struct {
+	targets  []*url.URL
+	base     *http.Transport // the connections to the targets
+	dialer   *backendDialer
+	dial     sproxy.DialContextFunc // dialer limited by conns
+	conns    *connLimiter           // nil without -max-conns-per-host
+	breakers *breakerSet            // nil without -breaker-failures
 
-	url, err := url.Parse(target)
+	wrap      func(http.RoundTripper) http.RoundTripper // adds the middleware to a transport
+	transport http.RoundTripper                         // base wrapped, for the HTTP requests
+}
+
+// newBackendTransport returns the transport to the -target servers.
+func (e *proxyEnv) newBackendTransport() *backendTransport {
+	var targetURLs []*url.URL
+	for _, t := range splitList(target) {
+		u, err := url.Parse(t)
+		if err != nil {
+			log.Fatalf("Cannot URL parse -target: %v", err)
+		}
+		targetURLs = append(targetURLs, u)
+	}
+	if len(targetURLs) == 0 {
+		usageExit()
+	}
+
+	dialer, err := newBackendDialer(targetFamily, dialTimeout, tcpKeepAlive)
+	if err != nil {
+		log.Fatalf("Invalid -target-family: %v", err)
+	}
+	dial := sproxy.DialContextFunc(dialer.DialContext)
+	var conns *connLimiter
+	if maxConnsPerHost > 0 {
+		conns = newConnLimiter(maxConnsPerHost, dial)
+		dial = conns.DialContext
+	}
+	backend := sproxy.NewHTTPTransport(dial)
+	backend.MaxIdleConns = maxIdleConns
+	backend.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	backend.DisableKeepAlives = disableKeepAlives
+	backend.TLSHandshakeTimeout = backendTLSTimeout
+	backend.ResponseHeaderTimeout = responseHeaderTimeout
+	backend.IdleConnTimeout = idleConnTimeout
+	backend.TLSClientConfig.ServerName = targetServerName
+	if !e.backendViaProxy {
+		backend.Proxy = nil
+	}
+	if targetSOCKS5 != "" {
+		u, err := url.Parse(targetSOCKS5)
+		if err != nil || u.Scheme != "socks5" {
+			log.Fatalf("Invalid -target-socks5 %q, want socks5://[user:password@]host:port", targetSOCKS5)
+		}
+		backend.Proxy = http.ProxyURL(u)
+	}
+	if targetTLSCert != "" || targetTLSKey != "" {
+		if err := withClientCert(backend.TLSClientConfig, e.reloader, targetTLSCert, targetTLSKey); err != nil {
+			log.Fatalf("Cannot load -target-tls-cert and -target-tls-key: %v", err)
+		}
+	}
+	if targetCA != "" {
+		backend.TLSClientConfig.RootCAs, err = loadCAPool(targetCA)
+		if err != nil {
+			log.Fatalf("Cannot load -target-ca: %v", err)
+		}
+	}
+	if targetInsecure {
+		log.Print("WARNING: The certificates of the targets are not verified, -target-insecure-skip-verify is for development only")
+		backend.TLSClientConfig.InsecureSkipVerify = true
+	}
+	if spiffeSocket != "" {
+		if targetTLSCert != "" || targetCA != "" || targetInsecure {
+			log.Fatal("-spiffe-socket can't be used with -target-tls-cert, -target-ca or -target-insecure-skip-verify")
+		}
+		svids := newSVIDSource(spiffeSocket)
+		if err := svids.WaitReady(30 * time.Second); err != nil {
+			log.Fatal(err)
+		}
+		// The backend is verified against the SPIFFE bundle
+		// by VerifyPeerCertificate instead of the system roots.
+		backend.TLSClientConfig.InsecureSkipVerify = true
+		backend.TLSClientConfig.VerifyPeerCertificate = svids.VerifyPeer(spiffeBackendID)
+		backend.TLSClientConfig.GetClientCertificate = svids.GetClientCertificate
+	}
+	backendFormat, err := parseTraceFormats(splitList(backendTraceFormats))
+	if err != nil {
+		log.Fatalf("Invalid -backend-trace-formats: %v", err)
+	}
+	// instrument wraps the transports to the backends
+	// with the metrics and tracing.
+	instrument := func(t http.RoundTripper) http.RoundTripper {
+		var base http.RoundTripper = &connMetricsTransport{base: t}
+		if debugTiming > 0 {
+			base = &timingTransport{base: base, threshold: debugTiming}
+		}
+		var traced http.RoundTripper = &ochttp.Transport{
+			Base:        base,
+			Propagation: backendFormat,
+		}
+		if e.normalizer != nil {
+			traced = &normalizeTransport{
+				n: e.normalizer,
+				base: &ochttp.Transport{
+					Base:        &restoreURLTransport{base: base},
+					Propagation: backendFormat,
+				},
+			}
+		}
+		if len(e.excluded) > 0 {
+			traced = &excludeTransport{base: base, traced: traced}
+		}
+		return traced
+	}
+	if targetIDAccount != "" && targetIDAudience == "" {
+		log.Fatal("-target-id-token-service-account requires -target-id-token-audience")
+	}
+	var idTokens oauth2.TokenSource
+	if targetIDAudience != "" {
+		t := sproxy.NewHTTPTransport(nil)
+		if !e.exporterViaProxy {
+			t.Proxy = nil
+		}
+		ts, err := newIDTokenSource(context.Background(), targetIDAudience, targetIDAccount, t)
+		if err != nil {
+			log.Fatalf("Cannot mint ID tokens for -target-id-token-audience: %v", err)
+		}
+		// Fail fast on the credentials instead of on the first request.
+		if _, err := ts.Token(); err != nil {
+			log.Fatalf("Cannot mint ID tokens for -target-id-token-audience: %v", err)
+		}
+		idTokens = ts
+	}
+	var breakers *breakerSet
+	if breakerFailures > 0 {
+		breakers = newBreakerSet(breakerFailures, breakerTimeout)
+	}
+	// wrap adds the ID tokens, circuit breakers, metrics, tracing and
+	// retries to the transports to the backends, of the HTTP, gRPC and
+	// WebSocket requests alike.
+	wrap := func(t http.RoundTripper) http.RoundTripper {
+		if idTokens != nil {
+			t = &oauth2.Transport{Source: idTokens, Base: t}
+		}
+		if breakers != nil {
+			t = breakers.transport(t)
+		}
+		t = instrument(t)
+		if retries > 0 {
+			t = &retryTransport{retries: retries, backoff: retryBackoff, base: t}
+		}
+		return t
+	}
+	transport := wrap(&reresolveTransport{base: backend})
+	if requestTimeout > 0 {
+		transport = &timeoutTransport{base: transport}
+	}
+	if shed {
+		transport = &rttTransport{base: transport}
+	}
+	return &backendTransport{
+		targets:   targetURLs,
+		base:      backend,
+		dialer:    dialer,
+		dial:      dial,
+		conns:     conns,
+		breakers:  breakers,
+		wrap:      wrap,
+		transport: transport,
+	}
+}
+
+// proxyHandler is the handler chain of the proxy, from the client
+// requests to b.
+type proxyHandler struct {
+	http.Handler
+	drain *drainer
+	ws    *wsProxy
+	admin *adminServer // nil without -admin
+}
+
+// newProxyHandler returns the handler chain proxying the requests
+// with b. The files it opens are kept open for the life of the
+// process.
+func (e *proxyEnv) newProxyHandler(b *backendTransport) *proxyHandler {
+	var err error
+	targetURL := b.targets[0]
+	claims, baggage := splitList(jwtClaimLabels), splitList(baggageKeys)
+	newProxy := func(u *url.URL) http.Handler {
+		p := httputil.NewSingleHostReverseProxy(u)
+		p.Director = sproxy.ForwardedProto(p.Director)
+		p.Transport = b.transport
+		return p
+	}
+	proxy := newProxy(targetURL)
+	var balancer *balancerHandler
+	if len(b.targets) > 1 {
+		if failoverTargets != "" {
+			log.Fatal("-failover-targets requires a single -target")
+		}
+		balancer, err = newBalancerHandler(b.targets, newProxy, balancePolicy)
+		if err != nil {
+			log.Fatalf("Invalid -balance-policy: %v", err)
+		}
+		proxy = balancer
+	}
+	var failover *failoverHandler
+	if failoverTargets != "" {
+		targets := []*url.URL{targetURL}
+		for _, t := range splitList(failoverTargets) {
+			u, err := url.Parse(t)
+			if err != nil {
+				log.Fatalf("Cannot URL parse -failover-targets: %v", err)
+			}
+			targets = append(targets, u)
+		}
+		failover = newFailoverHandler(targets, newProxy, healthPath, b.base, e.audit)
+		go failover.Run(healthInterval)
+		proxy = failover
+	}
+
+	grpcURL := targetURL
+	if grpcTarget != "" {
+		grpcURL, err = url.Parse(grpcTarget)
+		if err != nil {
+			log.Fatalf("Cannot URL parse -grpc-target: %v", err)
+		}
+	}
+	grpcProxy := newGRPCProxy(grpcURL, b.dial, b.base.TLSClientConfig, b.wrap)
+
+	var admin *adminServer
+	if adminListen != "" {
+		if adminTokenSecret == "" {
+			log.Fatal("-admin requires -admin-token")
+		}
+		token, err := loadSecret(context.Background(), adminTokenSecret, e.secretTransport)
+		if err != nil {
+			log.Fatalf("Cannot load -admin-token: %v", err)
+		}
+		admin = newAdminServer(bytes.TrimSpace(token), e.audit)
+	}
+
+	wsProxy := newWSProxy(targetURL, b.wrap(&wsTransport{dial: b.dial, tlsConfig: b.base.TLSClientConfig}))
+	if requestTimeout > 0 {
+		proxy = &requestTimeoutHandler{timeout: requestTimeout, handler: proxy}
+	}
+	var handler http.Handler = &protocolHandler{grpc: &grpcStatsHandler{handler: grpcProxy}, websocket: wsProxy, handler: proxy}
+	cacheBytes, err := parseByteSize(cacheSize)
+	if err != nil {
+		log.Fatalf("Invalid -cache-size: %v", err)
+	}
+	if cacheBytes > 0 {
+		handler = newCacheHandler(cacheBytes, handler)
+	}
+	if recordFile != "" {
+		f, err := e.files.open(recordFile)
+		if err != nil {
+			log.Fatalf("Cannot open -record: %v", err)
+		}
+		handler = &recordHandler{
+			scrub:    e.scrub,
+			withBody: recordBody,
+			w:        f,
+			handler:  handler,
+		}
+	}
+	// The stages checking the traced requests before the backend, in
+	// the order they run. Unlike those of chain below, they run inside
+	// the server spans.
+	var traced sproxy.Chain
+	if headerRules != "" {
+		h := &headerRulesHandler{}
+		err := e.reloader.Watch("-header-rules", []string{headerRules}, func(data [][]byte) error {
+			rules, err := parseHeaderRules(data[0])
+			if err != nil {
+				return err
+			}
+			h.SetRules(rules)
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Cannot load -header-rules: %v", err)
+		}
+		traced.Use("header-rules", sproxy.OrderEdge, func(next http.Handler) http.Handler {
+			h.handler = next
+			return h
+		})
+	}
+	kill, err := parseDisabledRoutes(splitList(disableRoutes))
+	if err != nil {
+		log.Fatalf("Invalid -disable-routes: %v", err)
+	}
+	traced.Use("disabled-routes", sproxy.OrderFilter, func(next http.Handler) http.Handler {
+		kill.handler = next
+		return kill
+	})
+	if opaURL != "" {
+		t := sproxy.NewHTTPTransport(nil)
+		if !e.exporterViaProxy {
+			t.Proxy = nil
+		}
+		headers, err := opaHeaders(splitList(opaHeaderList))
+		if err != nil {
+			log.Fatalf("Invalid -opa-headers: %v", err)
+		}
+		traced.Use("opa", sproxy.OrderAuth, func(next http.Handler) http.Handler {
+			return newOPAAuthorizer(opaURL, headers, t, next)
+		})
+	}
+	if shed {
+		traced.Use("shed", sproxy.OrderRateLimit, func(next http.Handler) http.Handler {
+			return &shedHandler{
+				limiter: newAdaptiveLimiter(shedInitialLimit, shedMaxLimit),
+				handler: next,
+			}
+		})
+	}
+	handler = traced.Then(handler)
+	if configFile != "" {
+		err := e.reloader.Watch("-config", []string{configFile}, reloadConfigFile(flag.CommandLine, configFile, e.cmdline, reloadableFlags(e.routeSampler, kill)))
+		if err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+	}
+	untraced := handler
+	if latencyBudgetList != "" {
+		budgets, err := parseLatencyBudgets(splitList(latencyBudgetList))
+		if err != nil {
+			log.Fatalf("Invalid -latency-budget: %v", err)
+		}
+		handler = &budgetHandler{
+			budgets:  budgets,
+			backend:  target,
+			annotate: latencyBudgetAnnotate,
+			handler:  handler,
+		}
+	}
+	if admin != nil {
+		t := newTap(e.scrub)
+		admin.Handle("/tap", "admin.Tap", t)
+		handler = t.Handler(handler)
+		ex := newExemplars(e.scrub)
+		admin.Handle("/exemplars", "admin.Exemplars", ex)
+		handler = ex.Handler(handler)
+		admin.Handle("/sampling", "admin.Sampling", e.routeSampler)
+		admin.Handle("/log-level", "admin.LogLevel", logLevelHandler{})
+		admin.Handle("/monitoring", "admin.Monitoring", monitoringAdmin{e.monitoring})
+		admin.Handle("/config", "admin.Config", configHandler{flag.CommandLine})
+		admin.Handle("/disabled-routes", "admin.DisabledRoutes", killSwitchAdmin{kill})
+	}
+	if traceHeaders {
+		handler = &traceHeadersHandler{handler: handler}
+	}
+	if debugTraceURLs {
+		project := projectID
+		if project == "" {
+			creds, err := google.FindDefaultCredentials(context.Background())
+			if err != nil || creds.ProjectID == "" {
+				log.Fatal("-debug-trace-urls requires -project")
+			}
+			project = creds.ProjectID
+		}
+		handler = &traceURLHandler{project: project, handler: handler}
+	}
+	handler = &labelSpanHandler{handler: handler}
+	if requireClientCert && clientCA == "" {
+		log.Fatal("-require-client-cert requires -client-ca")
+	}
+	if clientCA != "" && (tlsCert == "" || tlsKey == "") && acmeDomains == "" {
+		log.Fatal("-client-ca requires -tls-cert and -tls-key, or -acme-domains")
+	}
+	if clientCA != "" {
+		handler = &clientCertSpanHandler{handler: handler}
+	}
+	if report5xx {
+		handler = &serverErrorHandler{scrub: e.scrub, handler: handler}
+	}
+	switch accessLog {
+	case "":
+	case "cloud-logging":
+		if e.cl == nil {
+			log.Fatal("-access-log=cloud-logging requires -cloud-logging")
+		}
+		handler = &accessLogHandler{cl: e.cl, scrub: e.scrub, handler: handler}
+	default:
+		var w io.Writer = os.Stdout
+		if accessLog != "stdout" {
+			f, err := e.files.open(accessLog)
+			if err != nil {
+				log.Fatalf("Cannot open -access-log: %v", err)
+			}
+			w = f
+		}
+		project := projectID
+		if project == "" {
+			if creds, err := google.FindDefaultCredentials(context.Background()); err == nil {
+				project = creds.ProjectID
+			}
+		}
+		handler = &accessLogHandler{project: project, scrub: e.scrub, w: w, handler: handler}
+	}
+	if e.normalizer != nil {
+		handler = &restoreURLHandler{handler: handler}
+	}
+	incomingFormat, err := parseTraceFormats(splitList(propagationFormats))
 	if err != nil {
-		log.Fatalf("Cannot URL parse -target: %v", err)
+		log.Fatalf("Invalid -propagation: %v", err)
+	}
+	if traceForceHeader != "" {
+		incomingFormat = sproxy.ForceSampling(traceForceHeader, incomingFormat)
 	}
+	handler = &ochttp.Handler{
+		Handler:     handler,
+		Propagation: incomingFormat,
+	}
+	handler = &exposeWriterHandler{handler: handler}
+	if e.normalizer != nil {
+		handler = &normalizeHandler{n: e.normalizer, handler: handler}
+	}
+	if len(e.excluded) > 0 {
+		handler = &excludeHandler{
+			routes:   e.excluded,
+			excluded: untraced,
+			handler:  handler,
+		}
+	}
+	if len(claims) > 0 {
+		handler = &claimLabelsHandler{
+			header:  jwtHeader,
+			claims:  claims,
+			handler: handler,
+		}
+	}
+	if tenantSpec != "" {
+		tenant, err := tenantFunc(tenantSpec, jwtHeader)
+		if err != nil {
+			log.Fatalf("Invalid -tenant: %v", err)
+		}
+		handler = &tenantHandler{
+			tenant:  tenant,
+			hash:    tenantHash,
+			handler: handler,
+		}
+	}
+	if len(baggage) > 0 || baggageSet != "" {
+		set := make(map[string]string)
+		for _, item := range splitList(baggageSet) {
+			k, v, err := splitPair(item)
+			if err != nil {
+				log.Fatalf("Invalid -baggage-set: %v", err)
+			}
+			set[k] = v
+		}
+		handler = &baggageHandler{
+			keys:    baggage,
+			set:     set,
+			handler: handler,
+		}
+	}
+	// The stages checking the requests before they are traced, in
+	// the order they run.
+	var chain sproxy.Chain
+	trusted, err := parseTrustedProxies(trustedProxySpec)
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	fwdHost, fwdRFC7239, err := parseForwardedHeaders(splitList(forwardedHeaders))
+	if err != nil {
+		log.Fatalf("Invalid -forwarded-headers: %v", err)
+	}
+	if httpsOnly != "" && trusted.all {
+		log.Fatal("-https-only requires -trusted-proxies, none or the proxies terminating TLS in front")
+	}
+	if !trusted.all || fwdHost || fwdRFC7239 || hsts != "" {
+		chain.Use("forwarded", sproxy.OrderEdge, func(next http.Handler) http.Handler {
+			return &forwardedHandler{
+				trusted: trusted,
+				host:    fwdHost,
+				rfc7239: fwdRFC7239,
+				handler: next,
+			}
+		})
+	}
+	chain.Use("limits", sproxy.OrderEdge+10, func(next http.Handler) http.Handler {
+		return &limitHandler{
+			maxURLLength: maxURLLength,
+			handler:      next,
+		}
+	})
+	maxBody, err := parseByteSize(maxBodyBytes)
+	if err != nil {
+		log.Fatalf("Invalid -max-body-bytes: %v", err)
+	}
+	if maxBody > 0 || routeBodyBytes != "" {
+		limits, err := parseBodyLimits(maxBody, splitList(routeBodyBytes))
+		if err != nil {
+			log.Fatalf("Invalid -route-max-body-bytes: %v", err)
+		}
+		chain.Use("body-limits", sproxy.OrderEdge+20, func(next http.Handler) http.Handler {
+			return &bodyLimitHandler{limits: limits, handler: next}
+		})
+	}
+	switch httpsOnly {
+	case "", "redirect", "reject":
+	default:
+		log.Fatalf("Invalid -https-only %q, want redirect or reject", httpsOnly)
+	}
+	if httpsOnly != "" || hsts != "" {
+		chain.Use("https", sproxy.OrderEdge+30, func(next http.Handler) http.Handler {
+			return &httpsHandler{
+				mode:    httpsOnly,
+				hsts:    hsts,
+				handler: next,
+			}
+		})
+	}
+	identity, err := identityFunc(rateLimitIdentity)
+	if err != nil {
+		log.Fatalf("Invalid -rate-limit-identity: %v", err)
+	}
+	if rateLimit > 0 {
+		quotas, err := parseQuotas(rateLimitQuotas)
+		if err != nil {
+			log.Fatalf("Invalid -rate-limit-quota: %v", err)
+		}
+		local := newRateLimiter(rateLimit, rateLimitBurst, quotas)
+		var l limiter = local
+		if rateLimitRedis != "" {
+			var tlsConfig *tls.Config
+			if rateLimitRedisCA != "" {
+				pool, err := loadCAPool(rateLimitRedisCA)
+				if err != nil {
+					log.Fatalf("Invalid -rate-limit-redis-ca: %v", err)
+				}
+				tlsConfig = &tls.Config{RootCAs: pool}
+			}
+			l, err = newRedisLimiter(rateLimitRedis, tlsConfig, local)
+			if err != nil {
+				log.Fatalf("Invalid -rate-limit-redis: %v", err)
+			}
+		}
+		chain.Use("rate-limit", sproxy.OrderRateLimit, func(next http.Handler) http.Handler {
+			return &rateLimitHandler{
+				limiter:  l,
+				identity: identity,
+				handler:  next,
+			}
+		})
+	}
+	if len(requestQuotas) > 0 {
+		quotas, err := parseRequestQuotas(requestQuotas)
+		if err != nil {
+			log.Fatalf("Invalid -request-quota: %v", err)
+		}
+		chain.Use("quota", sproxy.OrderRateLimit+10, func(next http.Handler) http.Handler {
+			return &quotaHandler{
+				quotas:   newQuotaEnforcer(quotas),
+				identity: identity,
+				handler:  next,
+			}
+		})
+	}
+	if globalRateLimit > 0 {
+		chain.Use("global-rate-limit", sproxy.OrderRateLimit+20, func(next http.Handler) http.Handler {
+			return newGlobalRateLimitHandler(globalRateLimit, globalRateBurst, next)
+		})
+	}
+	if blockRulesFile != "" {
+		h := &blockHandler{bodyLimit: blockBodyLimit}
+		err := e.reloader.Watch("-block-rules", []string{blockRulesFile}, func(data [][]byte) error {
+			rules, err := parseBlockRules(data[0])
+			if err != nil {
+				return err
+			}
+			h.SetRules(rules)
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Cannot load -block-rules: %v", err)
+		}
+		chain.Use("block", sproxy.OrderFilter, func(next http.Handler) http.Handler {
+			h.handler = next
+			return h
+		})
+	}
+	if iapAudience != "" {
+		t := sproxy.NewHTTPTransport(nil)
+		if !e.exporterViaProxy {
+			t.Proxy = nil
+		}
+		keys := &iapKeys{
+			url:    iapKeysURL,
+			client: &http.Client{Transport: t, Timeout: 10 * time.Second},
+		}
+		chain.Use("iap", sproxy.OrderAuth, func(next http.Handler) http.Handler {
+			return &iapVerifier{audience: iapAudience, keys: keys, handler: next}
+		})
+	}
+	if hmacSecret != "" {
+		h, ok := hmacAlgorithms[hmacAlgorithm]
+		if !ok {
+			log.Fatalf("Unknown -hmac-algorithm %q", hmacAlgorithm)
+		}
+		secret, err := loadSecret(context.Background(), hmacSecret, e.secretTransport)
+		if err != nil {
+			log.Fatalf("Cannot load -hmac-secret: %v", err)
+		}
+		secrets := map[string][]byte{"": bytes.TrimSpace(secret)}
+		if hmacKeyIDHeader != "" {
+			keys, err := parseKeys(secret)
+			if err != nil {
+				log.Fatalf("Invalid -hmac-secret: %v", err)
+			}
+			secrets = make(map[string][]byte, len(keys))
+			for id, s := range keys {
+				secrets[id] = []byte(s)
+			}
+		}
+		if hmacTimestampHeader == "" {
+			log.Printf("WARNING: No -hmac-timestamp-header, signed requests can be replayed")
+		}
+		chain.Use("hmac", sproxy.OrderAuth+10, func(next http.Handler) http.Handler {
+			return &hmacVerifier{
+				hash:            h,
+				algorithm:       hmacAlgorithm,
+				secrets:         secrets,
+				header:          hmacHeader,
+				keyIDHeader:     hmacKeyIDHeader,
+				timestampHeader: hmacTimestampHeader,
+				maxSkew:         hmacMaxSkew,
+				handler:         next,
+			}
+		})
+	}
+	if apiKeys != "" {
+		data, err := loadSecret(context.Background(), apiKeys, e.secretTransport)
+		if err != nil {
+			log.Fatalf("Cannot load -api-keys: %v", err)
+		}
+		keys, err := parseKeys(data)
+		if err != nil {
+			log.Fatalf("Invalid -api-keys: %v", err)
+		}
+		chain.Use("api-key", sproxy.OrderAuth+20, func(next http.Handler) http.Handler {
+			return newAPIKeyVerifier(apiKeyHeader, keys, next)
+		})
+	}
+	handler = chain.Then(handler)
+	maintenance := &maintenanceHandler{handler: handler}
+	handler = maintenance
+	drain := newDrainer(readinessPath, func() {
+		e.audit.LogLocal("proxy.Stop", target, nil)
+		e.flushExporter()
+		if e.cl != nil {
+			e.cl.flush()
+		}
+		e.files.Close()
+		os.Exit(0)
+	}, handler)
+	handler = drain
+	if admin != nil {
+		admin.Handle("/drain", "admin.Drain", drainHandler{drain})
+		admin.HandleProbe("/healthz", healthzHandler{})
+		probed := b.targets
+		if failover != nil {
+			probed = failover.targets
+		}
+		admin.HandleProbe("/readyz", &readyzHandler{drain: drain, targets: probed, dial: b.dialer.DialContext})
+		status := newStatusz()
+		status.Add("Requests", requestRows(drain))
+		status.Add("Connections", connectionRows)
+		if failover != nil {
+			status.Add("Failover", failover.statuszRows)
+		}
+		if balancer != nil {
+			status.Add("Load balancing", balancer.statuszRows)
+		}
+		if b.breakers != nil {
+			status.Add("Circuit breakers", b.breakers.statuszRows)
+		}
+		if b.conns != nil {
+			status.Add("Backend connections", b.conns.statuszRows)
+		}
+		status.Add("Exporters", exporterRows(e.cl))
+		status.Add("Middleware", func() []statuszRow {
+			return []statuszRow{
+				{name: "Stages", value: strings.Join(chain.Names(), ", ")},
+				{name: "Traced stages", value: strings.Join(traced.Names(), ", ")},
+			}
+		})
+		admin.Handle("/statusz", "admin.Statusz", status)
+		admin.Handle("/maintenance", "admin.Maintenance", maintenanceAdmin{maintenance})
+	}
+	if controlSub != "" {
+		t := sproxy.NewHTTPTransport(nil)
+		if !e.exporterViaProxy {
+			t.Proxy = nil
+		}
+		control, err := newControlChannel(context.Background(), controlSub, e.audit, t)
+		if err != nil {
+			log.Fatalf("Invalid -control-subscription: %v", err)
+		}
+		control.Handle("sampling", "control.Sampling", samplingCommand(e.routeSampler))
+		control.Handle("log-level", "control.LogLevel", logLevelCommand)
+		control.Handle("maintenance", "control.Maintenance", maintenanceCommand(maintenance))
+		control.Handle("reload", "control.Reload", func(map[string]string) error {
+			e.reloader.Reload("control command")
+			return nil
+		})
+		go control.Run()
+	}
+	return &proxyHandler{Handler: handler, drain: drain, ws: wsProxy, admin: admin}
+}
 
-	proxy := httputil.NewSingleHostReverseProxy(url)
-	proxy.Transport = &ochttp.Transport{
-		Propagation: &propagation.HTTPFormat{},
+// newListener returns the listener of server, opened with open, and
+// sets the TLS config of server if it serves HTTPS.
+func (e *proxyEnv) newListener(server *http.Server, open func(network, addr string) (net.Listener, error)) net.Listener {
+	network, err := listenNetwork(listenFamily)
+	if err != nil {
+		log.Fatalf("Invalid -listen-family: %v", err)
 	}
-	if tlsCert != "" && tlsKey != "" {
-		log.Fatal(http.ListenAndServeTLS(listen, tlsCert, tlsKey, proxy))
-	} else {
-		log.Fatal(http.ListenAndServe(listen, proxy))
+	l, err := open(network, listen)
+	if err != nil {
+		log.Fatal(err)
 	}
+	var ln net.Listener = &connListener{Listener: l}
+	if acmeDomains != "" {
+		if tlsCert != "" || tlsKey != "" {
+			log.Fatal("-acme-domains can't be used with -tls-cert and -tls-key")
+		}
+		t := sproxy.NewHTTPTransport(nil)
+		if !e.exporterViaProxy {
+			t.Proxy = nil
+		}
+		m, err := newACMEManager(context.Background(), splitList(acmeDomains), acmeCache, acmeEmail, acmeDirectory, t)
+		if err != nil {
+			log.Fatalf("Invalid -acme-domains: %v", err)
+		}
+		server.TLSConfig = acmeTLSConfig(m)
+	} else if tlsCert != "" && tlsKey != "" {
+		var cert atomic.Value
+		err := e.reloader.Watch("-tls-cert", []string{tlsCert, tlsKey}, func(data [][]byte) error {
+			c, err := tls.X509KeyPair(data[0], data[1])
+			if err != nil {
+				return err
+			}
+			cert.Store(&c)
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Cannot load -tls-cert and -tls-key: %v", err)
+		}
+		// Advertising h2 lets http.Server configure HTTP/2,
+		// as ListenAndServeTLS does.
+		server.TLSConfig = &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return cert.Load().(*tls.Certificate), nil
+			},
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+	}
+	if server.TLSConfig != nil {
+		if clientCA != "" {
+			server.TLSConfig.ClientCAs, err = loadCAPool(clientCA)
+			if err != nil {
+				log.Fatalf("Cannot load -client-ca: %v", err)
+			}
+			server.TLSConfig.ClientAuth = clientAuth(requireClientCert)
+		}
+		ln = newHandshakeListener(ln, server.TLSConfig)
+	}
+	return ln
+}
+
+// registerFlags defines the flags of the proxy in fs.
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configFile, "config", "", "YAML or JSON file of flag values")
+	fs.StringVar(&projectID, "project", "", "")
+	fs.StringVar(&exportProjects, "export-projects", "", "additional projects telemetry is exported to")
+	fs.StringVar(&exportTo, "export", "stackdriver", "where telemetry is exported")
+	fs.StringVar(&telemetry, "telemetry", "", "stackdriver, stdout or none, shorthand of -export")
+	fs.StringVar(&exportFormat, "export-format", "text", "format of the stdout export")
+	fs.StringVar(&traceEndpoint, "trace-endpoint", "", "Stackdriver Trace API endpoint")
+	fs.StringVar(&monitoringEndpoint, "monitoring-endpoint", "", "Stackdriver Monitoring API endpoint")
+	fs.StringVar(&loggingEndpoint, "logging-endpoint", "", "Cloud Logging API endpoint")
+	fs.StringVar(&collectorEndpoint, "collector-endpoint", defaultCollectorEndpoint, "Zipkin v2 API spans are sent to")
+	fs.BoolVar(&exportInsecure, "export-insecure", false, "export without TLS and authentication")
+	fs.DurationVar(&monitoringPeriod, "monitoring-period", 10*time.Second, "period metrics are reported at")
+	fs.Var(&viewPeriods, "view-period", "view=duration reporting period")
+	fs.StringVar(&subscribedViews, "views", "", "views subscribed to")
+	fs.StringVar(&metricKind, "metric-kind", "cumulative", "cumulative or delta metrics")
+	fs.IntVar(&exportRetries, "export-retries", 3, "times a failed export is retried")
+	fs.StringVar(&egressProxy, "egress-proxy", "all", "traffic sent through the environment forward proxy")
+	fs.StringVar(&listen, "http", ":6996", "host:port proxy listens")
+	fs.StringVar(&target, "target", "", "target server")
+	fs.StringVar(&targetServerName, "target-server-name", "", "TLS server name of the target")
+	fs.StringVar(&targetTLSCert, "target-tls-cert", "", "TLS client cert file presented to the targets")
+	fs.StringVar(&targetTLSKey, "target-tls-key", "", "TLS client key file presented to the targets")
+	fs.StringVar(&targetCA, "target-ca", "", "CA certs file verifying the targets")
+	fs.BoolVar(&targetInsecure, "target-insecure-skip-verify", false, "INSECURE: don't verify the certificates of the targets")
+	fs.StringVar(&targetIDAudience, "target-id-token-audience", "", "audience of the ID tokens sent to the targets")
+	fs.StringVar(&targetIDAccount, "target-id-token-service-account", "", "service account impersonated to mint the ID tokens")
+	fs.StringVar(&failoverTargets, "failover-targets", "", "targets to fail over to")
+	fs.StringVar(&healthPath, "health-path", "/healthz", "health check path of the targets")
+	fs.DurationVar(&healthInterval, "health-interval", 10*time.Second, "health check interval of the targets")
+	fs.DurationVar(&shutdownTimeout, "shutdown-timeout", defaultDrainTimeout, "drain timeout on SIGTERM")
+	fs.StringVar(&balancePolicy, "balance-policy", "round-robin", "load balancing policy across the targets")
+	fs.IntVar(&retries, "retries", 0, "times a failed idempotent backend request is retried")
+	fs.DurationVar(&retryBackoff, "retry-backoff", 100*time.Millisecond, "backoff before the first retry")
+	fs.IntVar(&breakerFailures, "breaker-failures", 0, "consecutive failures opening the circuit breaker of a target")
+	fs.DurationVar(&breakerTimeout, "breaker-open-timeout", 30*time.Second, "time the circuit breaker of a target stays open")
+	fs.StringVar(&readinessPath, "readiness-path", "", "path of the readiness probes")
+	fs.StringVar(&warmupPaths, "warmup-paths", "", "paths requested from the target on startup")
+	fs.IntVar(&warmupCount, "warmup-count", 1, "warm-up requests per path")
+	fs.DurationVar(&warmupTimeout, "warmup-timeout", 30*time.Second, "timeout of the warm-up")
+	fs.StringVar(&listenFamily, "listen-family", "any", "address family listened on")
+	fs.StringVar(&targetFamily, "target-family", "any", "address family of the target")
+	fs.StringVar(&targetSOCKS5, "target-socks5", "", "SOCKS5 proxy to the target")
+	fs.Float64Var(&traceFrac, "trace-sampling", 1, "sampling fraction for tracing")
+	fs.StringVar(&routeSampling, "route-sampling", "", "sampling fractions for tracing per route")
+	fs.Float64Var(&traceMaxQPS, "trace-max-qps", 0, "maximum number of traces sampled per second")
+	fs.StringVar(&traceForceHeader, "trace-force-header", "", "header of the requests always sampled")
+	fs.BoolVar(&traceHeaders, "trace-headers", false, "add trace headers to responses")
+	fs.StringVar(&backendTraceFormats, "backend-trace-formats", "stackdriver,tracecontext", "trace header formats sent to the backend")
+	fs.StringVar(&propagationFormats, "propagation", "stackdriver", "trace header formats accepted from clients")
+	fs.StringVar(&excludePaths, "exclude-paths", "", "paths excluded from telemetry")
+	fs.StringVar(&tlsCert, "tls-cert", "", "TLS cert file to start an HTTPS proxy")
+	fs.StringVar(&tlsKey, "tls-key", "", "TLS key file to start an HTTPS proxy")
+	fs.StringVar(&clientCA, "client-ca", "", "CA certs file verifying the client certs")
+	fs.BoolVar(&requireClientCert, "require-client-cert", false, "require client certs verified by -client-ca")
+	fs.StringVar(&acmeDomains, "acme-domains", "", "comma separated domains to obtain ACME certs for")
+	fs.StringVar(&acmeCache, "acme-cache", "", "directory or Secret Manager project caching the ACME certs")
+	fs.StringVar(&acmeEmail, "acme-email", "", "contact email of the ACME account")
+	fs.StringVar(&acmeDirectory, "acme-directory", "", "directory URL of the ACME CA, by default Let's Encrypt")
+	fs.StringVar(&grpcTarget, "grpc-target", "", "backend of gRPC requests")
+	fs.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of request headers")
+	fs.IntVar(&maxURLLength, "max-url-length", 0, "maximum length of request URLs")
+	fs.StringVar(&maxBodyBytes, "max-body-bytes", "0", "maximum size of request bodies")
+	fs.StringVar(&routeBodyBytes, "route-max-body-bytes", "", "maximum sizes of request bodies per route")
+	fs.DurationVar(&dialTimeout, "dial-timeout", 30*time.Second, "timeout of the connections to the targets")
+	fs.DurationVar(&backendTLSTimeout, "tls-handshake-timeout", 10*time.Second, "timeout of the TLS handshakes with the targets")
+	fs.DurationVar(&responseHeaderTimeout, "response-header-timeout", 0, "timeout of the response headers of the targets")
+	fs.DurationVar(&idleConnTimeout, "idle-conn-timeout", 90*time.Second, "time the idle connections to the targets are kept")
+	fs.DurationVar(&requestTimeout, "request-timeout", 0, "timeout of the proxied requests")
+	fs.DurationVar(&readTimeout, "read-timeout", 0, "timeout of the client requests")
+	fs.DurationVar(&writeTimeout, "write-timeout", 0, "timeout of the client responses")
+	fs.IntVar(&maxIdleConns, "max-idle-conns", 100, "maximum idle connections to the targets")
+	fs.IntVar(&maxIdleConnsPerHost, "max-idle-conns-per-host", 100, "maximum idle connections to each target")
+	fs.IntVar(&maxConnsPerHost, "max-conns-per-host", 0, "maximum connections to each target")
+	fs.DurationVar(&tcpKeepAlive, "tcp-keep-alive", 30*time.Second, "TCP keep-alive period of the connections to the targets")
+	fs.BoolVar(&disableKeepAlives, "disable-keep-alives", false, "use a connection per request to the targets")
+	fs.StringVar(&cacheSize, "cache-size", "0", "size of the response cache")
+	fs.BoolVar(&cloudLogging, "cloud-logging", false, "write the proxy logs to Cloud Logging")
+	fs.StringVar(&accessLog, "access-log", "", "where the requests are logged")
+	fs.BoolVar(&report5xx, "report-5xx", false, "log the 5xx responses as errors")
+	fs.StringVar(&errorService, "error-reporting-service", "stackdriver-reverse-proxy", "service of the errors reported")
+	fs.StringVar(&errorVersion, "error-reporting-version", version, "version of the errors reported")
+	fs.StringVar(&globalLabels, "labels", "", "static labels added to all telemetry")
+	fs.StringVar(&logSinks, "log-sinks", "", "sinks of the proxy logs by severity")
+	fs.StringVar(&logFileMaxSize, "log-file-max-size", "0", "size at which log files are rolled over")
+	fs.BoolVar(&logFileCompress, "log-file-compress", false, "gzip compress log files")
+	fs.StringVar(&auditLogFile, "audit-log", "", "file to append audit log entries to")
+	fs.Var(&scrubPatterns, "scrub-pattern", "regexp to redact from telemetry")
+	fs.StringVar(&scrubFields, "scrub-fields", "", "fields to redact from telemetry")
+	fs.StringVar(&iapAudience, "iap-audience", "", "audience of the IAP JWTs to verify")
+	fs.StringVar(&opaURL, "opa-url", "", "URL of the OPA decision to authorize requests")
+	fs.StringVar(&opaHeaderList, "opa-headers", "", "comma separated headers sent to OPA")
+	fs.StringVar(&jwtClaimLabels, "jwt-claims", "", "JWT claims to label telemetry with")
+	fs.StringVar(&jwtHeader, "jwt-header", "Authorization", "header carrying the JWT")
+	fs.StringVar(&tenantSpec, "tenant", "", "tenant of the requests to label telemetry with")
+	fs.BoolVar(&tenantHash, "tenant-hash", false, "hash the tenant labels")
+	fs.StringVar(&baggageKeys, "baggage-keys", "", "baggage keys to label telemetry with")
+	fs.StringVar(&baggageSet, "baggage-set", "", "baggage entries to set")
+	fs.BoolVar(&normalizeIDs, "normalize-ids", false, "replace IDs in telemetry paths")
+	fs.StringVar(&pathTemplates, "path-templates", "", "route templates of telemetry paths")
+	fs.DurationVar(&heartbeatInterval, "heartbeat", time.Minute, "interval of the heartbeat metric")
+	fs.StringVar(&instance, "instance", defaultInstance(), "instance label of the heartbeat metric")
+	fs.Float64Var(&rateLimit, "rate-limit", 0, "requests per second per client identity")
+	fs.IntVar(&rateLimitBurst, "rate-limit-burst", 1, "request burst per client identity")
+	fs.StringVar(&rateLimitIdentity, "rate-limit-identity", "ip", "how clients are identified for rate limiting")
+	fs.Var(&rateLimitQuotas, "rate-limit-quota", "identity=rate quota")
+	fs.StringVar(&rateLimitRedis, "rate-limit-redis", "", "Redis server sharing the rate limits across replicas")
+	fs.StringVar(&rateLimitRedisCA, "rate-limit-redis-ca", "", "CA certs file verifying the Redis server")
+	fs.Float64Var(&globalRateLimit, "global-rate-limit", 0, "requests per second of all clients")
+	fs.IntVar(&globalRateBurst, "global-rate-limit-burst", 1, "request burst of all clients")
+	fs.Var(&requestQuotas, "request-quota", "identity=count/period request quota")
+	fs.StringVar(&hmacSecret, "hmac-secret", "", "secret to verify request signatures")
+	fs.StringVar(&hmacAlgorithm, "hmac-algorithm", "sha256", "request signature algorithm")
+	fs.StringVar(&hmacHeader, "hmac-header", "X-Signature", "request signature header")
+	fs.StringVar(&hmacKeyIDHeader, "hmac-key-id-header", "", "request signature key ID header")
+	fs.StringVar(&hmacTimestampHeader, "hmac-timestamp-header", "", "request signature timestamp header")
+	fs.DurationVar(&hmacMaxSkew, "hmac-max-skew", 5*time.Minute, "maximum age of signed requests")
+	fs.StringVar(&apiKeys, "api-keys", "", "name=key API keys required from clients")
+	fs.StringVar(&apiKeyHeader, "api-key-header", "X-Api-Key", "header carrying the API key")
+	fs.StringVar(&spiffeSocket, "spiffe-socket", os.Getenv("SPIFFE_ENDPOINT_SOCKET"), "SPIFFE Workload API socket")
+	fs.StringVar(&spiffeBackendID, "spiffe-backend-id", "", "SPIFFE ID the backend must present")
+	fs.StringVar(&httpsOnly, "https-only", "", "redirect or reject plaintext requests")
+	fs.StringVar(&hsts, "hsts", "", "Strict-Transport-Security header value")
+	fs.StringVar(&trustedProxySpec, "trusted-proxies", "all", "peers whose forwarding headers are kept")
+	fs.StringVar(&forwardedHeaders, "forwarded-headers", "", "optional forwarding headers added to the requests")
+	fs.StringVar(&blockRulesFile, "block-rules", "", "JSON file of rules of requests to block")
+	fs.Int64Var(&blockBodyLimit, "block-body-limit", 64<<10, "bytes of the body inspected by block rules")
+	fs.StringVar(&headerRules, "header-rules", "", "JSON file of rules rewriting headers")
+	fs.StringVar(&disableRoutes, "disable-routes", "", "routes answered without proxying")
+	fs.BoolVar(&shed, "shed", false, "shed load adaptively")
+	fs.IntVar(&shedInitialLimit, "shed-initial-limit", 20, "initial adaptive concurrency limit")
+	fs.IntVar(&shedMaxLimit, "shed-max-limit", 1000, "maximum adaptive concurrency limit")
+	fs.StringVar(&recordFile, "record", "", "file to record requests to")
+	fs.BoolVar(&recordBody, "record-body", false, "record request bodies")
+	fs.StringVar(&latencyBudgetList, "latency-budget", "", "route=duration latency budgets")
+	fs.BoolVar(&latencyBudgetAnnotate, "latency-budget-annotate", false, "annotate spans over budget")
+	fs.DurationVar(&debugTiming, "debug-timing", 0, "log timing of requests slower than this")
+	fs.BoolVar(&debugTraceURLs, "debug-trace-urls", false, "log the trace URLs of sampled requests")
+	fs.StringVar(&adminListen, "admin", "", "host:port admin API listens")
+	fs.StringVar(&prometheusListen, "prometheus", "", "host:port serving /metrics to Prometheus")
+	fs.StringVar(&adminTokenSecret, "admin-token", "", "bearer token of the admin API")
+	fs.StringVar(&controlSub, "control-subscription", "", "Pub/Sub subscription of the control commands")
+	fs.DurationVar(&configRefresh, "config-refresh", 0, "interval the configuration files are re-read at")
+}
+
+// commands are the subcommands of the proxy.
+var commands = map[string]func(args []string){
+	"replay":           replayMain,
+	"loadtest":         loadtestMain,
+	"setup-logmetrics": logmetricsMain,
 }
 
 func usageExit() {
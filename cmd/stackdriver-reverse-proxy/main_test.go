@@ -0,0 +1,244 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTestFlags resets the flags of the proxy to their defaults, then
+// parses args.
+func setTestFlags(t *testing.T, args ...string) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs)
+	if err := fs.Parse(append([]string{"-spiffe-socket="}, args...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestEnv(t *testing.T) *proxyEnv {
+	t.Helper()
+	scrub, err := newScrubber(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit := newAuditLogger(ioutil.Discard, scrub)
+	sampler, err := parseRouteSampling(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &proxyEnv{
+		audit:           audit,
+		reloader:        newConfigReloader(audit),
+		scrub:           scrub,
+		files:           &logFiles{},
+		secretTransport: http.DefaultTransport,
+		cmdline:         map[string]bool{},
+		routeSampler:    sampler,
+		flushExporter:   func() {},
+	}
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackendTransport(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	ca := filepath.Join(dir, "ca.pem")
+	writeFile(t, ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}))
+
+	setTestFlags(t, "-target="+backend.URL, "-max-conns-per-host=2", "-breaker-failures=3")
+	b := newTestEnv(t).newBackendTransport()
+	if b.conns == nil || b.breakers == nil {
+		t.Error("no connection limiter or circuit breakers")
+	}
+	if _, err := (&http.Client{Transport: b.transport}).Get(backend.URL); err == nil {
+		t.Error("request to a backend signed by an unknown CA succeeded")
+	}
+
+	setTestFlags(t, "-target="+backend.URL, "-target-ca="+ca)
+	b = newTestEnv(t).newBackendTransport()
+	if len(b.targets) != 1 || b.targets[0].String() != backend.URL {
+		t.Errorf("targets = %v, want %v", b.targets, backend.URL)
+	}
+	resp, err := (&http.Client{Transport: b.transport}).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "backend" {
+		t.Errorf("got %q, want the backend response", body)
+	}
+}
+
+func TestProxyHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer backend.Close()
+	setTestFlags(t, "-target="+backend.URL, "-max-url-length=16", "-rate-limit=1", "-rate-limit-burst=1", "-disable-routes=/off")
+	e := newTestEnv(t)
+	h := e.newProxyHandler(e.newBackendTransport())
+
+	tests := []struct {
+		target string
+		status int
+		body   string
+	}{
+		{"/" + strings.Repeat("x", 16), http.StatusRequestURITooLong, ""},
+		{"/hello", http.StatusOK, "/hello http"},
+		{"/hello", http.StatusTooManyRequests, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+		if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+			t.Errorf("GET %v = %d %q, want %d %q", tt.target, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+	if h.drain == nil || h.ws == nil || h.admin != nil {
+		t.Errorf("got drainer %v, WebSocket proxy %v and admin server %v, want no admin server without -admin", h.drain, h.ws, h.admin)
+	}
+}
+
+// writeTestCert writes a self-signed certificate of 127.0.0.1 and its
+// key, and returns a pool with the certificate.
+func writeTestCert(t *testing.T, certFile, keyFile string) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+// serveTest serves with the listener built by newListener, and
+// returns the address listened on.
+func serveTest(t *testing.T, e *proxyEnv, server *http.Server) string {
+	t.Helper()
+	var addr string
+	ln := e.newListener(server, func(network, a string) (net.Listener, error) {
+		l, err := net.Listen(network, a)
+		if err == nil {
+			addr = l.Addr().String()
+		}
+		return l, err
+	})
+	go server.Serve(ln)
+	return addr
+}
+
+func TestListener(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+
+	setTestFlags(t, "-target=http://backend", "-http=127.0.0.1:0")
+	server := &http.Server{Handler: handler}
+	defer server.Close()
+	addr := serveTest(t, newTestEnv(t), server)
+	if server.TLSConfig != nil {
+		t.Error("TLS configured without -tls-cert")
+	}
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	pool := writeTestCert(t, certFile, keyFile)
+	setTestFlags(t, "-target=http://backend", "-http=127.0.0.1:0", "-tls-cert="+certFile, "-tls-key="+keyFile)
+	server = &http.Server{Handler: handler}
+	defer server.Close()
+	addr = serveTest(t, newTestEnv(t), server)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err = client.Get("https://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.TLS == nil || string(body) != "HTTP/1.1" {
+		t.Errorf("got %q over TLS %v, want HTTP/1.1 over TLS", body, resp.TLS != nil)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// maintenanceRetryAfter is the Retry-After, in seconds, of the
+// responses in maintenance mode.
+const maintenanceRetryAfter = "120"
+
+// maintenanceHandler answers all the requests with 503 in maintenance
+// mode, without proxying them.
+type maintenanceHandler struct {
+	enabled int32
+	handler http.Handler
+}
+
+// SetEnabled enters or leaves maintenance mode.
+func (h *maintenanceHandler) SetEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	if atomic.SwapInt32(&h.enabled, v) == v {
+		return
+	}
+	if enabled {
+		log.Print("WARNING: Entered maintenance mode, rejecting all requests")
+	} else {
+		log.Print("Left maintenance mode")
+	}
+}
+
+// Enabled reports whether the proxy is in maintenance mode.
+func (h *maintenanceHandler) Enabled() bool {
+	return atomic.LoadInt32(&h.enabled) == 1
+}
+
+func (h *maintenanceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.Enabled() {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	recordRejection(r.Context(), "maintenance")
+	w.Header().Set("Retry-After", maintenanceRetryAfter)
+	http.Error(w, "Service under maintenance", http.StatusServiceUnavailable)
+}
+
+// maintenanceAdmin serves the maintenance admin endpoint. GET returns
+// the mode, POST sets it to the enabled query parameter.
+type maintenanceAdmin struct {
+	h *maintenanceHandler
+}
+
+func (a maintenanceAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		a.h.SetEnabled(enabled)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": a.h.Enabled()})
+}
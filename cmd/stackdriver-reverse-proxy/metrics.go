@@ -0,0 +1,537 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Measures recorded by the proxy itself, in addition to the
+// ones recorded by ochttp.
+var (
+	rejectedRequests, _    = stats.Int64("stackdriver-reverse-proxy/rejected_requests", "Number of requests rejected by the proxy", stats.UnitNone)
+	rateLimitedRequests, _ = stats.Int64("stackdriver-reverse-proxy/rate_limited_requests", "Number of requests over the client rate limit", stats.UnitNone)
+	quotaUsage, _          = stats.Int64("stackdriver-reverse-proxy/quota_usage", "Number of requests counted against a quota", stats.UnitNone)
+	rateLimitChecks, _     = stats.Int64("stackdriver-reverse-proxy/rate_limit_checks", "Number of rate limit checks", stats.UnitNone)
+	httpsRedirects, _      = stats.Int64("stackdriver-reverse-proxy/https_redirects", "Number of plaintext requests redirected to HTTPS", stats.UnitNone)
+	blockedRequests, _     = stats.Int64("stackdriver-reverse-proxy/blocked_requests", "Number of requests blocked by a rule", stats.UnitNone)
+	concurrencyLimit, _    = stats.Float64("stackdriver-reverse-proxy/concurrency_limit", "Adaptive concurrency limit when a request arrived", stats.UnitNone)
+	exportFailures, _      = stats.Int64("stackdriver-reverse-proxy/export_failures", "Number of failed telemetry exports", stats.UnitNone)
+	exportQueue, _         = stats.Int64("stackdriver-reverse-proxy/export_queue", "Number of telemetry items buffered (positive) or sent (negative)", stats.UnitNone)
+	exportDropped, _       = stats.Int64("stackdriver-reverse-proxy/export_dropped", "Number of telemetry items dropped with the buffer full", stats.UnitNone)
+	exportFlushLatency, _  = stats.Float64("stackdriver-reverse-proxy/export_flush_latency", "Duration of the flushes of the telemetry buffers", stats.UnitMilliseconds)
+	exportRPCLatency, _    = stats.Float64("stackdriver-reverse-proxy/export_rpc_latency", "Latency of the export RPC attempts", stats.UnitMilliseconds)
+	exportRPCs, _          = stats.Int64("stackdriver-reverse-proxy/export_rpcs_in_flight", "Number of export RPCs started (1) or ended (-1)", stats.UnitNone)
+	dnsLatency, _          = stats.Float64("stackdriver-reverse-proxy/backend_dns_latency", "Latency of the DNS lookups of backend hosts", stats.UnitMilliseconds)
+	tlsHandshakeLatency, _ = stats.Float64("stackdriver-reverse-proxy/tls_handshake_latency", "Duration of the TLS handshakes", stats.UnitMilliseconds)
+	connections, _         = stats.Int64("stackdriver-reverse-proxy/connections", "Number of connections accepted or dialed", stats.UnitNone)
+	failovers, _           = stats.Int64("stackdriver-reverse-proxy/failovers", "Number of failovers between targets", stats.UnitNone)
+	backendRetries, _      = stats.Int64("stackdriver-reverse-proxy/backend_retries", "Number of retries of backend requests", stats.UnitNone)
+	breakerTransitions, _  = stats.Int64("stackdriver-reverse-proxy/circuit_breaker_transitions", "Number of state changes of the circuit breakers", stats.UnitNone)
+	wsUpgrades, _          = stats.Int64("stackdriver-reverse-proxy/websocket_upgrades", "Number of WebSocket upgrade requests", stats.UnitNone)
+	wsSessions, _          = stats.Int64("stackdriver-reverse-proxy/websocket_sessions", "Number of WebSocket sessions started (1) or ended (-1)", stats.UnitNone)
+	wsSessionDuration, _   = stats.Float64("stackdriver-reverse-proxy/websocket_session_duration", "Duration of the WebSocket sessions", "s")
+	wsBytes, _             = stats.Int64("stackdriver-reverse-proxy/websocket_bytes", "Bytes of the WebSocket frames forwarded", stats.UnitBytes)
+	cacheLookups, _        = stats.Int64("stackdriver-reverse-proxy/cache_lookups", "Number of requests looked up in the response cache", stats.UnitNone)
+	requestBodyBytes, _    = stats.Int64("stackdriver-reverse-proxy/request_body_bytes", "Size of the request bodies", stats.UnitBytes)
+	configReloads, _       = stats.Int64("stackdriver-reverse-proxy/config_reloads", "Number of configuration reloads", stats.UnitNone)
+	heartbeats, _          = stats.Int64("stackdriver-reverse-proxy/heartbeats", "Number of heartbeats of the proxy instance", stats.UnitNone)
+	uptime, _              = stats.Float64("stackdriver-reverse-proxy/uptime", "Seconds since the proxy instance started at a heartbeat", "s")
+	grpcLatency, _         = stats.Float64("stackdriver-reverse-proxy/grpc_latency", "End-to-end latency of the gRPC requests proxied", stats.UnitMilliseconds)
+)
+
+// Tag keys applied to the proxy measures.
+var (
+	// reasonKey is the reason why the proxy rejected a request.
+	reasonKey, _ = tag.NewKey("reason")
+
+	// identityKey is the pseudonym of the client identity used for
+	// rate limiting, so that identities such as emails aren't exported
+	// as is.
+	identityKey, _ = tag.NewKey("identity")
+
+	// ruleKey is the name of the rule that blocked a request.
+	ruleKey, _ = tag.NewKey("rule")
+
+	// methodKey is the Stackdriver API method that failed.
+	methodKey, _ = tag.NewKey("method")
+
+	// codeKey is the gRPC code of a failure.
+	codeKey, _ = tag.NewKey("code")
+
+	// hostKey is the backend host.
+	hostKey, _ = tag.NewKey("host")
+
+	// resultKey is ok or error, or over_quota for the requests
+	// rejected by their quota. For the cache lookups, it is hit,
+	// miss, stale, stale_if_error or revalidated. For the WebSocket
+	// upgrades, it is ok, rejected by the target, dial_error, error
+	// or unsupported.
+	resultKey, _ = tag.NewKey("result")
+
+	// sideKey is listener for the connections accepted by the
+	// proxy, or backend for the connections to the backend.
+	sideKey, _ = tag.NewKey("side")
+
+	// tlsVersionKey is the negotiated TLS version, e.g. TLS1.2.
+	tlsVersionKey, _ = tag.NewKey("tls_version")
+
+	// cipherKey is the negotiated TLS cipher suite.
+	cipherKey, _ = tag.NewKey("cipher")
+
+	// familyKey is the address family of a connection, ipv4 or ipv6.
+	familyKey, _ = tag.NewKey("family")
+
+	// targetKey is the host of the target failed over to.
+	targetKey, _ = tag.NewKey("target")
+
+	// stateKey is the state a circuit breaker changed to: closed,
+	// open or half_open.
+	stateKey, _ = tag.NewKey("state")
+
+	// directionKey is client_to_backend or backend_to_client.
+	directionKey, _ = tag.NewKey("direction")
+
+	// versionKey is the version of the proxy.
+	versionKey, _ = tag.NewKey("version")
+
+	// instanceKey identifies the proxy instance.
+	instanceKey, _ = tag.NewKey("instance")
+
+	// routeKey is the route of a request, as its prefix followed by
+	// *, or other.
+	routeKey, _ = tag.NewKey("route")
+
+	// configKey is the flag of the configuration files reloaded.
+	configKey, _ = tag.NewKey("config")
+
+	// queueKey is the telemetry buffer, cloud_logging or zipkin.
+	queueKey, _ = tag.NewKey("queue")
+
+	// grpcMethodKey and grpcStatusKey are the method and status
+	// code of a gRPC request.
+	grpcMethodKey, _ = tag.NewKey("grpc_method")
+	grpcStatusKey, _ = tag.NewKey("grpc_status")
+
+	// modeKey is redis for the rate limits enforced across replicas,
+	// or local for the ones enforced per replica.
+	modeKey, _ = tag.NewKey("mode")
+)
+
+// proxyViews are subscribed next to ochttp.DefaultViews.
+var proxyViews = []*view.View{
+	{
+		Name:        "stackdriver-reverse-proxy/rejected_requests",
+		Description: "Count of requests rejected by the proxy by reason",
+		TagKeys:     []tag.Key{reasonKey},
+		Measure:     rejectedRequests,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/quota_usage",
+		Description: "Count of the requests counted against a quota by client identity and result",
+		TagKeys:     []tag.Key{identityKey, resultKey},
+		Measure:     quotaUsage,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/rate_limited_requests",
+		Description: "Count of requests over the rate limit by client identity",
+		TagKeys:     []tag.Key{identityKey},
+		Measure:     rateLimitedRequests,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/cache_lookups",
+		Description: "Count of the response cache lookups by result",
+		TagKeys:     []tag.Key{resultKey},
+		Measure:     cacheLookups,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/rate_limit_checks",
+		Description: "Count of rate limit checks by mode",
+		TagKeys:     []tag.Key{modeKey},
+		Measure:     rateLimitChecks,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/https_redirects",
+		Description: "Count of plaintext requests redirected to HTTPS",
+		Measure:     httpsRedirects,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/blocked_requests",
+		Description: "Count of requests blocked by rule",
+		TagKeys:     []tag.Key{ruleKey},
+		Measure:     blockedRequests,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		// The view is cumulative, align it with ALIGN_DELTA
+		// to see the recent limits.
+		Name:        "stackdriver-reverse-proxy/concurrency_limit",
+		Description: "Distribution of the adaptive concurrency limit",
+		Measure:     concurrencyLimit,
+		Aggregation: view.DistributionAggregation{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/export_failures",
+		Description: "Count of failed telemetry exports by API method and code",
+		TagKeys:     []tag.Key{methodKey, codeKey},
+		Measure:     exportFailures,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		// Summing the buffered and sent items gives the buffer length.
+		Name:        "stackdriver-reverse-proxy/export_queue",
+		Description: "Length of the telemetry buffers by queue",
+		TagKeys:     []tag.Key{queueKey},
+		Measure:     exportQueue,
+		Aggregation: view.SumAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/export_dropped",
+		Description: "Count of the telemetry items dropped with the buffer full by queue",
+		TagKeys:     []tag.Key{queueKey},
+		Measure:     exportDropped,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/export_flush_latency",
+		Description: "Duration distribution of the flushes of the telemetry buffers by queue and result",
+		TagKeys:     []tag.Key{queueKey, resultKey},
+		Measure:     exportFlushLatency,
+		Aggregation: ochttp.DefaultLatencyDistribution,
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/export_rpc_latency",
+		Description: "Latency distribution of the export RPC attempts by API method and code",
+		TagKeys:     []tag.Key{methodKey, codeKey},
+		Measure:     exportRPCLatency,
+		Aggregation: ochttp.DefaultLatencyDistribution,
+	},
+	{
+		// Summing the starts and ends gives the RPCs in flight.
+		Name:        "stackdriver-reverse-proxy/export_rpcs_in_flight",
+		Description: "Count of the export RPCs in flight",
+		Measure:     exportRPCs,
+		Aggregation: view.SumAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/backend_dns_latency",
+		Description: "Latency distribution of the backend DNS lookups by host and result",
+		TagKeys:     []tag.Key{hostKey, resultKey},
+		Measure:     dnsLatency,
+		Aggregation: ochttp.DefaultLatencyDistribution,
+	},
+	{
+		// Failures are the lookups with result=error.
+		Name:        "stackdriver-reverse-proxy/backend_dns_lookups",
+		Description: "Count of the backend DNS lookups by host and result",
+		TagKeys:     []tag.Key{hostKey, resultKey},
+		Measure:     dnsLatency,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/tls_handshake_latency",
+		Description: "Duration distribution of the TLS handshakes by side, result, TLS version and cipher",
+		TagKeys:     []tag.Key{sideKey, resultKey, tlsVersionKey, cipherKey},
+		Measure:     tlsHandshakeLatency,
+		Aggregation: ochttp.DefaultLatencyDistribution,
+	},
+	{
+		// Failures are the handshakes with a result other than ok,
+		// e.g. timeout or certificate.
+		Name:        "stackdriver-reverse-proxy/tls_handshakes",
+		Description: "Count of the TLS handshakes by side, result, TLS version and cipher",
+		TagKeys:     []tag.Key{sideKey, resultKey, tlsVersionKey, cipherKey},
+		Measure:     tlsHandshakeLatency,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/connections",
+		Description: "Count of the connections accepted by the listener or dialed to the backend by address family",
+		TagKeys:     []tag.Key{sideKey, familyKey},
+		Measure:     connections,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/failovers",
+		Description: "Count of failovers and failbacks by target failed over to",
+		TagKeys:     []tag.Key{targetKey},
+		Measure:     failovers,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/backend_retries",
+		Description: "Count of the retries of backend requests by backend host",
+		TagKeys:     []tag.Key{hostKey},
+		Measure:     backendRetries,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/circuit_breaker_transitions",
+		Description: "Count of the state changes of the circuit breakers by backend host and state",
+		TagKeys:     []tag.Key{hostKey, stateKey},
+		Measure:     breakerTransitions,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/grpc_latency",
+		Description: "Latency distribution of the gRPC requests by method",
+		TagKeys:     []tag.Key{grpcMethodKey},
+		Measure:     grpcLatency,
+		Aggregation: view.DistributionAggregation{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/grpc_requests",
+		Description: "Count of the gRPC requests by method and status",
+		TagKeys:     []tag.Key{grpcMethodKey, grpcStatusKey},
+		Measure:     grpcLatency,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/websocket_upgrades",
+		Description: "Count of the WebSocket upgrade requests by result",
+		TagKeys:     []tag.Key{resultKey},
+		Measure:     wsUpgrades,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		// Summing the starts and ends gives the sessions in progress.
+		Name:        "stackdriver-reverse-proxy/websocket_sessions",
+		Description: "Count of the WebSocket sessions in progress",
+		Measure:     wsSessions,
+		Aggregation: view.SumAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/websocket_session_duration",
+		Description: "Duration distribution of the WebSocket sessions",
+		Measure:     wsSessionDuration,
+		Aggregation: view.DistributionAggregation{0, 1, 5, 10, 30, 60, 300, 600, 1800, 3600, 7200, 21600, 86400},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/websocket_bytes",
+		Description: "Total bytes of the WebSocket frames forwarded by direction",
+		TagKeys:     []tag.Key{directionKey},
+		Measure:     wsBytes,
+		Aggregation: view.SumAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/request_body_bytes",
+		Description: "Size distribution of the request bodies by route",
+		TagKeys:     []tag.Key{routeKey},
+		Measure:     requestBodyBytes,
+		Aggregation: ochttp.DefaultSizeDistribution,
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/config_reloads",
+		Description: "Count of configuration reloads by flag and result",
+		TagKeys:     []tag.Key{configKey, resultKey},
+		Measure:     configReloads,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/heartbeats",
+		Description: "Count of heartbeats by proxy version and instance",
+		TagKeys:     []tag.Key{versionKey, instanceKey},
+		Measure:     heartbeats,
+		Aggregation: view.CountAggregation{},
+	},
+	{
+		// The maximum of the distribution is the uptime.
+		Name:        "stackdriver-reverse-proxy/uptime",
+		Description: "Distribution of the uptime at heartbeats by proxy version and instance",
+		TagKeys:     []tag.Key{versionKey, instanceKey},
+		Measure:     uptime,
+		Aggregation: view.DistributionAggregation{0, 60, 300, 900, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600, 30 * 24 * 3600},
+	},
+}
+
+// recordRejection counts a request rejected for the given reason.
+func recordRejection(ctx context.Context, reason string) {
+	ctx, err := tag.New(ctx, tag.Upsert(reasonKey, reason))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, rejectedRequests.M(1))
+}
+
+// recordRateLimited counts a request from identity over its rate limit.
+func recordRateLimited(ctx context.Context, identity string) {
+	ctx, err := tag.New(ctx, tag.Upsert(identityKey, pseudonym(identity)))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, rateLimitedRequests.M(1))
+}
+
+// recordQuotaUsage counts a request from identity with result against
+// its quota. The identity *, of the clients of the * quota, isn't
+// hashed.
+func recordQuotaUsage(ctx context.Context, identity, result string) {
+	if identity != "*" {
+		identity = pseudonym(identity)
+	}
+	ctx, err := tag.New(ctx,
+		tag.Upsert(identityKey, identity),
+		tag.Upsert(resultKey, result),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, quotaUsage.M(1))
+}
+
+// recordCacheLookup counts a request looked up in the response cache
+// with result.
+func recordCacheLookup(ctx context.Context, result string) {
+	ctx, err := tag.New(ctx, tag.Upsert(resultKey, result))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, cacheLookups.M(1))
+}
+
+// recordRateLimitCheck counts a rate limit check in mode.
+func recordRateLimitCheck(mode string) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(modeKey, mode))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, rateLimitChecks.M(1))
+}
+
+// recordRequestBody records the size of a request body of route.
+func recordRequestBody(ctx context.Context, route string, n int64) {
+	ctx, err := tag.New(ctx, tag.Upsert(routeKey, tagValue(route)))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, requestBodyBytes.M(n))
+}
+
+// recordConfigReload counts a reload of the configuration files
+// of flag with result, ok or error.
+func recordConfigReload(flag, result string) {
+	ctx, err := tag.New(context.Background(),
+		tag.Upsert(configKey, flag),
+		tag.Upsert(resultKey, result),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, configReloads.M(1))
+}
+
+// recordBlocked counts a request blocked by the named rule.
+func recordBlocked(ctx context.Context, rule string) {
+	ctx, err := tag.New(ctx, tag.Upsert(ruleKey, tagValue(rule)))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, blockedRequests.M(1))
+}
+
+// pathViews break down the server metrics by request path. They are
+// only subscribed if the paths are normalized, to bound cardinality.
+var pathViews = []*view.View{
+	{
+		Name:        "stackdriver-reverse-proxy/response_bytes_by_path",
+		Description: "Size distribution of the response bodies by normalized path",
+		TagKeys:     []tag.Key{ochttp.Path},
+		Measure:     ochttp.ServerResponseBytes,
+		Aggregation: ochttp.DefaultSizeDistribution,
+	},
+}
+
+// extraViews break down the HTTP metrics further than the ochttp
+// views. They are only subscribed if selected with -views.
+var extraViews = []*view.View{
+	{
+		Name:        "stackdriver-reverse-proxy/latency_by_status",
+		Description: "Latency distribution of the requests by response status",
+		TagKeys:     []tag.Key{ochttp.StatusCode},
+		Measure:     ochttp.ServerLatency,
+		Aggregation: ochttp.DefaultLatencyDistribution,
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/latency_by_method",
+		Description: "Latency distribution of the requests by method",
+		TagKeys:     []tag.Key{ochttp.Method},
+		Measure:     ochttp.ServerLatency,
+		Aggregation: ochttp.DefaultLatencyDistribution,
+	},
+	{
+		Name:        "stackdriver-reverse-proxy/backend_latency_by_status",
+		Description: "Latency distribution of the backend requests by response status",
+		TagKeys:     []tag.Key{ochttp.StatusCode},
+		Measure:     ochttp.ClientLatency,
+		Aggregation: ochttp.DefaultLatencyDistribution,
+	},
+}
+
+// recordExportQueue records n telemetry items buffered in queue, or
+// sent if negative.
+func recordExportQueue(queue string, n int) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(queueKey, queue))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, exportQueue.M(int64(n)))
+}
+
+// recordExportDropped counts a telemetry item dropped by queue.
+func recordExportDropped(queue string) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(queueKey, queue))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, exportDropped.M(1))
+}
+
+// recordExportFlush records the duration of a flush of queue since
+// start with result, ok or error.
+func recordExportFlush(queue, result string, start time.Time) {
+	ctx, err := tag.New(context.Background(),
+		tag.Upsert(queueKey, queue),
+		tag.Upsert(resultKey, result),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, exportFlushLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+}
+
+// recordExportRPC records the latency of an export RPC attempt of
+// method since start ending with code.
+func recordExportRPC(method, code string, start time.Time) {
+	ctx, err := tag.New(context.Background(),
+		tag.Upsert(methodKey, method),
+		tag.Upsert(codeKey, code),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, exportRPCLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+}
@@ -0,0 +1,195 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// netLogTimeout bounds the dials and writes to the log servers.
+	netLogTimeout = 5 * time.Second
+
+	// gelfChunkSize is the largest GELF datagram sent over UDP.
+	gelfChunkSize = 8192
+
+	// syslogFacility is the daemon facility.
+	syslogFacility = 3
+)
+
+// syslogSeverities are the syslog severities of the log severities.
+var syslogSeverities = map[string]int{
+	"DEBUG":   7,
+	"INFO":    6,
+	"WARNING": 4,
+	"ERROR":   3,
+}
+
+// netLogSink writes the log lines to a syslog (RFC 5424) or GELF
+// server, over UDP or TCP. Lines that cannot be written are dropped.
+type netLogSink struct {
+	format   string
+	network  string
+	addr     string
+	hostname string
+	labels   map[string]string
+
+	conn net.Conn
+}
+
+// newNetLogSink returns a sink to the server at u, of the form
+// syslog://host:port or gelf://host:port for UDP, and
+// syslog+tcp://host:port or gelf+tcp://host:port for TCP. The
+// messages carry the static labels as fields.
+func newNetLogSink(u *url.URL, labels map[string]string) (*netLogSink, error) {
+	s := &netLogSink{network: "udp", addr: u.Host, labels: labels}
+	switch u.Scheme {
+	case "syslog", "gelf":
+		s.format = u.Scheme
+	case "syslog+tcp", "gelf+tcp":
+		s.format = u.Scheme[:len(u.Scheme)-len("+tcp")]
+		s.network = "tcp"
+	default:
+		return nil, fmt.Errorf("unknown log server scheme %q, want syslog, syslog+tcp, gelf or gelf+tcp", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		return nil, err
+	}
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+	return s, nil
+}
+
+// Write writes a line of the standard logger. The standard logger
+// serializes the writes.
+func (s *netLogSink) Write(p []byte) (int, error) {
+	ll := parseLine(string(p))
+	var err error
+	if s.format == "syslog" {
+		err = s.send(s.syslogMessage(ll))
+	} else {
+		err = s.sendGELF(s.gelfMessage(ll))
+	}
+	if err != nil {
+		// Logging the failure would write to s again.
+		fmt.Fprintf(os.Stderr, "ERROR: Cannot write logs to %v://%v: %v\n", s.format, s.addr, err)
+	}
+	return len(p), nil
+}
+
+// syslogMessage returns the RFC 5424 message of ll.
+func (s *netLogSink) syslogMessage(ll logLine) []byte {
+	msg := ll.message
+	names := make([]string, 0, len(s.labels))
+	for k := range s.labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		msg += fmt.Sprintf(" %v=%q", k, s.labels[k])
+	}
+	if ll.traceID != "" {
+		msg += " trace=" + ll.traceID + " span=" + ll.spanID
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s stackdriver-reverse-proxy %d - - %s",
+		syslogFacility*8+syslogSeverities[ll.severity],
+		ll.time.UTC().Format(time.RFC3339Nano), s.hostname, os.Getpid(), msg))
+}
+
+// gelfMessage returns the GELF 1.1 message of ll.
+func (s *netLogSink) gelfMessage(ll logLine) []byte {
+	m := map[string]interface{}{
+		"version":       "1.1",
+		"host":          s.hostname,
+		"short_message": ll.message,
+		"timestamp":     float64(ll.time.UnixNano()) / 1e9,
+		"level":         syslogSeverities[ll.severity],
+		"_app":          "stackdriver-reverse-proxy",
+	}
+	for k, v := range s.labels {
+		m["_"+k] = v
+	}
+	if ll.traceID != "" {
+		m["_trace_id"] = ll.traceID
+		m["_span_id"] = ll.spanID
+	}
+	b, _ := json.Marshal(m)
+	return b
+}
+
+// sendGELF sends a GELF message, chunked if it doesn't fit in a
+// UDP datagram.
+func (s *netLogSink) sendGELF(msg []byte) error {
+	if s.network == "tcp" {
+		return s.send(append(msg, 0))
+	}
+	if len(msg) <= gelfChunkSize {
+		return s.send(msg)
+	}
+	const header = 12
+	size := gelfChunkSize - header
+	count := (len(msg) + size - 1) / size
+	if count > 128 {
+		return fmt.Errorf("message of %d bytes is too large", len(msg))
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		chunk := msg[i*size:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		b := append([]byte{0x1e, 0x0f}, id...)
+		b = append(b, byte(i), byte(count))
+		if err := s.send(append(b, chunk...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send writes b, in a datagram over UDP and framed by octet counting
+// for syslog over TCP (RFC 6587). The connection is dialed again
+// after a failure.
+func (s *netLogSink) send(b []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, netLogTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if s.network == "tcp" && s.format == "syslog" {
+		b = append([]byte(fmt.Sprintf("%d ", len(b))), b...)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(netLogTimeout))
+	if _, err := s.conn.Write(b); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// idSegment matches the path segments that are likely IDs:
+// numbers, UUIDs and long hex strings.
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// pathNormalizer normalizes the URL paths used in span names and
+// metric labels, so they don't have unbounded cardinality.
+//
+// Paths matching a template, e.g. /users/{id}/orders/{order}, are
+// replaced by the template. A {name} segment matches any segment.
+// If ids is set, the ID segments of the other paths are replaced by {id}.
+type pathNormalizer struct {
+	templates [][]string
+	ids       bool
+}
+
+func newPathNormalizer(templates []string, ids bool) *pathNormalizer {
+	n := &pathNormalizer{ids: ids}
+	for _, t := range templates {
+		n.templates = append(n.templates, strings.Split(t, "/"))
+	}
+	return n
+}
+
+// Normalize returns the normalized path.
+func (n *pathNormalizer) Normalize(path string) string {
+	segments := strings.Split(path, "/")
+	for _, t := range n.templates {
+		if matchTemplate(t, segments) {
+			return strings.Join(t, "/")
+		}
+	}
+	if !n.ids {
+		return path
+	}
+	for i, s := range segments {
+		if idSegment.MatchString(s) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func matchTemplate(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			continue
+		}
+		if t != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type originalURLKey struct{}
+
+// withNormalizedPath returns a copy of r whose URL path is normalized,
+// to be restored by withOriginalURL.
+func withNormalizedPath(r *http.Request, n *pathNormalizer) *http.Request {
+	path := n.Normalize(r.URL.Path)
+	if path == r.URL.Path {
+		return r
+	}
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	r = r.WithContext(context.WithValue(r.Context(), originalURLKey{}, r.URL))
+	r.URL = &u
+	return r
+}
+
+// withOriginalURL returns a copy of r with the URL it had
+// before withNormalizedPath.
+func withOriginalURL(r *http.Request) *http.Request {
+	u, ok := r.Context().Value(originalURLKey{}).(*url.URL)
+	if !ok {
+		return r
+	}
+	r = r.WithContext(context.WithValue(r.Context(), originalURLKey{}, nil))
+	r.URL = u
+	return r
+}
+
+// normalizeHandler normalizes the request paths seen by ochttp.
+// It must wrap ochttp.Handler, and restoreURLHandler be installed
+// inside ochttp.Handler.
+type normalizeHandler struct {
+	n       *pathNormalizer
+	handler http.Handler
+}
+
+func (h *normalizeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, withNormalizedPath(r, h.n))
+}
+
+type restoreURLHandler struct {
+	handler http.Handler
+}
+
+func (h *restoreURLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, withOriginalURL(r))
+}
+
+// normalizeTransport normalizes the backend request paths seen by
+// ochttp.Transport. The base transport of ochttp.Transport must be
+// a restoreURLTransport.
+type normalizeTransport struct {
+	n    *pathNormalizer
+	base http.RoundTripper
+}
+
+func (t *normalizeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(withNormalizedPath(req, t.n))
+}
+
+type restoreURLTransport struct {
+	base http.RoundTripper
+}
+
+func (t *restoreURLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(withOriginalURL(req))
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+// periodExporter exports each view once per its reporting period.
+// Periods are aligned to the Unix epoch, so a view with a 5m period
+// is reported once in every 5 minute window of the wall clock.
+//
+// The views are reported to periodExporter at the shortest period,
+// see minPeriod.
+type periodExporter struct {
+	telemetryExporter
+
+	defaultPeriod time.Duration
+	names         []string // view names or prefixes
+	periods       []time.Duration
+
+	mu       sync.Mutex
+	reported map[string]time.Time // by view name
+}
+
+// newPeriodExporter returns an exporter reporting views at
+// the periods of name=duration items, where name is a view name
+// or a view name prefix ending with '*', e.g.
+// opencensus.io/http/server/*=10s.
+func newPeriodExporter(e telemetryExporter, defaultPeriod time.Duration, items []string) (*periodExporter, error) {
+	p := &periodExporter{
+		telemetryExporter: e,
+		defaultPeriod:     defaultPeriod,
+		reported:          make(map[string]time.Time),
+	}
+	for _, item := range items {
+		name, v, err := splitPair(item)
+		if err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid period for %v: %q", name, v)
+		}
+		p.names = append(p.names, routePrefix(name))
+		p.periods = append(p.periods, d)
+	}
+	return p, nil
+}
+
+// minPeriod is the shortest reporting period, at which views
+// must be reported to the exporter.
+func (e *periodExporter) minPeriod() time.Duration {
+	min := e.defaultPeriod
+	for _, d := range e.periods {
+		if d < min {
+			min = d
+		}
+	}
+	return min
+}
+
+func (e *periodExporter) period(name string) time.Duration {
+	// View names are matched like routes, the longest prefix wins.
+	if i := matchRoute(e.names, name); i >= 0 {
+		return e.periods[i]
+	}
+	return e.defaultPeriod
+}
+
+func (e *periodExporter) ExportView(vd *view.Data) {
+	period := e.period(vd.View.Name)
+	window := vd.End.Truncate(period)
+
+	e.mu.Lock()
+	last, ok := e.reported[vd.View.Name]
+	if ok && !window.After(last) {
+		e.mu.Unlock()
+		return
+	}
+	e.reported[vd.View.Name] = window
+	e.mu.Unlock()
+
+	e.telemetryExporter.ExportView(vd)
+}
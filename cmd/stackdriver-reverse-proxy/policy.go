@@ -0,0 +1,163 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const opaTimeout = 2 * time.Second
+
+// opaInput is the document policies are evaluated against,
+// available as `input` in Rego. Only the headers the policies need
+// are sent, never the credentials: the identity verified by the proxy
+// stands for them.
+type opaInput struct {
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Segments []string          `json:"path_segments"`
+	Query    string            `json:"query,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"` // values of repeated headers joined with ", "
+	ClientIP string            `json:"client_ip"`
+	Identity string            `json:"identity,omitempty"`
+}
+
+// opaAuthorizer asks an external Open Policy Agent server for a
+// decision on each request before proxying it. The policies are
+// loaded and reloaded by the OPA server, e.g. a sidecar run with
+// `opa run --server --watch`.
+type opaAuthorizer struct {
+	url     string   // URL of the decision document, e.g. http://localhost:8181/v1/data/proxy/allow
+	headers []string // canonical names of the headers sent
+	client  *http.Client
+	handler http.Handler
+}
+
+// newOPAAuthorizer returns an authorizer sending the headers, see
+// opaHeaders, to the OPA server at url.
+func newOPAAuthorizer(url string, headers []string, t http.RoundTripper, h http.Handler) *opaAuthorizer {
+	return &opaAuthorizer{
+		url:     url,
+		headers: headers,
+		client:  &http.Client{Transport: t, Timeout: opaTimeout},
+		handler: h,
+	}
+}
+
+// opaHeaders returns the canonical names of the headers sent to OPA,
+// refusing the credential headers, see sensitiveHeader.
+func opaHeaders(names []string) ([]string, error) {
+	var headers []string
+	for _, name := range names {
+		if sensitiveHeader(name) {
+			return nil, fmt.Errorf("%v carries credentials", name)
+		}
+		headers = append(headers, http.CanonicalHeaderKey(name))
+	}
+	return headers, nil
+}
+
+func (a *opaAuthorizer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	span := trace.FromContext(r.Context())
+	allow, reason, err := a.decide(r)
+	if err != nil {
+		log.Printf("Cannot evaluate policy: %v", err)
+		span.SetAttributes(trace.StringAttribute("policy.decision", "error"))
+		recordRejection(r.Context(), "policy_error")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	attrs := []trace.Attribute{trace.BoolAttribute("policy.allowed", allow)}
+	if reason != "" {
+		attrs = append(attrs, trace.StringAttribute("policy.reason", reason))
+	}
+	span.SetAttributes(attrs...)
+	if !allow {
+		recordRejection(r.Context(), "policy_denied")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	a.handler.ServeHTTP(w, r)
+}
+
+// decide queries the OPA data API. The decision document can either
+// be a boolean or an object with "allow" and optional "reason" fields.
+func (a *opaAuthorizer) decide(r *http.Request) (allow bool, reason string, err error) {
+	body, err := json.Marshal(map[string]interface{}{"input": a.input(r)})
+	if err != nil {
+		return false, "", err
+	}
+	req, err := http.NewRequest("POST", a.url, bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req.WithContext(r.Context()))
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("OPA responded with %v", resp.Status)
+	}
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, "", err
+	}
+	if len(out.Result) == 0 {
+		// Undefined decision, the policy is not loaded
+		// or doesn't match the URL.
+		return false, "undefined", nil
+	}
+	if err := json.Unmarshal(out.Result, &allow); err == nil {
+		return allow, "", nil
+	}
+	var doc struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(out.Result, &doc); err != nil {
+		return false, "", fmt.Errorf("unexpected decision %s", out.Result)
+	}
+	return doc.Allow, doc.Reason, nil
+}
+
+func (a *opaAuthorizer) input(r *http.Request) *opaInput {
+	in := &opaInput{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Segments: strings.Split(strings.Trim(r.URL.Path, "/"), "/"),
+		Query:    r.URL.RawQuery,
+		Headers:  make(map[string]string, len(a.headers)),
+		ClientIP: clientIP(r),
+		Identity: verifiedIdentity(r),
+	}
+	for _, k := range a.headers {
+		if v, ok := r.Header[k]; ok {
+			in.Headers[strings.ToLower(k)] = strings.Join(v, ", ")
+		}
+	}
+	return in
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// probeTimeout bounds the connections to the targets of the readiness
+// probes.
+const probeTimeout = 2 * time.Second
+
+// targetAddr returns the host:port of the target u.
+func targetAddr(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Host, "443")
+	}
+	return net.JoinHostPort(u.Host, "80")
+}
+
+// healthzHandler answers the liveness probes, as long as the process
+// serves requests.
+type healthzHandler struct{}
+
+func (healthzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// readyzHandler answers the readiness probes: the proxy is ready once
+// warmed up, until it drains, while one of the targets accepts
+// connections. The exporters are created before the admin API
+// listens, so they are always initialized by then. The targets are
+// only dialed, so the probes don't reach the application.
+type readyzHandler struct {
+	drain   *drainer
+	targets []*url.URL
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (h *readyzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if reason := h.drain.notReady(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+	var errs []string
+	for _, u := range h.targets {
+		conn, err := h.dial(ctx, "tcp", targetAddr(u))
+		if err == nil {
+			conn.Close()
+			io.WriteString(w, "ok\n")
+			return
+		}
+		errs = append(errs, fmt.Sprintf("%v: %v", u.Host, err))
+	}
+	http.Error(w, "no reachable target: "+strings.Join(errs, "; "), http.StatusServiceUnavailable)
+}
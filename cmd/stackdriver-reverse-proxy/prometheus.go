@@ -0,0 +1,167 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+// prometheusExporter keeps the last reported data of the views to
+// serve them in the Prometheus text format, for the operators
+// scraping with Prometheus instead of, or besides, reading
+// Stackdriver Monitoring. The views are reported cumulative, whatever
+// the -metric-kind.
+type prometheusExporter struct {
+	mu    sync.Mutex
+	views map[string]*view.Data
+}
+
+func newPrometheusExporter() *prometheusExporter {
+	return &prometheusExporter{views: make(map[string]*view.Data)}
+}
+
+// ExportSpan drops the spans, Prometheus only scrapes metrics.
+func (e *prometheusExporter) ExportSpan(*trace.SpanData) {}
+
+func (e *prometheusExporter) ExportView(vd *view.Data) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.views[vd.View.Name] = vd
+}
+
+func (e *prometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	names := make([]string, 0, len(e.views))
+	for name := range e.views {
+		names = append(names, name)
+	}
+	views := make([]*view.Data, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		views[i] = e.views[name]
+	}
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(w)
+	for _, vd := range views {
+		writePrometheusView(b, vd)
+	}
+	b.Flush()
+}
+
+var prometheusInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// prometheusName returns name with the characters invalid in the
+// Prometheus metric and label names replaced with _, e.g.
+// opencensus_io_http_server_latency.
+func prometheusName(name string) string {
+	name = prometheusInvalid.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+var (
+	prometheusHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// prometheusRow is a row of a view with its formatted labels.
+type prometheusRow struct {
+	labels string
+	data   view.AggregationData
+}
+
+// writePrometheusView writes the rows of vd, counts as counters,
+// sums as untyped, means as summaries and distributions as
+// histograms.
+func writePrometheusView(b *bufio.Writer, vd *view.Data) {
+	name := prometheusName(vd.View.Name)
+	typ := "untyped"
+	var bounds []float64
+	switch a := vd.View.Aggregation.(type) {
+	case view.CountAggregation, *view.CountAggregation:
+		typ = "counter"
+	case view.MeanAggregation, *view.MeanAggregation:
+		typ = "summary"
+	case view.DistributionAggregation:
+		typ, bounds = "histogram", a
+	case *view.DistributionAggregation:
+		typ, bounds = "histogram", *a
+	}
+	fmt.Fprintf(b, "# HELP %s %s\n", name, prometheusHelpEscaper.Replace(vd.View.Description))
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, typ)
+
+	rows := make([]prometheusRow, len(vd.Rows))
+	for i, r := range vd.Rows {
+		labels := make([]string, len(r.Tags))
+		for j, t := range r.Tags {
+			labels[j] = prometheusName(t.Key.Name()) + `="` + prometheusLabelEscaper.Replace(t.Value) + `"`
+		}
+		sort.Strings(labels)
+		rows[i] = prometheusRow{labels: strings.Join(labels, ","), data: r.Data}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].labels < rows[j].labels })
+	for _, r := range rows {
+		switch d := r.data.(type) {
+		case *view.CountData:
+			writePrometheusSample(b, name, r.labels, float64(*d))
+		case *view.SumData:
+			writePrometheusSample(b, name, r.labels, float64(*d))
+		case *view.MeanData:
+			writePrometheusSample(b, name+"_sum", r.labels, d.Mean*float64(d.Count))
+			writePrometheusSample(b, name+"_count", r.labels, float64(d.Count))
+		case *view.DistributionData:
+			var count int64
+			for i, n := range d.CountPerBucket {
+				count += n
+				le := "+Inf"
+				if i < len(bounds) {
+					le = strconv.FormatFloat(bounds[i], 'g', -1, 64)
+				}
+				writePrometheusSample(b, name+"_bucket", joinLabels(r.labels, `le="`+le+`"`), float64(count))
+			}
+			writePrometheusSample(b, name+"_sum", r.labels, d.Mean*float64(d.Count))
+			writePrometheusSample(b, name+"_count", r.labels, float64(d.Count))
+		}
+	}
+}
+
+func writePrometheusSample(b *bufio.Writer, name, labels string, v float64) {
+	if labels != "" {
+		fmt.Fprintf(b, "%s{%s} %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+		return
+	}
+	fmt.Fprintf(b, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opencensus.io/exporter/stackdriver/propagation"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/trace"
+	tracepropagation "go.opencensus.io/trace/propagation"
+)
+
+// traceFormats are the trace header formats by name.
+var traceFormats = map[string]tracepropagation.HTTPFormat{
+	"stackdriver":  &propagation.HTTPFormat{},
+	"tracecontext": traceContextFormat{},
+	"b3":           &b3.HTTPFormat{},
+	"b3-single":    b3SingleFormat{},
+}
+
+// parseTraceFormats returns the format propagating the traces in the
+// headers of each of the named formats.
+func parseTraceFormats(names []string) (tracepropagation.HTTPFormat, error) {
+	var formats multiFormat
+	for _, name := range names {
+		f, ok := traceFormats[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown trace format %q, want stackdriver, tracecontext, b3 or b3-single", name)
+		}
+		formats = append(formats, f)
+	}
+	if len(formats) == 0 {
+		return nil, errors.New("no trace format")
+	}
+	if len(formats) == 1 {
+		return formats[0], nil
+	}
+	return formats, nil
+}
+
+// multiFormat propagates the traces in the headers of all its formats,
+// so that backends instrumented differently all find the trace.
+// Incoming traces are read from the first format present.
+type multiFormat []tracepropagation.HTTPFormat
+
+func (m multiFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	for _, f := range m {
+		if sc, ok := f.SpanContextFromRequest(req); ok {
+			return sc, true
+		}
+	}
+	return trace.SpanContext{}, false
+}
+
+func (m multiFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	for _, f := range m {
+		f.SpanContextToRequest(sc, req)
+	}
+}
+
+// traceparentHeader is the header of the W3C Trace Context format.
+const traceparentHeader = "traceparent"
+
+// traceContextFormat propagates the traces in the W3C traceparent
+// header, version 00. The tracestate header is not propagated.
+type traceContextFormat struct{}
+
+func (traceContextFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	// version-trace_id-parent_id-trace_flags
+	parts := strings.Split(req.Header.Get(traceparentHeader), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return trace.SpanContext{}, false
+	}
+	var sc trace.SpanContext
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil || len(tid) != len(sc.TraceID) {
+		return trace.SpanContext{}, false
+	}
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil || len(sid) != len(sc.SpanID) {
+		return trace.SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return trace.SpanContext{}, false
+	}
+	copy(sc.TraceID[:], tid)
+	copy(sc.SpanID[:], sid)
+	if sc.TraceID == (trace.TraceID{}) || sc.SpanID == (trace.SpanID{}) {
+		return trace.SpanContext{}, false
+	}
+	sc.TraceOptions = trace.TraceOptions(flags[0] & 1)
+	return sc, true
+}
+
+func (traceContextFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	req.Header.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, byte(sc.TraceOptions&1)))
+}
+
+// b3SingleHeader is the header of the single-header B3 format.
+const b3SingleHeader = "b3"
+
+// b3SingleFormat propagates the traces in the single b3 header used by
+// Zipkin and Istio, {trace_id}-{span_id}-{sampled}-{parent_span_id}, in
+// which the sampled and parent_span_id fields are optional. The 64-bit
+// trace IDs are padded to 128 bits, as in the multi-header format.
+type b3SingleFormat struct{}
+
+func (b3SingleFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	// A lone sampling decision, e.g. b3: 0, carries no trace.
+	parts := strings.Split(req.Header.Get(b3SingleHeader), "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return trace.SpanContext{}, false
+	}
+	var sc trace.SpanContext
+	tid, err := hex.DecodeString(parts[0])
+	if err != nil || (len(tid) != 8 && len(tid) != len(sc.TraceID)) {
+		return trace.SpanContext{}, false
+	}
+	sid, err := hex.DecodeString(parts[1])
+	if err != nil || len(sid) != len(sc.SpanID) {
+		return trace.SpanContext{}, false
+	}
+	copy(sc.TraceID[len(sc.TraceID)-len(tid):], tid)
+	copy(sc.SpanID[:], sid)
+	if sc.TraceID == (trace.TraceID{}) || sc.SpanID == (trace.SpanID{}) {
+		return trace.SpanContext{}, false
+	}
+	if len(parts) > 2 {
+		switch parts[2] {
+		case "1", "d": // d is the debug flag, which implies sampled.
+			sc.TraceOptions = 1
+		case "0":
+		default:
+			return trace.SpanContext{}, false
+		}
+	}
+	return sc, true
+}
+
+func (b3SingleFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	req.Header.Set(b3SingleHeader, fmt.Sprintf("%s-%s-%d", sc.TraceID, sc.SpanID, sc.TraceOptions&1))
+}
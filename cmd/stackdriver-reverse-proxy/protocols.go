@@ -0,0 +1,90 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/stackdriver-reverse-proxy/sproxy"
+	"golang.org/x/net/http2"
+)
+
+// grpcFlushInterval is how often streamed gRPC responses are flushed.
+const grpcFlushInterval = 10 * time.Millisecond
+
+// isGRPC reports whether r is a gRPC request.
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// newGRPCProxy returns a reverse proxy to a gRPC backend. The
+// backend is dialed with dial and reached over HTTP/2, with prior
+// knowledge if target is an http URL.
+func newGRPCProxy(target *url.URL, dial func(ctx context.Context, network, addr string) (net.Conn, error), tlsConfig *tls.Config, wrap func(http.RoundTripper) http.RoundTripper) *httputil.ReverseProxy {
+	t := &http2.Transport{
+		TLSClientConfig: tlsConfig,
+		AllowHTTP:       target.Scheme == "http",
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := dial(context.Background(), network, addr)
+			if err != nil || target.Scheme == "http" {
+				return conn, err
+			}
+			tlsConn := tls.Client(conn, cfg)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+				conn.Close()
+				return nil, fmt.Errorf("unexpected ALPN protocol %q, want %q", p, http2.NextProtoTLS)
+			}
+			return tlsConn, nil
+		},
+	}
+	p := httputil.NewSingleHostReverseProxy(target)
+	p.Director = sproxy.ForwardedProto(p.Director)
+	p.Transport = wrap(&reresolveTransport{base: t})
+	p.FlushInterval = grpcFlushInterval
+	return p
+}
+
+// protocolHandler routes the gRPC requests accepted over HTTP/2
+// to grpc, the WebSocket upgrades to websocket, and the other
+// requests to handler.
+type protocolHandler struct {
+	grpc      http.Handler
+	websocket http.Handler
+	handler   http.Handler
+}
+
+func (h *protocolHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isGRPC(r) {
+		h.grpc.ServeHTTP(withFlusher(w, r), r)
+		return
+	}
+	if isWebSocket(r) {
+		h.websocket.ServeHTTP(w, r)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
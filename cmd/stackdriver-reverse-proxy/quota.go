@@ -0,0 +1,201 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxQuotaCounters caps the counters kept. The identities over
+	// it share the counters of overflowIdentity, e.g. during an
+	// attack from many addresses with a * quota.
+	maxQuotaCounters = 100000
+	overflowIdentity = ""
+)
+
+// quotaPeriods are the periods of the request quotas by name.
+var quotaPeriods = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// quota allows limit requests per period, in windows aligned to UTC.
+type quota struct {
+	limit  int64
+	period time.Duration
+}
+
+// parseRequestQuotas parses identity=count/period items, e.g.
+// alice@example.com=10000/day, where * is any identity without its
+// own quotas. An identity can have a quota per period.
+func parseRequestQuotas(items []string) (map[string][]quota, error) {
+	quotas := make(map[string][]quota)
+	for _, item := range items {
+		id, v, err := splitPair(item)
+		if err != nil {
+			return nil, err
+		}
+		i := strings.LastIndex(v, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("quota %q has no period, want count/hour or count/day", item)
+		}
+		limit, err := strconv.ParseInt(v[:i], 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("quota %q has an invalid count", item)
+		}
+		period, ok := quotaPeriods[v[i+1:]]
+		if !ok {
+			return nil, fmt.Errorf("quota %q has an unknown period %q, want hour or day", item, v[i+1:])
+		}
+		quotas[id] = append(quotas[id], quota{limit: limit, period: period})
+	}
+	return quotas, nil
+}
+
+// quotaCounter counts the requests of an identity in a window.
+type quotaCounter struct {
+	start time.Time
+	n     int64
+}
+
+type quotaCounterKey struct {
+	identity string
+	period   time.Duration
+}
+
+// quotaEnforcer counts the requests of each identity against its
+// quotas, in this replica.
+type quotaEnforcer struct {
+	quotas map[string][]quota
+
+	mu        sync.Mutex
+	counters  map[quotaCounterKey]*quotaCounter
+	lastSweep time.Time
+}
+
+func newQuotaEnforcer(quotas map[string][]quota) *quotaEnforcer {
+	return &quotaEnforcer{
+		quotas:    quotas,
+		counters:  make(map[quotaCounterKey]*quotaCounter),
+		lastSweep: time.Now(),
+	}
+}
+
+// quotaStatus is the state of the quota closest to be exceeded.
+type quotaStatus struct {
+	limit     int64
+	remaining int64
+	reset     time.Time
+}
+
+// Use counts a request of id at now unless it exceeds one of its
+// quotas, and returns whether it was allowed with the status of the
+// exceeded quota, or of the one with the fewest remaining requests.
+// Identities without quotas are always allowed, with a nil status.
+func (e *quotaEnforcer) Use(id string, now time.Time) (bool, *quotaStatus) {
+	quotas, ok := e.quotas[id]
+	if !ok {
+		quotas = e.quotas["*"]
+	}
+	if len(quotas) == 0 {
+		return true, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if now.Sub(e.lastSweep) > time.Minute {
+		for k, c := range e.counters {
+			if now.Sub(c.start) >= k.period {
+				delete(e.counters, k)
+			}
+		}
+		e.lastSweep = now
+	}
+	k := quotaCounterKey{identity: id, period: quotas[0].period}
+	if _, ok := e.counters[k]; !ok && len(e.counters) >= maxQuotaCounters {
+		debugf("Counting the quota of %q with the overflow counters, %d counters", id, len(e.counters))
+		id = overflowIdentity
+	}
+	counters := make([]*quotaCounter, len(quotas))
+	for i, q := range quotas {
+		k := quotaCounterKey{identity: id, period: q.period}
+		c := e.counters[k]
+		if start := now.Truncate(q.period); c == nil || c.start != start {
+			c = &quotaCounter{start: start}
+			e.counters[k] = c
+		}
+		if c.n >= q.limit {
+			return false, &quotaStatus{limit: q.limit, reset: c.start.Add(q.period)}
+		}
+		counters[i] = c
+	}
+	var status *quotaStatus
+	for i, q := range quotas {
+		c := counters[i]
+		c.n++
+		if status == nil || q.limit-c.n < status.remaining {
+			status = &quotaStatus{limit: q.limit, remaining: q.limit - c.n, reset: c.start.Add(q.period)}
+		}
+	}
+	return true, status
+}
+
+// metricIdentity returns the identity id is counted as in the quota
+// usage metric: the identities without quotas of their own are
+// counted together as *, not as a time series each.
+func (e *quotaEnforcer) metricIdentity(id string) string {
+	if _, ok := e.quotas[id]; ok {
+		return id
+	}
+	return "*"
+}
+
+// quotaHandler rejects the requests of the client identities over
+// their quotas with 429. The responses tell the clients their quota
+// in the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+// (seconds) headers.
+type quotaHandler struct {
+	quotas   *quotaEnforcer
+	identity func(*http.Request) string
+	handler  http.Handler
+}
+
+func (h *quotaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := h.identity(r)
+	now := time.Now()
+	ok, status := h.quotas.Use(id, now)
+	if status == nil {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	reset := strconv.Itoa(int(status.reset.Sub(now).Seconds() + 0.5))
+	w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(status.limit, 10))
+	w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(status.remaining, 10))
+	w.Header().Set("X-RateLimit-Reset", reset)
+	if !ok {
+		recordRejection(r.Context(), "over_quota")
+		recordQuotaUsage(r.Context(), h.quotas.metricIdentity(id), "over_quota")
+		w.Header().Set("Retry-After", reset)
+		http.Error(w, "Quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+	recordQuotaUsage(r.Context(), h.quotas.metricIdentity(id), "ok")
+	h.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,281 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketIdleTimeout is how long an unused bucket is kept around.
+	bucketIdleTimeout = 10 * time.Minute
+
+	// maxBuckets caps the buckets kept. The keys over it share the
+	// overflowBucket, e.g. during an attack from many addresses.
+	maxBuckets     = 100000
+	overflowBucket = ""
+)
+
+// tokenBucket allows rate events per second with bursts of burst events.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter keeps a token bucket per key, such as a client identity.
+type rateLimiter struct {
+	rate   float64
+	burst  int
+	quotas map[string]float64 // per key rates overriding rate
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int, quotas map[string]float64) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     burst,
+		quotas:    quotas,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether a request from key is within its rate.
+func (l *rateLimiter) Allow(key string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > bucketIdleTimeout {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= maxBuckets {
+		debugf("Rate limiting %q with the overflow bucket, %d buckets", key, len(l.buckets))
+		key = overflowBucket
+		b, ok = l.buckets[key]
+	}
+	if !ok {
+		rate, burst := l.limits(key)
+		b = &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	return b.allow(now)
+}
+
+// limits returns the rate and burst of key.
+func (l *rateLimiter) limits(key string) (rate float64, burst int) {
+	rate, ok := l.quotas[key]
+	if !ok {
+		rate = l.rate
+	}
+	return rate, l.burst
+}
+
+// parseQuotas parses identity=rate pairs.
+func parseQuotas(specs []string) (map[string]float64, error) {
+	quotas := make(map[string]float64)
+	for _, s := range specs {
+		id, v, err := splitPair(s)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("quota %q has an invalid rate: %v", s, err)
+		}
+		quotas[id] = rate
+	}
+	return quotas, nil
+}
+
+// identityFunc returns the function identifying the client of a request,
+// as specified by spec:
+//
+//	ip        the client IP
+//	verified  the identity verified by the proxy, see verifiedIdentity
+//	sub       the subject of the verified IAP JWT, see verifiedSubject
+//	apikey    the verified API key, as apikey:<name>
+//
+// Requests without the identity are identified by their IP.
+// The identities the clients control, such as the value of a header
+// or the claims of an unverified JWT, are not used since clients
+// could rotate them to bypass their limits.
+func identityFunc(spec string) (func(*http.Request) string, error) {
+	var id func(*http.Request) string
+	switch spec {
+	case "ip":
+		return clientIP, nil
+	case "verified":
+		id = verifiedIdentity
+	case "sub":
+		id = verifiedSubject
+	case "apikey":
+		id = func(r *http.Request) string {
+			if id := verifiedIdentity(r); strings.HasPrefix(id, "apikey:") {
+				return id
+			}
+			return ""
+		}
+	default:
+		return nil, fmt.Errorf("unknown identity %q, want ip, verified, sub or apikey", spec)
+	}
+	return func(r *http.Request) string {
+		if id := id(r); id != "" {
+			return id
+		}
+		return clientIP(r)
+	}, nil
+}
+
+type verifiedIdentityKey struct{}
+
+type verifiedSubjectKey struct{}
+
+// withVerifiedSubject returns r with the subject of the JWT verified
+// by an authentication stage, e.g. the sub claim of an IAP JWT.
+func withVerifiedSubject(r *http.Request, sub string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), verifiedSubjectKey{}, sub))
+}
+
+// verifiedSubject returns the subject of the verified JWT of the
+// request, or "" if none.
+func verifiedSubject(r *http.Request) string {
+	sub, _ := r.Context().Value(verifiedSubjectKey{}).(string)
+	return sub
+}
+
+// withVerifiedIdentity returns r with the identity verified by an
+// authentication stage, e.g. the email of an IAP user, apikey:<name>
+// or hmac:<key ID>.
+func withVerifiedIdentity(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), verifiedIdentityKey{}, id))
+}
+
+// verifiedIdentity returns the identity of the client verified by the
+// proxy: the one set by an authentication stage, or the subject of
+// the verified client certificate, or "" if none.
+func verifiedIdentity(r *http.Request) string {
+	if id, ok := r.Context().Value(verifiedIdentityKey{}).(string); ok {
+		return id
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	return ""
+}
+
+// clientIP returns the IP address of the client, either the peer or
+// the client resolved by forwardedHandler behind trusted proxies.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the IP address of the peer.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitHandler rejects requests with 429 once their
+// client identity exceeds its rate.
+type rateLimitHandler struct {
+	limiter  limiter
+	identity func(*http.Request) string
+	handler  http.Handler
+}
+
+func (h *rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := h.identity(r)
+	if !h.limiter.Allow(id) {
+		recordRejection(r.Context(), "rate_limited")
+		recordRateLimited(r.Context(), id)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// globalRateLimitHandler rejects requests with 429 once all the clients
+// together exceed the rate of bucket, to protect the backend during
+// traffic spikes. Each replica of the proxy has its own bucket.
+type globalRateLimitHandler struct {
+	handler http.Handler
+
+	mu     sync.Mutex
+	bucket *tokenBucket
+}
+
+func newGlobalRateLimitHandler(rate float64, burst int, handler http.Handler) *globalRateLimitHandler {
+	if burst < 1 {
+		burst = 1
+	}
+	return &globalRateLimitHandler{
+		handler: handler,
+		bucket:  &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()},
+	}
+}
+
+func (h *globalRateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	ok := h.bucket.allow(time.Now())
+	h.mu.Unlock()
+	if !ok {
+		recordRejection(r.Context(), "global_rate_limited")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// recordedBodyLimit is the largest body recorded.
+const recordedBodyLimit = 64 << 10
+
+// sensitiveHeaders carry credentials, they are never recorded. The
+// headers of the credentials configured by flags are added with
+// addSensitiveHeaders.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"X-Api-Key",
+	"X-Goog-Iap-Jwt-Assertion",
+}
+
+// addSensitiveHeaders adds headers carrying credentials to
+// sensitiveHeaders, e.g. the -api-key-header.
+func addSensitiveHeaders(names ...string) {
+	for _, name := range names {
+		if name != "" && !sensitiveHeader(name) {
+			sensitiveHeaders = append(sensitiveHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+}
+
+// sensitiveHeader reports whether the header carries credentials.
+func sensitiveHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, h := range sensitiveHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// recordedRequest is a proxied request as saved by the recorder,
+// one JSON object per line.
+type recordedRequest struct {
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"` // path and query
+	Host   string      `json:"host,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// recordHandler saves the requests it proxies, with the sensitive
+// headers removed and the rest scrubbed, so they can be replayed
+// with the replay command.
+type recordHandler struct {
+	scrub    *scrubber
+	withBody bool
+
+	mu      sync.Mutex
+	w       io.Writer
+	handler http.Handler
+}
+
+func (h *recordHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := recordedRequest{
+		Time:   time.Now().UTC(),
+		Method: r.Method,
+		URL:    h.scrub.Scrub(r.URL.RequestURI()),
+		Host:   r.Host,
+		Header: make(http.Header, len(r.Header)),
+	}
+	for k, vv := range r.Header {
+		for _, v := range vv {
+			rec.Header.Add(k, h.scrub.ScrubField(k, v))
+		}
+	}
+	for _, k := range sensitiveHeaders {
+		rec.Header.Del(k)
+	}
+	if h.withBody && r.Body != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, recordedBodyLimit))
+		if err == nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			if utf8.Valid(body) {
+				body = []byte(h.scrub.Scrub(string(body)))
+			}
+			rec.Body = body
+		}
+	}
+	h.save(&rec)
+	h.handler.ServeHTTP(w, r)
+}
+
+func (h *recordHandler) save(rec *recordedRequest) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Cannot record request: %v", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.w.Write(append(b, '\n')); err != nil {
+		log.Printf("Cannot record request: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisTimeout bounds the latency added to a request by Redis.
+	redisTimeout = 100 * time.Millisecond
+
+	// redisRetryDelay is how long the local limiter is used after
+	// Redis failed before Redis is tried again.
+	redisRetryDelay = 5 * time.Second
+
+	redisMaxIdleConns = 16
+	redisKeyPrefix    = "stackdriver-reverse-proxy/rate-limit/"
+)
+
+// redisTokenBucket is the token bucket of tokenBucket run atomically
+// by Redis. The time is given by the proxies, whose clocks are
+// expected to be in sync.
+const redisTokenBucket = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens, last = tonumber(b[1]) or burst, tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+return allowed
+`
+
+// redisTokenBucketSHA is the SHA1 digest identifying redisTokenBucket
+// in the script cache of Redis.
+var redisTokenBucketSHA = fmt.Sprintf("%x", sha1.Sum([]byte(redisTokenBucket)))
+
+// limiter reports whether a request from key is within its rate.
+type limiter interface {
+	Allow(key string) bool
+}
+
+// redisLimiter enforces the rates across the replicas of the proxy
+// with token buckets in Redis, e.g. Memorystore. It falls back to the
+// buckets of the replica while Redis is unreachable.
+type redisLimiter struct {
+	local    *rateLimiter
+	addr     string
+	password string
+	tls      *tls.Config // if not nil, Redis is reached over TLS
+	idle     chan *redisConn
+
+	mu         sync.Mutex
+	retryAfter time.Time // local only until then
+}
+
+// newRedisLimiter returns a limiter using the Redis server at rawurl,
+// host:port or redis[s]://[:password@]host:port, with the rates of local.
+// The rediss servers are verified with tlsConfig, by default with the
+// system roots.
+func newRedisLimiter(rawurl string, tlsConfig *tls.Config, local *rateLimiter) (*redisLimiter, error) {
+	l := &redisLimiter{
+		local: local,
+		addr:  rawurl,
+		idle:  make(chan *redisConn, redisMaxIdleConns),
+	}
+	if strings.Contains(rawurl, "://") {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "redis":
+		case "rediss":
+			l.tls = tlsConfig
+			if l.tls == nil {
+				l.tls = &tls.Config{}
+			}
+		default:
+			return nil, fmt.Errorf("unknown scheme %q, want redis or rediss", u.Scheme)
+		}
+		l.addr = u.Host
+		if u.User != nil {
+			l.password, _ = u.User.Password()
+		}
+	}
+	if _, _, err := net.SplitHostPort(l.addr); err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil && l.tls == nil {
+		return nil, errors.New("a CA needs a rediss:// URL")
+	}
+	return l, nil
+}
+
+// Allow reports whether a request from key is within its rate.
+func (l *redisLimiter) Allow(key string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	local := now.Before(l.retryAfter)
+	l.mu.Unlock()
+	if !local {
+		allowed, err := l.allow(key, now)
+		if err == nil {
+			recordRateLimitCheck("redis")
+			return allowed
+		}
+		l.mu.Lock()
+		l.retryAfter = now.Add(redisRetryDelay)
+		l.mu.Unlock()
+		log.Printf("WARNING: Rate limiting locally for %v, Redis failed: %v", redisRetryDelay, err)
+	}
+	recordRateLimitCheck("local")
+	return l.local.Allow(key)
+}
+
+func (l *redisLimiter) allow(key string, now time.Time) (bool, error) {
+	c, err := l.conn()
+	if err != nil {
+		return false, err
+	}
+	rate, burst := l.local.limits(key)
+	// The buckets that never refill, of rate 0, expire when idle.
+	ttl := 0
+	if rate > 0 {
+		ttl = int(math.Min(float64(burst)/rate, math.MaxInt32)) + 1
+	}
+	if ttl < int(bucketIdleTimeout.Seconds()) {
+		ttl = int(bucketIdleTimeout.Seconds())
+	}
+	args := []string{"EVALSHA", redisTokenBucketSHA, "1", redisKeyPrefix + key,
+		strconv.FormatFloat(rate, 'g', -1, 64),
+		strconv.Itoa(burst),
+		strconv.FormatFloat(float64(now.UnixNano())/1e9, 'f', 6, 64),
+		strconv.Itoa(ttl),
+	}
+	reply, err := c.do(args...)
+	if e, ok := err.(redisError); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		// The script is not cached yet, e.g. after a restart of
+		// Redis. EVAL caches it.
+		args[0], args[1] = "EVAL", redisTokenBucket
+		reply, err = c.do(args...)
+	}
+	if err != nil {
+		c.Close()
+		return false, err
+	}
+	l.release(c)
+	n, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply %v", reply)
+	}
+	return n == 1, nil
+}
+
+func (l *redisLimiter) conn() (*redisConn, error) {
+	select {
+	case c := <-l.idle:
+		return c, nil
+	default:
+	}
+	d := &net.Dialer{Timeout: redisTimeout}
+	var nc net.Conn
+	var err error
+	if l.tls != nil {
+		nc, err = tls.DialWithDialer(d, "tcp", l.addr, l.tls)
+	} else {
+		nc, err = d.Dial("tcp", l.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if l.password != "" {
+		if _, err := c.do("AUTH", l.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (l *redisLimiter) release(c *redisConn) {
+	select {
+	case l.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// redisError is an error reply of Redis, e.g. "NOSCRIPT No matching
+// script".
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisConn is a connection speaking the Redis protocol.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and returns its reply: a string, an int64 or nil,
+// or a redisError.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(redisTimeout))
+	var b []byte
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, "\r\n"...)
+	for _, a := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(a)), 10)
+		b = append(b, "\r\n"...)
+		b = append(b, a...)
+		b = append(b, "\r\n"...)
+	}
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	}
+	return nil, fmt.Errorf("unsupported reply %q", line)
+}
@@ -0,0 +1,278 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a server speaking the Redis protocol, answering the
+// commands with reply, a raw RESP reply, and recording them.
+type fakeRedis struct {
+	ln    net.Listener
+	reply func(args []string) string
+
+	mu       sync.Mutex
+	commands [][]string
+}
+
+func newFakeRedis(t *testing.T, reply func(args []string) string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln, reply: reply}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		s.mu.Unlock()
+		if _, err := io.WriteString(c, s.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+// names returns the names of the commands received.
+func (s *fakeRedis) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, c := range s.commands {
+		names = append(names, c[0])
+	}
+	return names
+}
+
+func (s *fakeRedis) Close() {
+	s.ln.Close()
+}
+
+func TestRedisConnReplies(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    interface{}
+		wantErr string
+	}{
+		{reply: "+OK\r\n", want: "OK"},
+		{reply: ":1\r\n", want: int64(1)},
+		{reply: ":-7\r\n", want: int64(-7)},
+		{reply: "$5\r\nhe\r\no\r\n", want: "he\r\no"},
+		{reply: "$0\r\n\r\n", want: ""},
+		{reply: "$-1\r\n", want: nil},
+		{reply: "-ERR unknown command\r\n", wantErr: "ERR unknown command"},
+		{reply: "*1\r\n:1\r\n", wantErr: "unsupported reply"},
+		{reply: ":x\r\n", wantErr: "invalid syntax"},
+		{reply: "\r\n", wantErr: "empty reply"},
+		{reply: "$5\r\nhe", wantErr: "timeout"},
+	}
+	for _, tt := range tests {
+		reply := tt.reply
+		s := newFakeRedis(t, func([]string) string { return reply })
+		nc, err := net.Dial("tcp", s.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+		got, err := c.do("PING")
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("reply %q: got %v, %v, want error %q", tt.reply, got, err, tt.wantErr)
+			}
+		} else if err != nil || got != tt.want {
+			t.Errorf("reply %q: got %#v, %v, want %#v", tt.reply, got, err, tt.want)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestRedisLimiterEvalsha(t *testing.T) {
+	var mu sync.Mutex
+	cached := false
+	s := newFakeRedis(t, func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "AUTH":
+			if args[1] != "secret" {
+				return "-WRONGPASS invalid password\r\n"
+			}
+			return "+OK\r\n"
+		case "EVAL":
+			if fmt.Sprintf("%x", sha1.Sum([]byte(args[1]))) != redisTokenBucketSHA {
+				return "-ERR wrong script\r\n"
+			}
+			cached = true
+			return ":1\r\n"
+		case "EVALSHA":
+			if !cached {
+				return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+			}
+			if args[3] != redisKeyPrefix+"alice" {
+				return "-ERR wrong key\r\n"
+			}
+			return ":0\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	defer s.Close()
+	l, err := newRedisLimiter("redis://:secret@"+s.ln.Addr().String(), nil, newRateLimiter(1, 1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Allow("alice") {
+		t.Error("first request rejected, the EVAL reply allowed it")
+	}
+	if l.Allow("alice") {
+		t.Error("second request allowed, the EVALSHA reply rejected it")
+	}
+	want := []string{"AUTH", "EVALSHA", "EVAL", "EVALSHA"}
+	if got := s.names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestRedisLimiterFallback(t *testing.T) {
+	s := newFakeRedis(t, func([]string) string {
+		return "-ERR out of memory\r\n"
+	})
+	defer s.Close()
+	l, err := newRedisLimiter(s.ln.Addr().String(), nil, newRateLimiter(1, 2, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The local bucket of burst 2 allows two requests.
+	for i, want := range []bool{true, true, false} {
+		if got := l.Allow("alice"); got != want {
+			t.Errorf("request %d: Allow = %v, want %v", i, got, want)
+		}
+	}
+	// Redis is not tried again before redisRetryDelay.
+	if got := s.names(); !reflect.DeepEqual(got, []string{"EVALSHA"}) {
+		t.Errorf("commands = %q, want only the first EVALSHA", got)
+	}
+
+	l.mu.Lock()
+	l.retryAfter = time.Now()
+	l.mu.Unlock()
+	l.Allow("alice")
+	if got := len(s.names()); got != 2 {
+		t.Errorf("Redis received %d commands, want 2 after the retry delay", got)
+	}
+}
+
+func TestRedisLimiterUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	l, err := newRedisLimiter(addr, nil, newRateLimiter(1, 1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Allow("alice") || l.Allow("alice") {
+		t.Error("the local limiter did not enforce the burst of 1")
+	}
+}
+
+func TestNewRedisLimiter(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		password string
+		tls      bool
+		wantErr  bool
+	}{
+		{url: "localhost:6379", addr: "localhost:6379"},
+		{url: "redis://10.0.0.1:6379", addr: "10.0.0.1:6379"},
+		{url: "redis://:p%40ss@10.0.0.1:6379", addr: "10.0.0.1:6379", password: "p@ss"},
+		{url: "rediss://10.0.0.1:6378", addr: "10.0.0.1:6378", tls: true},
+		{url: "http://10.0.0.1:6379", wantErr: true},
+		{url: "redis://10.0.0.1", wantErr: true},
+		{url: "localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		l, err := newRedisLimiter(tt.url, nil, newRateLimiter(1, 1, nil))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("newRedisLimiter(%q) succeeded, want an error", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newRedisLimiter(%q) failed: %v", tt.url, err)
+			continue
+		}
+		if l.addr != tt.addr || l.password != tt.password || (l.tls != nil) != tt.tls {
+			t.Errorf("newRedisLimiter(%q) = %v, %q, TLS %v, want %v, %q, TLS %v",
+				tt.url, l.addr, l.password, l.tls != nil, tt.addr, tt.password, tt.tls)
+		}
+	}
+	if _, err := newRedisLimiter("redis://10.0.0.1:6379", &tls.Config{}, newRateLimiter(1, 1, nil)); err == nil {
+		t.Error("newRedisLimiter with a CA and a redis:// URL succeeded, want an error")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configFiles are the files of a configuration flag, applied together.
+type configFiles struct {
+	flag  string
+	paths []string
+	apply func(data [][]byte) error
+	sum   []byte // of the applied files
+	bad   []byte // of the files that failed to apply, not retried
+}
+
+// configReloader re-reads the configuration files, e.g. pushed to
+// disk by configuration management tools, and applies the ones that
+// changed. The reloads are triggered periodically, by SIGHUP and by
+// the reload control command. Applied changes are logged, audit
+// logged and counted in config_reloads.
+type configReloader struct {
+	audit *auditLogger
+
+	mu    sync.Mutex
+	files []*configFiles
+}
+
+func newConfigReloader(audit *auditLogger) *configReloader {
+	return &configReloader{audit: audit}
+}
+
+// Watch reads the files of flag and applies them, then applies them
+// again at every reload where they changed.
+func (r *configReloader) Watch(flag string, paths []string, apply func(data [][]byte) error) error {
+	f := &configFiles{flag: flag, paths: paths, apply: apply}
+	data, sum, err := f.read()
+	if err != nil {
+		return err
+	}
+	if err := apply(data); err != nil {
+		return err
+	}
+	f.sum = sum
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files = append(r.files, f)
+	return nil
+}
+
+func (f *configFiles) read() (data [][]byte, sum []byte, err error) {
+	h := sha256.New()
+	for _, p := range f.paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = append(data, b)
+		h.Write(b)
+	}
+	return data, h.Sum(nil), nil
+}
+
+// Reload applies the files changed since they were last applied.
+// The files failing to apply are kept as they were, and not applied
+// again until they change.
+func (r *configReloader) Reload(trigger string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.files {
+		data, sum, err := f.read()
+		if err == nil && (bytes.Equal(sum, f.sum) || bytes.Equal(sum, f.bad)) {
+			continue
+		}
+		if err == nil {
+			if err = f.apply(data); err != nil {
+				f.bad = sum
+			}
+		}
+		if err != nil {
+			log.Printf("ERROR: Cannot reload %v: %v", f.flag, err)
+			recordConfigReload(f.flag, "error")
+			continue
+		}
+		f.sum = sum
+		log.Printf("Reloaded %v from %v on %v", f.flag, strings.Join(f.paths, ","), trigger)
+		r.audit.LogLocal("proxy.ReloadConfig", f.flag, map[string]interface{}{
+			"files":   f.paths,
+			"trigger": trigger,
+			"sha256":  hex.EncodeToString(sum),
+		})
+		recordConfigReload(f.flag, "ok")
+	}
+}
+
+// Run reloads the files every interval.
+func (r *configReloader) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		r.Reload("refresh")
+	}
+}
+
+// HandleSignals reloads the files on SIGHUP.
+func (r *configReloader) HandleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		r.Reload("SIGHUP")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const replayUsage = `stackdriver-reverse-proxy replay [opts...] -target=<host:port> <file>
+
+Re-sends the requests recorded with -record to the target. Files ending with
+.gz are decompressed.
+
+Options:
+  -target         URL requests are sent to, e.g. http://staging:8080.
+  -realtime       Preserve the intervals between the recorded requests.
+`
+
+func replayMain(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(replayUsage)
+	}
+	target := fs.String("target", "", "URL requests are sent to")
+	realtime := fs.Bool("realtime", false, "preserve intervals between requests")
+	fs.Parse(args)
+	if *target == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if strings.HasSuffix(fs.Arg(0), ".gz") {
+		// Recorded with -log-file-compress.
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		in = gz
+	}
+
+	var (
+		last   time.Time
+		sent   int
+		failed int
+	)
+	s := bufio.NewScanner(in)
+	s.Buffer(nil, 2*recordedBodyLimit+64<<10)
+	for s.Scan() {
+		var rec recordedRequest
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			log.Fatalf("Cannot parse recorded request: %v", err)
+		}
+		if *realtime && !last.IsZero() {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+
+		status, latency, err := replay(strings.TrimSuffix(*target, "/"), &rec)
+		sent++
+		if err != nil {
+			failed++
+			fmt.Printf("%s %s: %v\n", rec.Method, rec.URL, err)
+			continue
+		}
+		fmt.Printf("%s %s: %d in %v\n", rec.Method, rec.URL, status, latency)
+	}
+	if err := s.Err(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Replayed %d requests, %d failed\n", sent, failed)
+}
+
+func replay(target string, rec *recordedRequest) (status int, latency time.Duration, err error) {
+	req, err := http.NewRequest(rec.Method, target+rec.URL, bytes.NewReader(rec.Body))
+	if err != nil {
+		return 0, 0, err
+	}
+	for k, vv := range rec.Header {
+		req.Header[k] = vv
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
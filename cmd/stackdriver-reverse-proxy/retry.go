@@ -0,0 +1,126 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// retryMaxBackoff caps the backoff between the attempts of a backend
+// request.
+const retryMaxBackoff = 5 * time.Second
+
+// idempotentMethods are the methods of the requests safe to retry.
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+// retryableStatus are the statuses of the responses worth retrying.
+var retryableStatus = map[int]bool{
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// retryTransport retries the idempotent requests without body failing
+// with a transport error, e.g. connection refused, or a 502, 503 or
+// 504 response, up to retries times with exponential backoff. The 503
+// responses with Retry-After, e.g. from an open circuit breaker, are
+// not retried. Each retry is traced as a child span of the request,
+// parent of the span of its backend request, so the latency they add
+// shows up in the traces.
+type retryTransport struct {
+	retries int
+	backoff time.Duration
+	base    http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotentMethods[req.Method] || (req.Body != nil && req.Body != http.NoBody) {
+		return t.base.RoundTrip(req)
+	}
+	resp, err := t.base.RoundTrip(req)
+	backoff := t.backoff
+	for attempt := 1; attempt <= t.retries && t.retryable(req.Context(), resp, err); attempt++ {
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		recordRetry(req.Context(), req.URL.Host)
+		resp, err = t.retry(req, attempt, backoff, err, resp)
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+	return resp, err
+}
+
+// retry sends req again after backoff, in the span of the attempt,
+// annotated with the failure of the previous one.
+func (t *retryTransport) retry(req *http.Request, attempt int, backoff time.Duration, err error, resp *http.Response) (*http.Response, error) {
+	ctx, span := trace.StartSpan(req.Context(), fmt.Sprintf("Retry.%s", req.URL.Path))
+	defer span.End()
+	span.SetAttributes(trace.Int64Attribute("retry.attempt", int64(attempt)))
+	if err != nil {
+		span.Annotatef(nil, "Previous attempt failed: %v", err)
+	} else {
+		span.Annotatef(nil, "Previous attempt responded %d", resp.StatusCode)
+	}
+	select {
+	case <-ctx.Done():
+		span.SetStatus(trace.Status{Code: int32(codes.Canceled), Message: ctx.Err().Error()})
+		return nil, ctx.Err()
+	case <-time.After(backoff):
+	}
+	resp, err = t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		span.SetStatus(trace.Status{Code: int32(codes.Unavailable), Message: err.Error()})
+	}
+	return resp, err
+}
+
+func (t *retryTransport) retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "" {
+		return false
+	}
+	return retryableStatus[resp.StatusCode]
+}
+
+// recordRetry counts a retry of a request to the backend host.
+func recordRetry(ctx context.Context, host string) {
+	ctx, err := tag.New(ctx, tag.Upsert(hostKey, tagValue(host)))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, backendRetries.M(1))
+}
@@ -0,0 +1,40 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+)
+
+// Routes are URL path prefixes, such as /api/, that per-route
+// settings apply to. A trailing '*' in a prefix is ignored, so
+// /api/* and /api/ are the same route.
+
+// routePrefix normalizes a route as written in flags.
+func routePrefix(route string) string {
+	return strings.TrimSuffix(route, "*")
+}
+
+// matchRoute returns the index of the longest of prefixes
+// matching path, or -1 if none does.
+func matchRoute(prefixes []string, path string) int {
+	match := -1
+	for i, p := range prefixes {
+		if strings.HasPrefix(path, p) && (match < 0 || len(p) > len(prefixes[match])) {
+			match = i
+		}
+	}
+	return match
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+// monitoringSwitch drops the view data instead of exporting it while
+// monitoring is off, e.g. to stop the metric writes of a proxy
+// flooding Stackdriver Monitoring without restarting it. The spans
+// are always exported, their volume is set by the sampling.
+type monitoringSwitch struct {
+	off int32 // atomic
+	e   telemetryExporter
+}
+
+func (m *monitoringSwitch) ExportSpan(sd *trace.SpanData) {
+	m.e.ExportSpan(sd)
+}
+
+func (m *monitoringSwitch) ExportView(vd *view.Data) {
+	if atomic.LoadInt32(&m.off) == 0 {
+		m.e.ExportView(vd)
+	}
+}
+
+// Enabled reports whether the view data is exported.
+func (m *monitoringSwitch) Enabled() bool {
+	return atomic.LoadInt32(&m.off) == 0
+}
+
+// SetEnabled turns the export of the view data on or off.
+func (m *monitoringSwitch) SetEnabled(enabled bool) {
+	var off int32
+	if !enabled {
+		off = 1
+	}
+	atomic.StoreInt32(&m.off, off)
+}
+
+// monitoringAdmin serves the monitoring admin endpoint. GET returns
+// whether the metrics are exported, POST with enabled=<bool> turns
+// their export on or off.
+type monitoringAdmin struct {
+	m *monitoringSwitch
+}
+
+func (a monitoringAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "invalid enabled: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.m.SetEnabled(enabled)
+		if enabled {
+			log.Print("Enabled the export of the metrics")
+		} else {
+			log.Print("WARNING: Disabled the export of the metrics")
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": a.m.Enabled()})
+}
+
+// configHandler serves the configuration the proxy was started with:
+// the value of every flag, set on the command line, in the -config
+// file, or by default. The flags only name the secrets, e.g.
+// -admin-token, but the passwords of the URLs, e.g. of
+// -rate-limit-redis, are redacted.
+type configHandler struct {
+	fs *flag.FlagSet
+}
+
+func (h configHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := make(map[string]string)
+	h.fs.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = redactPasswords(f.Value.String())
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// redactPasswords replaces the passwords of the URLs in the
+// comma-separated list v.
+func redactPasswords(v string) string {
+	items := strings.Split(v, ",")
+	for i, item := range items {
+		u, err := url.Parse(strings.TrimSpace(item))
+		if err != nil || u.User == nil {
+			continue
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			items[i] = u.String()
+		}
+	}
+	return strings.Join(items, ",")
+}
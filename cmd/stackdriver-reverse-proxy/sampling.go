@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/stackdriver-reverse-proxy/sproxy"
+	"go.opencensus.io/trace"
+)
+
+// routeSampler samples the traces with a fraction per route, matched
+// against the path in the server span names, or a default fraction,
+// with a sproxy.PathSampler of sproxy.ProbabilitySampler samplers. The
+// fractions can be changed at runtime through the admin API.
+type routeSampler struct {
+	mu        sync.RWMutex
+	fraction  float64
+	routes    []string
+	fractions []float64
+	sampler   trace.Sampler // of the fractions
+}
+
+func newRouteSampler(fraction float64) *routeSampler {
+	s := &routeSampler{fraction: fraction}
+	s.update()
+	return s
+}
+
+// Sample implements trace.Sampler.
+func (s *routeSampler) Sample(p trace.SamplingParameters) trace.SamplingDecision {
+	s.mu.RLock()
+	sampler := s.sampler
+	s.mu.RUnlock()
+	return sampler(p)
+}
+
+// update builds the sampler of the fractions. s.mu must be held.
+func (s *routeSampler) update() {
+	routes := make(map[string]trace.Sampler, len(s.routes))
+	for i, r := range s.routes {
+		routes[r] = sproxy.ProbabilitySampler(s.fractions[i])
+	}
+	s.sampler = sproxy.PathSampler(routes, sproxy.ProbabilitySampler(s.fraction))
+}
+
+// parseRouteSampling parses route=fraction items, e.g. /api/*=0.1,
+// into a sampler of the default fraction.
+func parseRouteSampling(fraction float64, items []string) (*routeSampler, error) {
+	s := newRouteSampler(fraction)
+	for _, item := range items {
+		route, v, err := splitPair(item)
+		if err != nil {
+			return nil, err
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return nil, fmt.Errorf("invalid fraction for %v: %q is not between 0 and 1", route, v)
+		}
+		s.SetRoute(route, f)
+	}
+	return s, nil
+}
+
+// SetFraction sets the default fraction.
+func (s *routeSampler) SetFraction(fraction float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fraction = fraction
+	s.update()
+}
+
+// SetRoute sets the fraction of route.
+func (s *routeSampler) SetRoute(route string, fraction float64) {
+	prefix := routePrefix(route)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.routes {
+		if r == prefix {
+			s.fractions[i] = fraction
+			s.update()
+			return
+		}
+	}
+	s.routes = append(s.routes, prefix)
+	s.fractions = append(s.fractions, fraction)
+	s.update()
+}
+
+// SetRoutes replaces the fractions of the routes with those of from,
+// e.g. parsed from a reloaded -route-sampling.
+func (s *routeSampler) SetRoutes(from *routeSampler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes, s.fractions = from.routes, from.fractions
+	s.update()
+}
+
+// DeleteRoute makes route sampled with the default fraction.
+func (s *routeSampler) DeleteRoute(route string) {
+	prefix := routePrefix(route)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.routes {
+		if r == prefix {
+			s.routes = append(s.routes[:i:i], s.routes[i+1:]...)
+			s.fractions = append(s.fractions[:i:i], s.fractions[i+1:]...)
+			s.update()
+			return
+		}
+	}
+}
+
+// ServeHTTP serves the sampling admin endpoint. GET returns the
+// fractions, POST sets the default fraction, or the fraction of the
+// route query parameter, to the fraction query parameter, and DELETE
+// removes the fraction of the route.
+func (s *routeSampler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := r.URL.Query().Get("route")
+	switch r.Method {
+	case "GET":
+	case "POST":
+		fraction, err := strconv.ParseFloat(r.URL.Query().Get("fraction"), 64)
+		if err != nil || fraction < 0 || fraction > 1 {
+			http.Error(w, "fraction must be between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		if route == "" {
+			s.SetFraction(fraction)
+			log.Printf("Set the trace sampling fraction to %v", fraction)
+		} else {
+			s.SetRoute(route, fraction)
+			log.Printf("Set the trace sampling fraction of %v to %v", route, fraction)
+		}
+	case "DELETE":
+		if route == "" {
+			http.Error(w, "missing route", http.StatusBadRequest)
+			return
+		}
+		s.DeleteRoute(route)
+		log.Printf("Removed the trace sampling fraction of %v", route)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	out := struct {
+		Fraction float64            `json:"fraction"`
+		Routes   map[string]float64 `json:"routes"`
+	}{s.fraction, make(map[string]float64, len(s.routes))}
+	for i, r := range s.routes {
+		out.Routes[r+"*"] = s.fractions[i]
+	}
+	s.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+const redacted = "[REDACTED]"
+
+// defaultScrubPatterns match emails and credentials. The credential
+// parameters are matched as whole words or suffixes after _ or -,
+// e.g. client_secret= but not monkey=.
+var defaultScrubPatterns = []string{
+	`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`,
+	`(?i)bearer\s+[a-z0-9._~+/=-]+`,
+	`eyJ[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]*`,
+	`(?i)\b(?:[a-z0-9]+[_-])*(?:access_token|id_token|api_key|apikey|key|token|password|secret)=[^&\s]+`,
+}
+
+// cardPattern matches the card numbers of the major networks, of 13
+// to 19 digits optionally grouped with spaces or dashes. They are only
+// redacted if their Luhn checksum is valid, not to redact e.g. the
+// timestamps in milliseconds.
+var cardPattern = regexp.MustCompile(`\b[2-6](?:[ -]?\d){12,18}\b`)
+
+// scrubber removes personal data and secrets from telemetry
+// before it leaves the proxy.
+type scrubber struct {
+	patterns []*regexp.Regexp
+	fields   map[string]bool // fields whose value is always redacted
+}
+
+func newScrubber(patterns, fields []string) (*scrubber, error) {
+	s := &scrubber{fields: make(map[string]bool)}
+	for _, p := range append(defaultScrubPatterns, patterns...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	for _, f := range fields {
+		s.fields[f] = true
+	}
+	return s, nil
+}
+
+// Scrub redacts all the sensitive substrings of v.
+func (s *scrubber) Scrub(v string) string {
+	for _, re := range s.patterns {
+		v = re.ReplaceAllString(v, redacted)
+	}
+	return cardPattern.ReplaceAllStringFunc(v, func(n string) string {
+		if luhnValid(n) {
+			return redacted
+		}
+		return n
+	})
+}
+
+// luhnValid reports whether the digits of n have a valid Luhn
+// checksum, ignoring the other characters.
+func luhnValid(n string) bool {
+	sum, double := 0, false
+	for i := len(n) - 1; i >= 0; i-- {
+		c := n[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// ScrubField redacts the value of the named field.
+func (s *scrubber) ScrubField(name, v string) string {
+	if s.fields[name] {
+		return redacted
+	}
+	return s.Scrub(v)
+}
+
+// ScrubFields returns a copy of m with string values scrubbed.
+func (s *scrubber) ScrubFields(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if str, ok := v.(string); ok {
+			v = s.ScrubField(k, str)
+		} else if s.fields[k] {
+			v = redacted
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// telemetryExporter exports both spans and view data,
+// like the Stackdriver exporter does.
+type telemetryExporter interface {
+	trace.Exporter
+	view.Exporter
+}
+
+// scrubExporter scrubs spans and view data before handing
+// them to the underlying exporter.
+type scrubExporter struct {
+	s *scrubber
+	e telemetryExporter
+}
+
+func (e *scrubExporter) ExportSpan(sd *trace.SpanData) {
+	// SpanData is shared between the registered exporters,
+	// modify a copy.
+	c := *sd
+	c.Name = e.s.Scrub(sd.Name)
+	c.Attributes = e.s.ScrubFields(sd.Attributes)
+	c.Annotations = make([]trace.Annotation, len(sd.Annotations))
+	for i, a := range sd.Annotations {
+		c.Annotations[i] = trace.Annotation{
+			Time:       a.Time,
+			Message:    e.s.Scrub(a.Message),
+			Attributes: e.s.ScrubFields(a.Attributes),
+		}
+	}
+	c.Status.Message = e.s.Scrub(sd.Status.Message)
+	e.e.ExportSpan(&c)
+}
+
+// ExportView scrubs the tag values of the rows. The rows whose tags
+// collide once scrubbed are merged, since the exporters expect one
+// row per tag values.
+func (e *scrubExporter) ExportView(vd *view.Data) {
+	c := *vd
+	c.Rows = make([]*view.Row, 0, len(vd.Rows))
+	rows := make(map[string]*view.Row, len(vd.Rows))
+	for _, r := range vd.Rows {
+		tags := make([]tag.Tag, len(r.Tags))
+		for j, t := range r.Tags {
+			tags[j] = tag.Tag{Key: t.Key, Value: e.s.ScrubField(t.Key.Name(), t.Value)}
+		}
+		key := fmt.Sprint(tags)
+		if row, ok := rows[key]; ok {
+			row.Data = addData(row.Data, r.Data)
+			continue
+		}
+		row := &view.Row{Tags: tags, Data: r.Data}
+		rows[key] = row
+		c.Rows = append(c.Rows, row)
+	}
+	e.e.ExportView(&c)
+}
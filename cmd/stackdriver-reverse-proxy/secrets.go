@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	secretManagerURL = "https://secretmanager.googleapis.com/v1/"
+
+	// secretTimeout bounds the time loadSecret waits for Secret
+	// Manager, the proxy doesn't start until then.
+	secretTimeout = 30 * time.Second
+)
+
+// loadSecret reads a secret either from a Secret Manager secret version,
+// if name is of the form projects/<p>/secrets/<s>/versions/<v>, reached
+// with base, or from the file at name.
+func loadSecret(ctx context.Context, name string, base http.RoundTripper) ([]byte, error) {
+	if !strings.HasPrefix(name, "projects/") {
+		return ioutil.ReadFile(name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, secretTimeout)
+	defer cancel()
+	ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: &oauth2.Transport{Source: ts, Base: base}}
+	return accessSecret(ctx, client, name)
+}
+
+// errSecretNotFound is returned by accessSecret for the missing secrets.
+var errSecretNotFound = errors.New("secret not found")
+
+// accessSecret reads the Secret Manager secret version name with client.
+func accessSecret(ctx context.Context, client *http.Client, name string) ([]byte, error) {
+	req, err := http.NewRequest("GET", secretManagerURL+name+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errSecretNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot access secret %v: %v", name, resp.Status)
+	}
+	var out struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Payload.Data)
+}
+
+// parseKeys parses the name=key lines of a secret holding several
+// keys. Blank lines and lines starting with # are skipped.
+func parseKeys(data []byte) (map[string]string, error) {
+	keys := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		j := strings.Index(line, "=")
+		if j <= 0 || j == len(line)-1 {
+			return nil, fmt.Errorf("line %d is not in name=key form", i+1)
+		}
+		name := strings.TrimSpace(line[:j])
+		if _, ok := keys[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate name %q", i+1, name)
+		}
+		keys[name] = strings.TrimSpace(line[j+1:])
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no key")
+	}
+	return keys, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSecretFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(name, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Files are read without the transport.
+	got, err := loadSecret(context.Background(), name, nil)
+	if err != nil || string(got) != "s3cret\n" {
+		t.Errorf("loadSecret(%q) = %q, %v, want %q", name, got, err, "s3cret\n")
+	}
+	if _, err := loadSecret(context.Background(), filepath.Join(dir, "missing"), nil); err == nil {
+		t.Error("loadSecret of a missing file succeeded")
+	}
+}
+
+func TestAccessSecret(t *testing.T) {
+	const name = "projects/p/secrets/s/versions/latest"
+	tests := []struct {
+		status  int
+		body    string
+		want    string
+		wantErr error
+	}{
+		{status: 200, body: `{"payload": {"data": "czNjcmV0"}}`, want: "s3cret"},
+		{status: 404, wantErr: errSecretNotFound},
+		{status: 403},
+		{status: 200, body: `{"payload": {"data": "!"}}`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if want := secretManagerURL + name + ":access"; req.URL.String() != want {
+				t.Errorf("request to %v, want %v", req.URL, want)
+			}
+			w := httptest.NewRecorder()
+			w.WriteHeader(tt.status)
+			w.WriteString(tt.body)
+			return w.Result(), nil
+		})}
+		got, err := accessSecret(context.Background(), client, name)
+		switch {
+		case tt.want != "":
+			if err != nil || string(got) != tt.want {
+				t.Errorf("status %d: got %q, %v, want %q", tt.status, got, err, tt.want)
+			}
+		case tt.wantErr != nil:
+			if err != tt.wantErr {
+				t.Errorf("status %d: got %q, %v, want %v", tt.status, got, err, tt.wantErr)
+			}
+		case err == nil:
+			t.Errorf("status %d %s: got %q, want an error", tt.status, tt.body, got)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	got, err := parseKeys([]byte("# keys\nalice = k1==\n\n  bob=k2\n"))
+	want := map[string]string{"alice": "k1==", "bob": "k2"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("parseKeys = %q, %v, want %q", got, err, want)
+	}
+	for _, in := range []string{"", "# none\n", "alice", "=k1", "alice=", "alice=k1\nalice=k2"} {
+		if got, err := parseKeys([]byte(in)); err == nil {
+			t.Errorf("parseKeys(%q) = %q, want an error", in, got)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+)
+
+// Smoothing factors of the adaptive limiter.
+const (
+	shortRTTFactor = 0.1  // weight of a sample in the short-term RTT
+	longRTTFactor  = 0.01 // weight of a sample in the long-term RTT
+	limitFactor    = 0.2  // weight of a new limit
+)
+
+// adaptiveLimiter limits the number of concurrent requests sent to the
+// backend, adjusting the limit with the gradient between the long-term
+// and short-term backend latencies: the limit shrinks as latency
+// degrades and grows back as it recovers.
+type adaptiveLimiter struct {
+	minLimit, maxLimit float64
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	shortRTT float64 // in seconds
+	longRTT  float64 // in seconds
+}
+
+func newAdaptiveLimiter(initial, max int) *adaptiveLimiter {
+	return &adaptiveLimiter{
+		minLimit: 1,
+		maxLimit: float64(max),
+		limit:    float64(initial),
+	}
+}
+
+// Acquire reserves a slot for a request. It reports false if the
+// limit is reached and the request must be shed.
+func (l *adaptiveLimiter) Acquire() (limit float64, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if float64(l.inflight) >= l.limit {
+		return l.limit, false
+	}
+	l.inflight++
+	return l.limit, true
+}
+
+// Release frees the slot of a request whose backend round trips took
+// rtt, 0 if it did not reach the backend, e.g. served from the cache.
+func (l *adaptiveLimiter) Release(rtt time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inflight := l.inflight
+	l.inflight--
+	if rtt <= 0 {
+		return
+	}
+
+	sample := rtt.Seconds()
+	if l.longRTT == 0 {
+		l.shortRTT, l.longRTT = sample, sample
+		return
+	}
+	l.shortRTT = (1-shortRTTFactor)*l.shortRTT + shortRTTFactor*sample
+	l.longRTT = (1-longRTTFactor)*l.longRTT + longRTTFactor*sample
+	// Quickly forget a baseline degraded by a long overload.
+	if l.longRTT/l.shortRTT > 2 {
+		l.longRTT *= 0.95
+	}
+	// Don't grow the limit while it is not used.
+	if float64(inflight) < l.limit/2 {
+		return
+	}
+	gradient := math.Max(0.5, math.Min(1, l.longRTT/l.shortRTT))
+	newLimit := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = (1-limitFactor)*l.limit + limitFactor*newLimit
+	l.limit = math.Max(l.minLimit, math.Min(l.maxLimit, l.limit))
+}
+
+// shedHandler rejects requests with 503 when the backend is overloaded,
+// adapting the limit to the latencies measured by rttTransport.
+// The WebSocket and gRPC streams are passed through: they would hold a
+// slot for their whole session, and their durations are not latencies.
+type shedHandler struct {
+	limiter *adaptiveLimiter
+	handler http.Handler
+}
+
+func (h *shedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isGRPC(r) || isWebSocket(r) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	limit, ok := h.limiter.Acquire()
+	stats.Record(r.Context(), concurrencyLimit.M(limit))
+	if !ok {
+		recordRejection(r.Context(), "load_shed")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	var rtt time.Duration
+	defer func() {
+		h.limiter.Release(rtt)
+	}()
+	h.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), backendRTTKey{}, &rtt)))
+}
+
+// backendRTTKey is the context key of the *time.Duration adding up the
+// backend round trips of a request.
+type backendRTTKey struct{}
+
+// rttTransport measures the backend round trips for shedHandler, up to
+// the response headers, excluding the time spent in the handlers and
+// streaming the body.
+type rttTransport struct {
+	base http.RoundTripper
+}
+
+func (t *rttTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if rtt, ok := req.Context().Value(backendRTTKey{}).(*time.Duration); ok {
+		*rtt += time.Since(start)
+	}
+	return resp, err
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestShedHandlerMeasuresBackend(t *testing.T) {
+	const backendRTT = 20 * time.Millisecond
+	transport := &rttTransport{base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		time.Sleep(backendRTT)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})}
+	l := newAdaptiveLimiter(10, 100)
+	h := &shedHandler{
+		limiter: l,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The time spent outside of the round trip, e.g. in
+			// the handlers or sending the body, is not sampled.
+			time.Sleep(10 * backendRTT)
+			if r.URL.Path == "/cached" {
+				return
+			}
+			req, _ := http.NewRequest("GET", "http://backend/", nil)
+			resp, err := transport.RoundTrip(req.WithContext(r.Context()))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}),
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/cached", nil))
+	if l.longRTT != 0 || l.inflight != 0 {
+		t.Errorf("after a cache hit: RTT %v, %d in flight, want no sample and none in flight", l.longRTT, l.inflight)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if rtt := time.Duration(l.shortRTT * float64(time.Second)); rtt < backendRTT || rtt > 5*backendRTT {
+		t.Errorf("RTT sample = %v, want about the backend round trip of %v", rtt, backendRTT)
+	}
+	if l.inflight != 0 {
+		t.Errorf("%d in flight, want none", l.inflight)
+	}
+}
+
+func TestShedHandlerSheds(t *testing.T) {
+	l := newAdaptiveLimiter(1, 1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := &shedHandler{
+		limiter: l,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	<-started
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("over the limit: got %d, Retry-After %q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(release)
+	<-done
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(10, 1000)
+	// round sends requests up to the limit concurrently, each taking
+	// rtt.
+	round := func(rtt time.Duration) {
+		n := 0
+		for {
+			if _, ok := l.Acquire(); !ok {
+				break
+			}
+			n++
+		}
+		for i := 0; i < n; i++ {
+			l.Release(rtt)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		round(10 * time.Millisecond)
+	}
+	steady := l.limit
+	if steady <= 10 {
+		t.Errorf("limit = %v at a steady latency, want grown from 10", steady)
+	}
+	round(100 * time.Millisecond)
+	if l.limit >= steady {
+		t.Errorf("limit = %v once the latency degraded, want below %v", l.limit, steady)
+	}
+	degraded := l.limit
+	round(10 * time.Millisecond)
+	if l.limit <= degraded {
+		t.Errorf("limit = %v once the latency recovered, want above %v", l.limit, degraded)
+	}
+
+	// Releases without a backend round trip leave the latencies as is.
+	short, long := l.shortRTT, l.longRTT
+	l.Acquire()
+	l.Release(0)
+	if l.shortRTT != short || l.longRTT != long {
+		t.Errorf("RTTs changed by a release without round trip")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// The SPIFFE Workload API messages used by the proxy, see
+// https://github.com/spiffe/spiffe/blob/master/standards/SPIFFE_Workload_API.md.
+
+type x509SVIDRequest struct{}
+
+func (m *x509SVIDRequest) Reset()         { *m = x509SVIDRequest{} }
+func (m *x509SVIDRequest) String() string { return proto.CompactTextString(m) }
+func (*x509SVIDRequest) ProtoMessage()    {}
+
+type x509SVIDResponse struct {
+	Svids            []*x509SVID       `protobuf:"bytes,1,rep,name=svids"`
+	Crl              [][]byte          `protobuf:"bytes,2,rep,name=crl,proto3"`
+	FederatedBundles map[string][]byte `protobuf:"bytes,3,rep,name=federated_bundles,json=federatedBundles" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *x509SVIDResponse) Reset()         { *m = x509SVIDResponse{} }
+func (m *x509SVIDResponse) String() string { return proto.CompactTextString(m) }
+func (*x509SVIDResponse) ProtoMessage()    {}
+
+type x509SVID struct {
+	SpiffeID    string `protobuf:"bytes,1,opt,name=spiffe_id,json=spiffeId,proto3"`
+	X509Svid    []byte `protobuf:"bytes,2,opt,name=x509_svid,json=x509Svid,proto3"`
+	X509SvidKey []byte `protobuf:"bytes,3,opt,name=x509_svid_key,json=x509SvidKey,proto3"`
+	Bundle      []byte `protobuf:"bytes,4,opt,name=bundle,proto3"`
+}
+
+func (m *x509SVID) Reset()         { *m = x509SVID{} }
+func (m *x509SVID) String() string { return proto.CompactTextString(m) }
+func (*x509SVID) ProtoMessage()    {}
+
+// svidSource keeps the proxy's X.509 SVID and trust bundle up to date
+// by streaming them from the SPIFFE Workload API, as exposed by
+// the SPIRE agent.
+type svidSource struct {
+	socket string
+
+	mu    sync.RWMutex
+	id    string
+	cert  *tls.Certificate
+	roots *x509.CertPool
+	ready chan struct{}
+}
+
+func newSVIDSource(socket string) *svidSource {
+	s := &svidSource{
+		socket: strings.TrimPrefix(socket, "unix://"),
+		ready:  make(chan struct{}),
+	}
+	go s.watch()
+	return s
+}
+
+// WaitReady blocks until the first SVID is received or timeout expires.
+func (s *svidSource) WaitReady(timeout time.Duration) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("no SVID received from %v in %v", s.socket, timeout)
+	}
+}
+
+func (s *svidSource) watch() {
+	backoff := time.Second
+	for {
+		err := s.fetch()
+		log.Printf("SPIFFE Workload API stream ended, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (s *svidSource) fetch() error {
+	conn, err := grpc.Dial(s.socket, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("workload.spiffe.io", "true"))
+	stream, err := grpc.NewClientStream(ctx, &grpc.StreamDesc{ServerStreams: true}, conn, "/SpiffeWorkloadAPI/FetchX509SVID")
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&x509SVIDRequest{}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		resp := &x509SVIDResponse{}
+		if err := stream.RecvMsg(resp); err != nil {
+			return err
+		}
+		if err := s.update(resp); err != nil {
+			log.Printf("Ignoring invalid SVID update: %v", err)
+		}
+	}
+}
+
+// update installs the first SVID of resp, the default identity.
+func (s *svidSource) update(resp *x509SVIDResponse) error {
+	if len(resp.Svids) == 0 {
+		return errors.New("no SVID")
+	}
+	svid := resp.Svids[0]
+	chain, err := x509.ParseCertificates(svid.X509Svid)
+	if err != nil {
+		return err
+	}
+	if len(chain) == 0 {
+		return errors.New("empty certificate chain")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(svid.X509SvidKey)
+	if err != nil {
+		return err
+	}
+	bundle, err := x509.ParseCertificates(svid.Bundle)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	for _, c := range bundle {
+		roots.AddCert(c)
+	}
+	cert := &tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	s.mu.Lock()
+	first := s.cert == nil
+	s.id, s.cert, s.roots = svid.SpiffeID, cert, roots
+	s.mu.Unlock()
+	if first {
+		log.Printf("Received SVID %v", svid.SpiffeID)
+		close(s.ready)
+	}
+	return nil
+}
+
+// GetClientCertificate presents the current SVID to the backend.
+func (s *svidSource) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, errors.New("no SVID available yet")
+	}
+	return s.cert, nil
+}
+
+// VerifyPeer returns a tls.Config.VerifyPeerCertificate function that
+// accepts backend SVIDs signed by the trust bundle whose SPIFFE ID
+// matches allowed, see spiffeIDMatches.
+func (s *svidSource) VerifyPeer(allowed string) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("spiffe: no backend certificate")
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i, b := range raw {
+			c, err := x509.ParseCertificate(b)
+			if err != nil {
+				return err
+			}
+			certs[i] = c
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		s.mu.RLock()
+		roots := s.roots
+		s.mu.RUnlock()
+		if _, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return fmt.Errorf("spiffe: %v", err)
+		}
+		for _, u := range certs[0].URIs {
+			if u.Scheme == "spiffe" && spiffeIDMatches(u.String(), allowed) {
+				return nil
+			}
+		}
+		return fmt.Errorf("spiffe: backend SPIFFE ID is not %v", allowed)
+	}
+}
+
+// spiffeIDMatches reports whether id is allowed, either a full ID, or
+// a prefix ending with / such as the trust domain spiffe://example.org/.
+// An empty allowed accepts any SPIFFE ID.
+func spiffeIDMatches(id, allowed string) bool {
+	if allowed == "" || id == allowed {
+		return true
+	}
+	return strings.HasSuffix(allowed, "/") && strings.HasPrefix(id, allowed)
+}
@@ -0,0 +1,183 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// statuszRow is a counter shown on the statusz page.
+type statuszRow struct {
+	name  string
+	value interface{}
+}
+
+type statuszSection struct {
+	title string
+	rows  func() []statuszRow
+}
+
+// statusz serves a human-readable page of the live counters of the
+// proxy, in sections added by the features that are enabled.
+type statusz struct {
+	start time.Time
+
+	mu       sync.Mutex
+	sections []statuszSection
+}
+
+func newStatusz() *statusz {
+	return &statusz{start: time.Now()}
+}
+
+// Add adds a section whose rows are read at every request.
+func (s *statusz) Add(title string, rows func() []statuszRow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sections = append(s.sections, statuszSection{title: title, rows: rows})
+}
+
+func (s *statusz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	sections := append([]statuszSection(nil), s.sections...)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	host, _ := os.Hostname()
+	fmt.Fprintf(w, "stackdriver-reverse-proxy on %v\n", host)
+	fmt.Fprintf(w, "Started %v, up %v\n", s.start.Format(time.RFC3339), time.Since(s.start).Truncate(time.Second))
+	for _, sec := range sections {
+		fmt.Fprintf(w, "\n%v\n", sec.title)
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, row := range sec.rows() {
+			fmt.Fprintf(tw, "  %v\t%v\n", row.name, row.value)
+		}
+		tw.Flush()
+	}
+}
+
+// viewCounts returns the counts of the named view by the values of
+// key, summing the rows with other tags. Values are mapped by group,
+// e.g. to status classes, unless nil.
+func viewCounts(name string, key tag.Key, group func(string) string) map[string]int64 {
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		return nil
+	}
+	counts := make(map[string]int64)
+	for _, row := range rows {
+		var v string
+		for _, t := range row.Tags {
+			if t.Key == key {
+				v = t.Value
+			}
+		}
+		if group != nil {
+			v = group(v)
+		}
+		switch d := row.Data.(type) {
+		case *view.CountData:
+			counts[v] += int64(*d)
+		case *view.SumData:
+			counts[v] += int64(*d)
+		case *view.DistributionData:
+			counts[v] += d.Count
+		}
+	}
+	return counts
+}
+
+// viewTotal returns the total count of the named view.
+func viewTotal(name string) int64 {
+	var total int64
+	for _, n := range viewCounts(name, tag.Key{}, nil) {
+		total += n
+	}
+	return total
+}
+
+// countRows returns the counts as rows named prefix+value, sorted.
+func countRows(prefix string, counts map[string]int64) []statuszRow {
+	var rows []statuszRow
+	for v, n := range counts {
+		if v == "" {
+			v = "unknown"
+		}
+		rows = append(rows, statuszRow{name: prefix + v, value: n})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].name < rows[j].name })
+	return rows
+}
+
+// statusClass returns the class of an HTTP status code, e.g. 5xx.
+func statusClass(code string) string {
+	if len(code) != 3 {
+		return code
+	}
+	return code[:1] + "xx"
+}
+
+// requestRows returns the statusz rows of the requests, the in-flight
+// ones of d and the totals by status class.
+func requestRows(d *drainer) func() []statuszRow {
+	return func() []statuszRow {
+		rows := []statuszRow{{name: "In flight", value: d.Inflight()}}
+		counts := viewCounts(ochttp.ServerResponseCountByStatusCode.Name, ochttp.StatusCode, statusClass)
+		return append(rows, countRows("Responses ", counts)...)
+	}
+}
+
+// connectionRows returns the statusz rows of the connections accepted
+// and dialed, and of the WebSocket sessions open.
+func connectionRows() []statuszRow {
+	counts := viewCounts("stackdriver-reverse-proxy/connections", sideKey, nil)
+	rows := []statuszRow{
+		{name: "Accepted", value: counts["listener"]},
+		{name: "Dialed to the backend", value: counts["backend"]},
+	}
+	open := viewTotal("stackdriver-reverse-proxy/websocket_sessions")
+	return append(rows, statuszRow{name: "WebSocket sessions open", value: open})
+}
+
+// exporterRows returns the statusz rows of the telemetry and log
+// exports: the RPCs in flight, the items dropped and the failures by
+// method, and the log entries buffered for Cloud Logging, if enabled.
+func exporterRows(cl *cloudLogger) func() []statuszRow {
+	return func() []statuszRow {
+		var rows []statuszRow
+		if cl != nil {
+			rows = append(rows, statuszRow{name: "Cloud Logging entries queued", value: cl.Queued()})
+		}
+		rows = append(rows, statuszRow{name: "Export RPCs in flight", value: viewTotal("stackdriver-reverse-proxy/export_rpcs_in_flight")})
+		rows = append(rows, countRows("Dropped from ", viewCounts("stackdriver-reverse-proxy/export_dropped", queueKey, nil))...)
+		counts := viewCounts("stackdriver-reverse-proxy/export_failures", methodKey, nil)
+		var failures int64
+		for _, n := range counts {
+			failures += n
+		}
+		rows = append(rows, statuszRow{name: "Export failures", value: failures})
+		return append(rows, countRows("Export failures of ", counts)...)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// tapBufferSize is the number of events buffered per subscriber,
+// events are dropped for slower subscribers.
+const tapBufferSize = 256
+
+// tapEvent is a proxied request as seen on the tap.
+type tapEvent struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMs float64   `json:"latencyMs"`
+	TraceID   string    `json:"traceId,omitempty"`
+}
+
+type tapSubscriber struct {
+	events   chan *tapEvent
+	sampling float64
+}
+
+// tap streams the proxied requests to the admin API subscribers
+// as server-sent events. Paths are scrubbed and queries dropped.
+type tap struct {
+	scrub *scrubber
+
+	mu          sync.Mutex
+	subscribers map[*tapSubscriber]struct{}
+}
+
+func newTap(s *scrubber) *tap {
+	return &tap{scrub: s, subscribers: make(map[*tapSubscriber]struct{})}
+}
+
+func (t *tap) active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.subscribers) > 0
+}
+
+func (t *tap) publish(ev *tapEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for s := range t.subscribers {
+		if s.sampling < 1 && rand.Float64() >= s.sampling {
+			continue
+		}
+		select {
+		case s.events <- ev:
+		default:
+		}
+	}
+}
+
+// Handler returns the middleware publishing the requests served by h.
+// It must be installed inside ochttp.Handler.
+func (t *tap) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.active() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		ev := &tapEvent{
+			Time:      start.UTC(),
+			Method:    r.Method,
+			Path:      t.scrub.Scrub(r.URL.Path),
+			Status:    sw.Status(),
+			LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if span := trace.FromContext(r.Context()); span != nil {
+			ev.TraceID = span.SpanContext().TraceID.String()
+		}
+		t.publish(ev)
+	})
+}
+
+// ServeHTTP streams the events to an admin client. The optional
+// sampling query parameter is the fraction of requests to stream.
+func (t *tap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sampling := 1.0
+	if v := r.URL.Query().Get("sampling"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 1 {
+			http.Error(w, "sampling must be in (0, 1]", http.StatusBadRequest)
+			return
+		}
+		sampling = f
+	}
+
+	s := &tapSubscriber{events: make(chan *tapEvent, tapBufferSize), sampling: sampling}
+	t.mu.Lock()
+	t.subscribers[s] = struct{}{}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.subscribers, s)
+		t.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-s.events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tenantLabel is the label of the request tenants.
+const tenantLabel = "tenant"
+
+// tenantFunc returns the function returning the tenant of a request,
+// or an empty string, given its spec:
+//
+//	header:<name>  the value of the named header
+//	jwt:<claim>    a claim of the JWT in the jwtHeader header
+func tenantFunc(spec, jwtHeader string) (func(*http.Request) string, error) {
+	switch {
+	case strings.HasPrefix(spec, "header:"):
+		name := strings.TrimPrefix(spec, "header:")
+		return func(r *http.Request) string {
+			return r.Header.Get(name)
+		}, nil
+	case strings.HasPrefix(spec, "jwt:"):
+		claim := strings.TrimPrefix(spec, "jwt:")
+		return func(r *http.Request) string {
+			claims, err := jwtClaims(bearerToken(r, jwtHeader))
+			if err != nil {
+				return ""
+			}
+			return claimString(claims[claim])
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown tenant %q, want header:<name> or jwt:<claim>", spec)
+}
+
+// pseudonym returns a pseudonym of s, e.g. a tenant or a client
+// identity, stable across the proxy instances.
+func pseudonym(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// tenantHandler labels the requests with their tenant, raw or hashed.
+type tenantHandler struct {
+	tenant  func(*http.Request) string
+	hash    bool
+	handler http.Handler
+}
+
+func (h *tenantHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if tenant := h.tenant(r); tenant != "" {
+		if h.hash {
+			tenant = pseudonym(tenant)
+		}
+		r = r.WithContext(withLabels(r.Context(), map[string]string{tenantLabel: tenant}))
+	}
+	h.handler.ServeHTTP(w, r)
+}
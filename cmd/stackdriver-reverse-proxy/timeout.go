@@ -0,0 +1,52 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// requestTimeoutHandler bounds the time handler takes to proxy a
+// request, from its receipt to the end of the response body, so that
+// a hung backend doesn't hang the clients.
+type requestTimeoutHandler struct {
+	timeout time.Duration
+	handler http.Handler
+}
+
+func (h *requestTimeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+	h.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// timeoutTransport answers with 504, rather than the 502 of
+// httputil.ReverseProxy, the requests whose deadline, e.g. set by
+// requestTimeoutHandler, passed before the backend responded.
+type timeoutTransport struct {
+	base http.RoundTripper
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil && req.Context().Err() == context.DeadlineExceeded {
+		requestLogf(req.Context(), "WARNING: Request to %v timed out: %v", req.URL.Host, err)
+		recordRejection(req.Context(), "timeout")
+		return errorResponse(req, http.StatusGatewayTimeout), nil
+	}
+	return resp, err
+}
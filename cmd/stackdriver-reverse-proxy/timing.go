@@ -0,0 +1,126 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// requestTiming collects the phases of a backend request.
+type requestTiming struct {
+	mu sync.Mutex
+
+	start                    time.Time
+	getConn, gotConn         time.Time
+	dnsStart, dnsDone        time.Time
+	connectStart, connectEnd time.Time
+	tlsStart, tlsDone        time.Time
+	wroteRequest, firstByte  time.Time
+	reused                   bool
+}
+
+func (t *requestTiming) set(field *time.Time) {
+	t.mu.Lock()
+	*field = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *requestTiming) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) { t.set(&t.getConn) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.set(&t.gotConn)
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { t.set(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.set(&t.dnsDone) },
+		ConnectStart:         func(string, string) { t.set(&t.connectStart) },
+		ConnectDone:          func(string, string, error) { t.set(&t.connectEnd) },
+		TLSHandshakeStart:    func() { t.set(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.set(&t.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.set(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.set(&t.firstByte) },
+	}
+}
+
+// between returns the duration between two phases, or 0 if
+// any of them didn't happen.
+func between(from, to time.Time) time.Duration {
+	if from.IsZero() || to.IsZero() {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+func (t *requestTiming) log(req *http.Request, end time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dns := between(t.dnsStart, t.dnsDone)
+	dial := between(t.connectStart, t.connectEnd)
+	tlsHandshake := between(t.tlsStart, t.tlsDone)
+	queue := between(t.getConn, t.gotConn) - dns - dial - tlsHandshake
+	requestLogf(req.Context(), "Slow request %v %v: total=%v queue=%v dns=%v dial=%v tls=%v ttfb=%v body=%v reused=%v",
+		req.Method, req.URL,
+		end.Sub(t.start), queue, dns, dial, tlsHandshake,
+		between(t.wroteRequest, t.firstByte), between(t.firstByte, end), t.reused)
+}
+
+// timingTransport logs the timing breakdown of the backend requests
+// slower than threshold, to tell where the latency comes from when
+// the request isn't traced.
+type timingTransport struct {
+	base      http.RoundTripper
+	threshold time.Duration
+}
+
+func (t *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timing := &requestTiming{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timing.clientTrace()))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		if end := time.Now(); end.Sub(timing.start) > t.threshold {
+			timing.log(req, end)
+		}
+		return resp, err
+	}
+	resp.Body = &timingBody{ReadCloser: resp.Body, req: req, timing: timing, threshold: t.threshold}
+	return resp, nil
+}
+
+// timingBody logs the timing once the body is copied.
+type timingBody struct {
+	io.ReadCloser
+	req       *http.Request
+	timing    *requestTiming
+	threshold time.Duration
+	once      sync.Once
+}
+
+func (b *timingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		if end := time.Now(); end.Sub(b.timing.start) > b.threshold {
+			b.timing.log(b.req, end)
+		}
+	})
+	return err
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshakes of the listener.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// handshakeListener accepts TLS connections, performing the
+// handshakes off the accept loop to record their duration and
+// failures. http.Server finds the connections already handshaked.
+type handshakeListener struct {
+	net.Listener
+	config *tls.Config
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+}
+
+func newHandshakeListener(l net.Listener, config *tls.Config) *handshakeListener {
+	hl := &handshakeListener{
+		Listener: l,
+		config:   config,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go hl.acceptLoop()
+	return hl
+}
+
+func (l *handshakeListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.handshake(c)
+	}
+}
+
+func (l *handshakeListener) handshake(c net.Conn) {
+	tc := tls.Server(c, l.config)
+	start := time.Now()
+	c.SetDeadline(start.Add(tlsHandshakeTimeout))
+	err := tc.Handshake()
+	c.SetDeadline(time.Time{})
+	recordTLSHandshake("listener", tc.ConnectionState(), time.Since(start), err)
+	if err != nil {
+		c.Close()
+		return
+	}
+	select {
+	case l.conns <- tc:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+func (l *handshakeListener) Close() error {
+	close(l.done)
+	return l.Listener.Close()
+}
+
+// recordTLSHandshake records the duration and result of
+// a handshake of the listener or backend side.
+func recordTLSHandshake(side string, state tls.ConnectionState, latency time.Duration, err error) {
+	mutators := []tag.Mutator{
+		tag.Upsert(sideKey, side),
+		tag.Upsert(resultKey, handshakeResult(err)),
+	}
+	if err == nil {
+		mutators = append(mutators,
+			tag.Upsert(tlsVersionKey, tlsVersionName(state.Version)),
+			tag.Upsert(cipherKey, cipherSuiteName(state.CipherSuite)),
+		)
+	}
+	ctx, terr := tag.New(context.Background(), mutators...)
+	if terr != nil {
+		return
+	}
+	stats.Record(ctx, tlsHandshakeLatency.M(float64(latency)/float64(time.Millisecond)))
+}
+
+// handshakeResult classifies handshake errors for metric labels.
+func handshakeResult(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	if err == io.EOF {
+		return "eof"
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "does not look like a TLS handshake"):
+		return "not_tls"
+	case strings.Contains(msg, "certificate"):
+		return "certificate"
+	case strings.Contains(msg, "version"):
+		return "version"
+	case strings.Contains(msg, "cipher"):
+		return "cipher"
+	}
+	return "error"
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case 0x0304:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+var cipherSuiteNames = map[uint16]string{
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+	// TLS 1.3 suites, not defined by crypto/tls yet.
+	0x1301: "TLS_AES_128_GCM_SHA256",
+	0x1302: "TLS_AES_256_GCM_SHA384",
+	0x1303: "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+func cipherSuiteName(id uint16) string {
+	if name, ok := cipherSuiteNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
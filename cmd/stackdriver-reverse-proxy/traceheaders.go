@@ -0,0 +1,59 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"go.opencensus.io/trace"
+)
+
+// traceHeadersHandler tells clients the trace of their request in the
+// X-Trace-Id and X-Trace-Sampled response headers, so failing requests
+// can be looked up in Stackdriver Trace. It must be installed inside
+// ochttp.Handler.
+type traceHeadersHandler struct {
+	handler http.Handler
+}
+
+func (h *traceHeadersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if span := trace.FromContext(r.Context()); span != nil {
+		sc := span.SpanContext()
+		w.Header().Set("X-Trace-Id", sc.TraceID.String())
+		w.Header().Set("X-Trace-Sampled", strconv.FormatBool(sc.IsSampled()))
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// traceURLHandler logs the Cloud Console URL of the traces of the
+// sampled requests, to jump from the proxy output to the traces while
+// debugging. It must be installed inside ochttp.Handler.
+type traceURLHandler struct {
+	project string
+	handler http.Handler
+}
+
+func (h *traceURLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r)
+	span := trace.FromContext(r.Context())
+	if span == nil || !span.SpanContext().IsSampled() {
+		return
+	}
+	log.Printf("Trace of %v %v: https://console.cloud.google.com/traces/list?project=%v&tid=%v",
+		r.Method, r.URL.Path, url.QueryEscape(h.project), span.SpanContext().TraceID)
+}
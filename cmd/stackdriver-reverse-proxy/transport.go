@@ -0,0 +1,59 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// reresolveTransport closes the idle connections to the backend when
+// a request fails, so the next requests dial new connections. Since
+// the backend host is resolved at every dial, they reach the new
+// addresses of a backend whose IP changed, e.g. after a failover.
+type reresolveTransport struct {
+	base interface {
+		http.RoundTripper
+		CloseIdleConnections()
+	}
+}
+
+func (t *reresolveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil && req.Context().Err() == nil {
+		requestLogf(req.Context(), "ERROR: Request to %v failed, closing idle backend connections: %v", req.URL.Host, err)
+		t.base.CloseIdleConnections()
+	}
+	return resp, err
+}
+
+// errorResponse returns a response with status to req, answered by the
+// proxy on behalf of the backend.
+func errorResponse(req *http.Request, status int) *http.Response {
+	body := http.StatusText(status) + "\n"
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// inheritedFDsEnv lists the names of the listeners inherited by
+	// an upgraded process, the first one being file descriptor 3.
+	inheritedFDsEnv = "STACKDRIVER_PROXY_INHERITED_FDS"
+
+	// readyFDEnv is the file descriptor the upgraded process closes
+	// once ready, after writing a byte to it.
+	readyFDEnv = "STACKDRIVER_PROXY_READY_FD"
+
+	// upgradeTimeout is how long the upgraded process has to get ready.
+	upgradeTimeout = time.Minute
+
+	// upgradeGrace is how long the connections accepted before the
+	// listeners were handed over have to send their request before
+	// the idle connections are closed. http.Server drops the requests
+	// read once it is shutting down.
+	upgradeGrace = time.Second
+)
+
+type namedListener struct {
+	name string
+	l    *net.TCPListener
+}
+
+// upgrader hands the listening sockets over to a new process of the
+// proxy, e.g. a new version of the binary installed in place, so it
+// starts accepting the connections before the old process drains.
+type upgrader struct {
+	inherited  map[string]*os.File
+	ready      *os.File
+	listeners  []namedListener
+	handedOver int32
+}
+
+// newUpgrader returns an upgrader with the listeners inherited from
+// the process that started this one, if any.
+func newUpgrader() (*upgrader, error) {
+	u := &upgrader{inherited: make(map[string]*os.File)}
+	if names := os.Getenv(inheritedFDsEnv); names != "" {
+		for i, name := range strings.Split(names, ",") {
+			u.inherited[name] = os.NewFile(uintptr(3+i), name)
+		}
+	}
+	if s := os.Getenv(readyFDEnv); s != "" {
+		fd, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %v", readyFDEnv, err)
+		}
+		u.ready = os.NewFile(uintptr(fd), "ready")
+	}
+	os.Unsetenv(inheritedFDsEnv)
+	os.Unsetenv(readyFDEnv)
+	return u, nil
+}
+
+// Listen returns the listener inherited under name, or listens on
+// addr. The listener is handed over on upgrades.
+func (u *upgrader) Listen(name, network, addr string) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if f, ok := u.inherited[name]; ok {
+		l, err = net.FileListener(f)
+		f.Close()
+		if err == nil {
+			log.Printf("Inherited the %v listener on %v", name, l.Addr())
+		}
+	} else {
+		l, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("cannot hand over %T", l)
+	}
+	u.listeners = append(u.listeners, namedListener{name: name, l: tl})
+	return l, nil
+}
+
+// Ready tells the process that started this one, if any, that it is
+// ready to serve.
+func (u *upgrader) Ready() {
+	if u.ready == nil {
+		return
+	}
+	u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+}
+
+// Upgrade starts a new process of the proxy, with the same command
+// line and the listeners of this one, and waits for it to be ready.
+func (u *upgrader) Upgrade() (pid int, err error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return 0, err
+	}
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, nl := range u.listeners {
+		f, err := nl.l.File()
+		if err != nil {
+			return 0, err
+		}
+		names = append(names, nl.name)
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		inheritedFDsEnv+"="+strings.Join(names, ","),
+		readyFDEnv+"="+strconv.Itoa(3+len(names)),
+	)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	w.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		if err == io.EOF {
+			err = errors.New("exited before being ready")
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("not ready after %v", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	pid = cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// Close closes the listeners handed over to the new process.
+func (u *upgrader) Close() {
+	atomic.StoreInt32(&u.handedOver, 1)
+	for _, nl := range u.listeners {
+		nl.l.Close()
+	}
+}
+
+// HandedOver reports whether the listeners were handed over, so
+// http.Server.Serve failing is expected.
+func (u *upgrader) HandedOver() bool {
+	return atomic.LoadInt32(&u.handedOver) == 1
+}
+
+// upgradeHandler serves the upgrade admin endpoint. POST starts a new
+// process of the proxy taking over the listeners, then stops this one
+// with stop once the new process is ready.
+type upgradeHandler struct {
+	u    *upgrader
+	stop func()
+}
+
+func (h upgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	pid, err := h.u.Upgrade()
+	if err != nil {
+		log.Printf("ERROR: Cannot upgrade the proxy: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Handed the listeners over to process %d, draining", pid)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"pid": pid})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	go h.stop()
+}
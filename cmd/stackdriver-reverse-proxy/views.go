@@ -0,0 +1,52 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.opencensus.io/stats/view"
+)
+
+// selectViews returns the views of all named by the items, view names
+// or view name prefixes ending with '*', e.g.
+// opencensus.io/http/server/*. Without items, it returns defaults.
+func selectViews(defaults, all []*view.View, items []string) ([]*view.View, error) {
+	if len(items) == 0 {
+		return defaults, nil
+	}
+	selected := make(map[*view.View]bool)
+	for _, item := range items {
+		prefix := strings.TrimSuffix(item, "*")
+		found := false
+		for _, v := range all {
+			if v.Name == item || (prefix != item && strings.HasPrefix(v.Name, prefix)) {
+				selected[v] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no view matches %q", item)
+		}
+	}
+	var views []*view.View
+	for _, v := range all {
+		if selected[v] {
+			views = append(views, v)
+		}
+	}
+	return views, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// blockRule describes requests to block. All the conditions set
+// must match for the rule to match.
+type blockRule struct {
+	Name          string `json:"name"`
+	Method        string `json:"method,omitempty"`
+	Path          string `json:"path,omitempty"`           // regexp matched against the URL path
+	Header        string `json:"header,omitempty"`         // header name
+	HeaderPattern string `json:"header_pattern,omitempty"` // regexp matched against the header values
+	Body          string `json:"body,omitempty"`           // substring of the first bodyLimit bytes of the body
+
+	path   *regexp.Regexp
+	header *regexp.Regexp
+}
+
+// parseBlockRules parses a JSON list of rules. Unknown fields are
+// rejected, since a misspelled condition would widen its rule, and so
+// are the rules without conditions, which would block every request.
+func parseBlockRules(b []byte) ([]*blockRule, error) {
+	var rules []*blockRule
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	err := d.Decode(&rules)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("data after the rules")
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.Method == "" && rule.Path == "" && rule.Header == "" && rule.Body == "" {
+			return nil, fmt.Errorf("rule %v: no conditions", rule.Name)
+		}
+		if rule.HeaderPattern != "" && rule.Header == "" {
+			return nil, fmt.Errorf("rule %v: header_pattern without header", rule.Name)
+		}
+		if rule.Path != "" {
+			if rule.path, err = regexp.Compile(rule.Path); err != nil {
+				return nil, fmt.Errorf("rule %v: %v", rule.Name, err)
+			}
+		}
+		if rule.HeaderPattern != "" {
+			if rule.header, err = regexp.Compile(rule.HeaderPattern); err != nil {
+				return nil, fmt.Errorf("rule %v: %v", rule.Name, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (rule *blockRule) match(r *http.Request, body []byte) bool {
+	if rule.Method != "" && rule.Method != r.Method {
+		return false
+	}
+	if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+	if rule.Header != "" {
+		values, ok := r.Header[http.CanonicalHeaderKey(rule.Header)]
+		if !ok {
+			return false
+		}
+		if rule.header != nil {
+			matched := false
+			for _, v := range values {
+				if rule.header.MatchString(v) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+	if rule.Body != "" && !bytes.Contains(body, []byte(rule.Body)) {
+		return false
+	}
+	return true
+}
+
+// blockHandler rejects with 403 the requests matching any of the rules.
+type blockHandler struct {
+	bodyLimit int64
+	handler   http.Handler
+
+	mu    sync.RWMutex
+	rules []*blockRule
+}
+
+// SetRules replaces the rules.
+func (h *blockHandler) SetRules(rules []*blockRule) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rules = rules
+}
+
+func (h *blockHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	rules := h.rules
+	h.mu.RUnlock()
+	var body []byte
+	if inspectsBody(rules) && r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, h.bodyLimit))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+	for _, rule := range rules {
+		if rule.match(r, body) {
+			log.Printf("Blocked %v %v from %v: matched rule %q", r.Method, r.URL.Path, r.RemoteAddr, rule.Name)
+			recordRejection(r.Context(), "blocked")
+			recordBlocked(r.Context(), rule.Name)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+func inspectsBody(rules []*blockRule) bool {
+	for _, rule := range rules {
+		if rule.Body != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// warmUp sends count concurrent GET requests for each of the paths
+// to target with t, so the backend and the connection pool are primed
+// before the first real requests. It gives up after timeout.
+func warmUp(t http.RoundTripper, target *url.URL, paths []string, count int, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client := &http.Client{Transport: t}
+	start := time.Now()
+	var wg sync.WaitGroup
+	var failed int32
+	for _, p := range paths {
+		u := *target
+		u.Path = singleJoiningSlash(target.Path, p)
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(u string) {
+				defer wg.Done()
+				if err := warmUpRequest(ctx, client, u); err != nil {
+					atomic.AddInt32(&failed, 1)
+					debugf("Warm-up request to %v failed: %v", u, err)
+				}
+			}(u.String())
+		}
+	}
+	wg.Wait()
+	n := len(paths) * count
+	if failed > 0 {
+		log.Printf("WARNING: Warmed up the backend in %v, %d of %d requests failed", time.Since(start), failed, n)
+		return
+	}
+	log.Printf("Warmed up the backend with %d requests in %v", n, time.Since(start))
+}
+
+func warmUpRequest(ctx context.Context, client *http.Client, u string) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "stackdriver-reverse-proxy warm-up")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 500 {
+		return &statusError{resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/stackdriver-reverse-proxy/sproxy"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// wsCloseTimeout is how long the peers of the sessions have to
+// complete the closing handshake on shutdown.
+const wsCloseTimeout = 5 * time.Second
+
+// isWebSocket reports whether r is a WebSocket upgrade request.
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range splitList(r.Header.Get("Connection")) {
+		if strings.EqualFold(v, "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// wsProxy proxies the WebSocket sessions to the target. Unlike
+// httputil.ReverseProxy, it parses the frames exchanged by the peers
+// to measure the sessions and to close them gracefully on shutdown.
+type wsProxy struct {
+	target    *url.URL
+	director  func(*http.Request)
+	transport http.RoundTripper
+
+	mu       sync.Mutex
+	sessions map[*wsSession]struct{}
+}
+
+// newWSProxy returns a WebSocket proxy to target, sending the upgrade
+// requests with transport, a wsTransport or a transport wrapping one.
+func newWSProxy(target *url.URL, transport http.RoundTripper) *wsProxy {
+	return &wsProxy{
+		target:    target,
+		director:  sproxy.ForwardedProto(httputil.NewSingleHostReverseProxy(target).Director),
+		transport: transport,
+		sessions:  make(map[*wsSession]struct{}),
+	}
+}
+
+type wsUpgradeKey struct{}
+
+// wsUpgrade receives the connection of an upgrade request accepted by
+// the target from wsTransport.
+type wsUpgrade struct {
+	dialed bool
+	conn   net.Conn
+	br     *bufio.Reader
+}
+
+// wsTransport sends each upgrade request on a connection of its own,
+// dialed with dial, over TLS to https targets. The connection of a
+// 101 response is handed over to the wsUpgrade of the request context,
+// the ones of the other responses are closed with their body.
+type wsTransport struct {
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	tlsConfig *tls.Config
+}
+
+func (t *wsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	up, ok := req.Context().Value(wsUpgradeKey{}).(*wsUpgrade)
+	if !ok {
+		return nil, errors.New("not a WebSocket upgrade")
+	}
+	conn, err := t.dialTarget(req.Context(), req.URL)
+	if err != nil {
+		return nil, err
+	}
+	up.dialed = true
+	br := bufio.NewReader(conn)
+	resp, err := writeUpgrade(conn, br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		up.conn, up.br = conn, br
+		return resp, nil
+	}
+	resp.Body = &connBody{ReadCloser: resp.Body, conn: conn}
+	return resp, nil
+}
+
+// connBody closes the connection of the response with its body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+func (p *wsProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		if outer, found := outerWriter(r); found {
+			hj, ok = outer.(http.Hijacker)
+		}
+	}
+	if !ok {
+		recordWSUpgrade(r.Context(), "unsupported")
+		http.Error(w, "WebSocket upgrades are not supported", http.StatusInternalServerError)
+		return
+	}
+	outreq := r.WithContext(r.Context())
+	outreq.URL = new(url.URL)
+	*outreq.URL = *r.URL
+	outreq.Header = make(http.Header)
+	for k, v := range r.Header {
+		outreq.Header[k] = v
+	}
+	p.director(outreq)
+
+	up := &wsUpgrade{}
+	resp, err := p.transport.RoundTrip(outreq.WithContext(context.WithValue(outreq.Context(), wsUpgradeKey{}, up)))
+	if err != nil {
+		if !up.dialed {
+			requestLogf(r.Context(), "ERROR: Cannot dial WebSocket target %v: %v", p.target.Host, err)
+			recordWSUpgrade(r.Context(), "dial_error")
+		} else {
+			requestLogf(r.Context(), "ERROR: WebSocket upgrade to %v failed: %v", p.target.Host, err)
+			recordWSUpgrade(r.Context(), "error")
+		}
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	// Closing the body of a 101 response ends its span, not the
+	// connection. The responses answered by the transports, e.g. 503
+	// with an open circuit breaker, have no connection.
+	backend, br := up.conn, up.br
+	if resp.StatusCode != http.StatusSwitchingProtocols || backend == nil {
+		recordWSUpgrade(r.Context(), "rejected")
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	resp.Body.Close()
+	client, brw, err := hj.Hijack()
+	if err != nil {
+		backend.Close()
+		log.Printf("Cannot hijack WebSocket connection: %v", err)
+		recordWSUpgrade(r.Context(), "error")
+		return
+	}
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		client.Close()
+		backend.Close()
+		recordWSUpgrade(r.Context(), "error")
+		return
+	}
+	recordWSUpgrade(r.Context(), "ok")
+
+	s := &wsSession{
+		client:  &wsConn{Conn: client, r: brw.Reader},
+		backend: &wsConn{Conn: backend, r: br, masked: true},
+	}
+	p.add(s)
+	defer p.remove(s)
+	s.run(r.Context())
+}
+
+// dialTarget dials the target, over TLS for an https target.
+func (t *wsTransport) dialTarget(ctx context.Context, target *url.URL) (net.Conn, error) {
+	conn, err := t.dial(ctx, "tcp", targetAddr(target))
+	if err != nil || target.Scheme != "https" {
+		return conn, err
+	}
+	config := t.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = target.Hostname()
+	}
+	config.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// writeUpgrade sends the upgrade request req to the target and reads
+// its response.
+func writeUpgrade(conn net.Conn, br *bufio.Reader, req *http.Request) (*http.Response, error) {
+	if deadline, ok := req.Context().Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(br, req)
+}
+
+// recordWSUpgrade counts a WebSocket upgrade request with result.
+func recordWSUpgrade(ctx context.Context, result string) {
+	ctx, err := tag.New(ctx, tag.Upsert(resultKey, result))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, wsUpgrades.M(1))
+}
+
+func (p *wsProxy) add(s *wsSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[s] = struct{}{}
+}
+
+func (p *wsProxy) remove(s *wsSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, s)
+}
+
+// Shutdown starts the closing handshake of the sessions, with the
+// 1001 (going away) status code, and closes the connections of the
+// sessions not closed within wsCloseTimeout. Register it with
+// http.Server.RegisterOnShutdown, since the server doesn't track
+// hijacked connections.
+func (p *wsProxy) Shutdown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for s := range p.sessions {
+		s.close()
+	}
+}
+
+// wsSession is a proxied WebSocket session.
+type wsSession struct {
+	client  *wsConn
+	backend *wsConn
+}
+
+// run forwards the frames between the peers until either closes its
+// connection, and records the session telemetry.
+func (s *wsSession) run(ctx context.Context) {
+	start := time.Now()
+	stats.Record(ctx, wsSessions.M(1))
+	defer func() {
+		stats.Record(ctx, wsSessions.M(-1))
+		stats.Record(ctx, wsSessionDuration.M(time.Since(start).Seconds()))
+	}()
+
+	done := make(chan struct{}, 2)
+	forward := func(dst, src *wsConn, direction string) {
+		ctx, err := tag.New(ctx, tag.Upsert(directionKey, direction))
+		if err == nil {
+			copyFrames(ctx, dst, src)
+		}
+		done <- struct{}{}
+	}
+	go forward(s.backend, s.client, "client_to_backend")
+	go forward(s.client, s.backend, "backend_to_client")
+	<-done
+	s.client.Close()
+	s.backend.Close()
+	<-done
+}
+
+// close bounds the time the peers have to close the connections and
+// sends them a close frame. The deadlines are set first: a frame
+// being forwarded holds the lock of the connection while it is read
+// from a peer that may be stalled. The close frames are written in
+// the background, not to hold up the shutdown of the other sessions.
+func (s *wsSession) close() {
+	deadline := time.Now().Add(wsCloseTimeout)
+	for _, c := range []*wsConn{s.client, s.backend} {
+		c.SetDeadline(deadline)
+	}
+	for _, c := range []*wsConn{s.client, s.backend} {
+		go c.writeClose(1001)
+	}
+}
+
+// wsConn is a connection to a WebSocket peer. The frames written to
+// it are serialized, so that a close frame can be written between
+// the forwarded frames. Frames written to the target are masked, as
+// required of the frames sent by clients.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	masked bool
+
+	mu sync.Mutex
+}
+
+// writeClose writes a close frame with the status code.
+func (c *wsConn) writeClose(code uint16) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	frame := []byte{0x88, byte(len(payload))}
+	if c.masked {
+		mask := make([]byte, 4)
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.Write(append(frame, payload...))
+	return err
+}
+
+// copyFrames forwards the frames read from src to dst, recording
+// the forwarded bytes, until src is closed.
+func copyFrames(ctx context.Context, dst, src *wsConn) error {
+	header := make([]byte, 14)
+	for {
+		if _, err := io.ReadFull(src.r, header[:2]); err != nil {
+			return err
+		}
+		n := 2
+		switch header[1] & 0x7f {
+		case 126:
+			n += 2
+		case 127:
+			n += 8
+		}
+		if header[1]&0x80 != 0 {
+			n += 4
+		}
+		if _, err := io.ReadFull(src.r, header[2:n]); err != nil {
+			return err
+		}
+		var size int64
+		switch header[1] & 0x7f {
+		case 126:
+			size = int64(binary.BigEndian.Uint16(header[2:4]))
+		case 127:
+			size = int64(binary.BigEndian.Uint64(header[2:10]))
+		default:
+			size = int64(header[1] & 0x7f)
+		}
+		dst.mu.Lock()
+		_, err := dst.Write(header[:n])
+		if err == nil {
+			_, err = io.CopyN(dst, src.r, size)
+		}
+		dst.mu.Unlock()
+		stats.Record(ctx, wsBytes.M(int64(n)+size))
+		if err != nil {
+			return err
+		}
+	}
+}
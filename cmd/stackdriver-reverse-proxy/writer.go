@@ -0,0 +1,116 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// statusWriter records the status code and size of a response.
+// It keeps the http.Flusher and http.Hijacker abilities of the
+// underlying writer, needed for streaming and upgrades.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Status returns the response status, 200 if none was written.
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+	return h.Hijack()
+}
+
+type outerWriterKey struct{}
+
+// exposeWriterHandler makes its ResponseWriter available to the
+// handlers inside ochttp.Handler, whose ResponseWriter is neither
+// an http.Flusher nor an http.Hijacker. It must wrap ochttp.Handler.
+type exposeWriterHandler struct {
+	handler http.Handler
+}
+
+func (h *exposeWriterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), outerWriterKey{}, w)))
+}
+
+// outerWriter returns the ResponseWriter exposed by exposeWriterHandler.
+func outerWriter(r *http.Request) (http.ResponseWriter, bool) {
+	w, ok := r.Context().Value(outerWriterKey{}).(http.ResponseWriter)
+	return w, ok
+}
+
+// flushingWriter writes to the ResponseWriter of ochttp.Handler
+// but flushes the outer one, for streaming responses.
+type flushingWriter struct {
+	http.ResponseWriter
+	outer http.Flusher
+}
+
+func (w *flushingWriter) Flush() {
+	w.outer.Flush()
+}
+
+// withFlusher returns w made flushable if the outer writer of r is.
+func withFlusher(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if _, ok := w.(http.Flusher); ok {
+		return w
+	}
+	outer, ok := outerWriter(r)
+	if !ok {
+		return w
+	}
+	f, ok := outer.(http.Flusher)
+	if !ok {
+		return w
+	}
+	return &flushingWriter{ResponseWriter: w, outer: f}
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// defaultCollectorEndpoint is the Zipkin v2 API of a local Zipkin
+	// server or Jaeger collector.
+	defaultCollectorEndpoint = "http://localhost:9411/api/v2/spans"
+
+	// spanBatchSize is the number of spans sent at once.
+	spanBatchSize = 100
+
+	// spanBufferSize is the number of spans kept while the collector
+	// is unreachable. Newer spans are dropped.
+	spanBufferSize = 10000
+)
+
+// zipkinEndpoint is the service of a Zipkin span.
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"` // microseconds
+	Value     string `json:"value"`
+}
+
+// zipkinSpan is a span of the Zipkin v2 API, also accepted by the
+// Jaeger collectors.
+type zipkinSpan struct {
+	TraceID       string             `json:"traceId"`
+	ID            string             `json:"id"`
+	ParentID      string             `json:"parentId,omitempty"`
+	Name          string             `json:"name"`
+	Kind          string             `json:"kind,omitempty"`
+	Timestamp     int64              `json:"timestamp"` // microseconds
+	Duration      int64              `json:"duration"`  // microseconds
+	LocalEndpoint zipkinEndpoint     `json:"localEndpoint"`
+	Tags          map[string]string  `json:"tags,omitempty"`
+	Annotations   []zipkinAnnotation `json:"annotations,omitempty"`
+}
+
+// zipkinExporter sends the spans in batches to a Zipkin server or a
+// Jaeger collector, for the environments that can't reach the
+// Stackdriver Trace API. The metrics are not exported.
+type zipkinExporter struct {
+	client   *http.Client
+	endpoint string
+	service  string
+
+	mu    sync.Mutex
+	spans []zipkinSpan
+
+	// flushMu serializes the flushes.
+	flushMu sync.Mutex
+}
+
+// newZipkinExporter returns an exporter sending the spans of service
+// to the Zipkin v2 endpoint with t.
+func newZipkinExporter(endpoint, service string, t http.RoundTripper) *zipkinExporter {
+	return &zipkinExporter{
+		client:   &http.Client{Transport: t, Timeout: 10 * time.Second},
+		endpoint: endpoint,
+		service:  service,
+	}
+}
+
+func (e *zipkinExporter) ExportSpan(sd *trace.SpanData) {
+	s := zipkinSpan{
+		TraceID:       sd.TraceID.String(),
+		ID:            sd.SpanID.String(),
+		Name:          sd.Name,
+		Timestamp:     sd.StartTime.UnixNano() / 1e3,
+		Duration:      int64(sd.EndTime.Sub(sd.StartTime) / time.Microsecond),
+		LocalEndpoint: zipkinEndpoint{ServiceName: e.service},
+		Tags:          make(map[string]string, len(sd.Attributes)+1),
+	}
+	if sd.ParentSpanID != (trace.SpanID{}) {
+		s.ParentID = sd.ParentSpanID.String()
+	}
+	// The ochttp spans are named after their side.
+	switch {
+	case strings.HasPrefix(sd.Name, "Recv."):
+		s.Kind = "SERVER"
+	case strings.HasPrefix(sd.Name, "Sent."):
+		s.Kind = "CLIENT"
+	}
+	for k, v := range sd.Attributes {
+		s.Tags[k] = fmt.Sprint(v)
+	}
+	if sd.Code != 0 {
+		s.Tags["error"] = sd.Message
+		if s.Tags["error"] == "" {
+			s.Tags["error"] = fmt.Sprintf("code %d", sd.Code)
+		}
+	}
+	for _, a := range sd.Annotations {
+		s.Annotations = append(s.Annotations, zipkinAnnotation{
+			Timestamp: a.Time.UnixNano() / 1e3,
+			Value:     a.Message,
+		})
+	}
+	e.mu.Lock()
+	queued := len(e.spans) < spanBufferSize
+	if queued {
+		e.spans = append(e.spans, s)
+	}
+	full := len(e.spans) >= spanBatchSize
+	e.mu.Unlock()
+	if queued {
+		recordExportQueue("zipkin", 1)
+	} else {
+		recordExportDropped("zipkin")
+	}
+	if full {
+		go e.flush()
+	}
+}
+
+// ExportView drops the view data, Zipkin has no metrics.
+func (e *zipkinExporter) ExportView(vd *view.Data) {}
+
+// Queued returns the number of spans buffered.
+func (e *zipkinExporter) Queued() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.spans)
+}
+
+// Run sends the buffered spans every interval.
+func (e *zipkinExporter) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		e.flush()
+	}
+}
+
+// flush sends the buffered spans, in batches. The spans are kept for
+// the next flush if the collector cannot be reached.
+func (e *zipkinExporter) flush() {
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+	start := time.Now()
+	for sent := false; ; sent = true {
+		e.mu.Lock()
+		n := len(e.spans)
+		if n > spanBatchSize {
+			n = spanBatchSize
+		}
+		batch := append([]zipkinSpan(nil), e.spans[:n]...)
+		e.mu.Unlock()
+		if n == 0 {
+			if sent {
+				recordExportFlush("zipkin", "ok", start)
+			}
+			return
+		}
+		if err := e.send(batch); err != nil {
+			log.Printf("ERROR: Cannot export spans to %v: %v", e.endpoint, err)
+			recordExportFailure("zipkin.Spans", "Unavailable")
+			recordExportFlush("zipkin", "error", start)
+			return
+		}
+		e.mu.Lock()
+		e.spans = e.spans[n:]
+		e.mu.Unlock()
+		recordExportQueue("zipkin", -n)
+	}
+}
+
+func (e *zipkinExporter) send(spans []zipkinSpan) error {
+	body, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
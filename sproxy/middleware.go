@@ -0,0 +1,93 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sproxy
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Middleware wraps a handler with a stage of the proxy, e.g. the
+// authentication or the rate limiting of the requests.
+type Middleware func(http.Handler) http.Handler
+
+// The orders of the stages of the stackdriver-reverse-proxy command,
+// both of those checking the requests before they are traced and of
+// those checking the traced requests before the backend, to run other
+// stages before, between or after them:
+//
+//	chain.Use("tenant-auth", sproxy.OrderAuth+5, tenantAuth)
+const (
+	// OrderEdge is the order of the checks of the requests as
+	// received: forwarding headers, size limits and HTTPS, and of the
+	// header rewrites.
+	OrderEdge = 100
+
+	// OrderFilter is the order of the blocking rules and of the
+	// disabled routes.
+	OrderFilter = 200
+
+	// OrderAuth is the order of the authentication and authorization
+	// of the requests.
+	OrderAuth = 300
+
+	// OrderRateLimit is the order of the rate limits, quotas and load
+	// shedding, after the authentication so that they can apply per
+	// verified identity.
+	OrderRateLimit = 400
+)
+
+// Chain composes middlewares by order. The zero value is an empty
+// chain.
+type Chain struct {
+	stages []stage
+}
+
+type stage struct {
+	name  string
+	order int
+	m     Middleware
+}
+
+// Use adds m as the stage name of the chain. The stages run by
+// increasing order, and those of the same order as they were added.
+func (c *Chain) Use(name string, order int, m Middleware) {
+	c.stages = append(c.stages, stage{name: name, order: order, m: m})
+}
+
+// Then returns h wrapped by the stages, the first to run outermost.
+func (c *Chain) Then(h http.Handler) http.Handler {
+	stages := c.sorted()
+	for i := len(stages) - 1; i >= 0; i-- {
+		h = stages[i].m(h)
+	}
+	return h
+}
+
+// Names returns the names of the stages in the order they run.
+func (c *Chain) Names() []string {
+	stages := c.sorted()
+	names := make([]string, len(stages))
+	for i, s := range stages {
+		names[i] = s.name
+	}
+	return names
+}
+
+func (c *Chain) sorted() []stage {
+	stages := append([]stage(nil), c.stages...)
+	sort.SliceStable(stages, func(i, j int) bool { return stages[i].order < stages[j].order })
+	return stages
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"go.opencensus.io/exporter/stackdriver/propagation"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+	ocpropagation "go.opencensus.io/trace/propagation"
+)
+
+// Config configures a reverse proxy to a target.
+type Config struct {
+	// Target is the URL of the server the requests are proxied to,
+	// e.g. http://localhost:8080.
+	Target *url.URL
+
+	// Transport configures how the target is reached.
+	Transport TransportOptions
+
+	// Propagation is the trace header format of the incoming requests
+	// and of the requests to the target. If nil, the Stackdriver
+	// X-Cloud-Trace-Context header is used.
+	Propagation ocpropagation.HTTPFormat
+
+	// Sampler samples the traces of the incoming requests, e.g. one
+	// of the samplers of this package. If nil, the default sampler of
+	// the trace package is used.
+	Sampler trace.Sampler
+
+	// Middleware runs its stages on the incoming requests before they
+	// are traced and proxied, e.g. to authenticate them, if not nil.
+	Middleware *Chain
+}
+
+// Proxy is a reverse proxy to a target that traces and measures the
+// incoming requests and the requests to the target, like the
+// stackdriver-reverse-proxy command. The spans and the ochttp views
+// are exported by the exporters registered by the embedding server.
+type Proxy struct {
+	handler   http.Handler
+	transport http.RoundTripper
+}
+
+// New returns the reverse proxy configured by c.
+func New(c Config) (*Proxy, error) {
+	if c.Target == nil {
+		return nil, errors.New("sproxy: no target")
+	}
+	format := c.Propagation
+	if format == nil {
+		format = &propagation.HTTPFormat{}
+	}
+	base := c.Transport.Base
+	if base == nil {
+		base = NewHTTPTransport(c.Transport.DialContext)
+	}
+	transport := &ochttp.Transport{Base: base, Propagation: format}
+	p := httputil.NewSingleHostReverseProxy(c.Target)
+	p.Director = ForwardedProto(p.Director)
+	p.Transport = transport
+	var handler http.Handler = &ochttp.Handler{
+		Handler:      p,
+		Propagation:  format,
+		StartOptions: trace.StartOptions{Sampler: c.Sampler},
+	}
+	if c.Middleware != nil {
+		handler = c.Middleware.Then(handler)
+	}
+	return &Proxy{handler: handler, transport: transport}, nil
+}
+
+// ServeHTTP proxies r to the target.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// Transport returns the instrumented transport to the target, e.g.
+// to send health checks or requests of the embedding server to the
+// target that are traced like the proxied ones.
+func (p *Proxy) Transport() http.RoundTripper {
+	return p.transport
+}
+
+// ForwardedProto wraps a reverse proxy director to tell the target
+// the scheme the request was received with, which differs from the
+// scheme of the request to the target when bridging HTTP to HTTPS.
+// The X-Forwarded-Proto header set by a load balancer in front of the
+// proxy is kept.
+func ForwardedProto(director func(*http.Request)) func(*http.Request) {
+	return func(req *http.Request) {
+		director(req)
+		if req.Header.Get("X-Forwarded-Proto") != "" {
+			return
+		}
+		if req.TLS != nil {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			req.Header.Set("X-Forwarded-Proto", "http")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sproxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+)
+
+// The samplers below compose into the sampling policy of a server,
+// e.g. half of the /api traces, 1% of the others, at most 10 traces
+// per second:
+//
+//	sampler := sproxy.RateLimitedSampler(sproxy.PathSampler(
+//		map[string]trace.Sampler{"/api/*": sproxy.ProbabilitySampler(0.5)},
+//		sproxy.ProbabilitySampler(0.01),
+//	), 10)
+//	trace.SetDefaultSampler(sampler)
+//
+// and the requests with the X-Force-Trace header always traced:
+//
+//	handler := &ochttp.Handler{
+//		Handler:     proxy,
+//		Propagation: sproxy.ForceSampling("X-Force-Trace", &propagation.HTTPFormat{}),
+//	}
+
+// ProbabilitySampler samples fraction of the traces by trace ID, so
+// that the proxies along a trace take the same decision, and the spans
+// whose parent is sampled.
+func ProbabilitySampler(fraction float64) trace.Sampler {
+	return func(p trace.SamplingParameters) trace.SamplingDecision {
+		if p.ParentContext.IsSampled() || fraction >= 1 {
+			return trace.SamplingDecision{Sample: true}
+		}
+		if fraction <= 0 {
+			return trace.SamplingDecision{Sample: false}
+		}
+		x := binary.BigEndian.Uint64(p.TraceID[0:8]) >> 1
+		return trace.SamplingDecision{Sample: x < uint64(fraction*(1<<63))}
+	}
+}
+
+// PathSampler samples the server spans with the sampler of the longest
+// route matching their path, a path prefix optionally followed by *,
+// e.g. /api/*, and the other spans with def.
+func PathSampler(routes map[string]trace.Sampler, def trace.Sampler) trace.Sampler {
+	prefixes := make([]string, 0, len(routes))
+	samplers := make([]trace.Sampler, 0, len(routes))
+	for route, s := range routes {
+		prefixes = append(prefixes, strings.TrimSuffix(route, "*"))
+		samplers = append(samplers, s)
+	}
+	return func(p trace.SamplingParameters) trace.SamplingDecision {
+		if !strings.HasPrefix(p.Name, "Recv.") {
+			return def(p)
+		}
+		path := strings.TrimPrefix(p.Name, "Recv.")
+		match := -1
+		for i, prefix := range prefixes {
+			if strings.HasPrefix(path, prefix) && (match < 0 || len(prefix) > len(prefixes[match])) {
+				match = i
+			}
+		}
+		if match < 0 {
+			return def(p)
+		}
+		return samplers[match](p)
+	}
+}
+
+// AnySampler samples the spans sampled by any of samplers.
+func AnySampler(samplers ...trace.Sampler) trace.Sampler {
+	return func(p trace.SamplingParameters) trace.SamplingDecision {
+		for _, s := range samplers {
+			if s(p).Sample {
+				return trace.SamplingDecision{Sample: true}
+			}
+		}
+		return trace.SamplingDecision{Sample: false}
+	}
+}
+
+// RateLimitedSampler caps the traces sampled by sampler to qps per
+// second, with bursts of up to a second of traces. The spans with a
+// local parent follow the decision of their parent, so the sampled
+// traces are kept whole.
+func RateLimitedSampler(sampler trace.Sampler, qps float64) trace.Sampler {
+	burst := math.Max(qps, 1)
+	var (
+		mu     sync.Mutex
+		tokens = burst
+		last   = time.Now()
+	)
+	return func(p trace.SamplingParameters) trace.SamplingDecision {
+		if p.ParentContext != (trace.SpanContext{}) && !p.HasRemoteParent {
+			return trace.SamplingDecision{Sample: p.ParentContext.IsSampled()}
+		}
+		if !sampler(p).Sample {
+			return trace.SamplingDecision{Sample: false}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		tokens = math.Min(burst, tokens+now.Sub(last).Seconds()*qps)
+		last = now
+		if tokens < 1 {
+			return trace.SamplingDecision{Sample: false}
+		}
+		tokens--
+		return trace.SamplingDecision{Sample: true}
+	}
+}
+
+// ForceSampling returns the format reading the incoming traces with
+// format, marked sampled if the request has header, whatever its
+// value. Requests with the header and no trace start a new sampled
+// one.
+func ForceSampling(header string, format propagation.HTTPFormat) propagation.HTTPFormat {
+	return &forcedFormat{header: header, HTTPFormat: format}
+}
+
+type forcedFormat struct {
+	header string
+	propagation.HTTPFormat
+}
+
+func (f *forcedFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	sc, ok := f.HTTPFormat.SpanContextFromRequest(req)
+	if _, forced := req.Header[http.CanonicalHeaderKey(f.header)]; !forced {
+		return sc, ok
+	}
+	if !ok {
+		// A parent without span ID makes the server span a root.
+		sc = trace.SpanContext{}
+		if _, err := rand.Read(sc.TraceID[:]); err != nil {
+			return trace.SpanContext{}, false
+		}
+	}
+	sc.TraceOptions |= 1
+	return sc, true
+}
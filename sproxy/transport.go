@@ -0,0 +1,101 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sproxy contains the building blocks of the Stackdriver
+// reverse proxy for servers embedding it.
+//
+// New returns a proxy to a target, traced and measured like the
+// stackdriver-reverse-proxy command, to serve next to the other
+// handlers of the server:
+//
+//	view.Subscribe(ochttp.DefaultViews...)
+//	proxy, err := sproxy.New(sproxy.Config{
+//		Target:  target,
+//		Sampler: sproxy.ProbabilitySampler(0.1),
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	http.Handle("/api/", proxy)
+//
+// Servers can customize how the target is reached, e.g. to dial
+// through a VPC Service Controls aware path or to track the
+// connections:
+//
+//	proxy := httputil.NewSingleHostReverseProxy(target)
+//	proxy.Transport = sproxy.NewTransport(sproxy.TransportOptions{
+//		DialContext: trackingDialer.DialContext,
+//	})
+package sproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+)
+
+// DialContextFunc dials a connection to the target.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// TransportOptions configures the transport to the target.
+type TransportOptions struct {
+	// DialContext dials the connections to the target. If nil,
+	// the target is dialed like by http.DefaultTransport.
+	DialContext DialContextFunc
+
+	// Base is the RoundTripper sending the requests to the target,
+	// e.g. a transport tracking the requests. If nil, the transport
+	// returned by NewHTTPTransport is used. DialContext is ignored
+	// if Base is set.
+	Base http.RoundTripper
+}
+
+// NewTransport returns the transport to the target, instrumented
+// so that the requests to the target are traced and measured.
+func NewTransport(o TransportOptions) http.RoundTripper {
+	base := o.Base
+	if base == nil {
+		base = NewHTTPTransport(o.DialContext)
+	}
+	return &ochttp.Transport{Base: base}
+}
+
+// NewHTTPTransport returns a transport configured like
+// http.DefaultTransport except that it keeps as many idle connections
+// to the target as in total, since there is a single target. This
+// saves the TLS handshakes to https targets. The target is dialed
+// with dial, or like by http.DefaultTransport if dial is nil.
+func NewHTTPTransport(dial DialContextFunc) *http.Transport {
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       &tls.Config{},
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sproxytest provides utilities to test the telemetry of
+// servers embedding the Stackdriver reverse proxy: an in-memory
+// exporter recording spans and view data, a fake backend, and
+// assertions over what was recorded.
+package sproxytest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+// Exporter records the exported spans and view data in memory.
+type Exporter struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+	views map[string]*view.Data
+}
+
+// NewExporter returns an empty exporter. Use Install to
+// register it.
+func NewExporter() *Exporter {
+	return &Exporter{views: make(map[string]*view.Data)}
+}
+
+// Install registers e as a trace and view exporter, samples all
+// the traces and reports the views every reportingPeriod.
+// The returned function unregisters e and restores the default
+// sampler and reporting period. The trace and view packages don't
+// tell the ones set before Install, so it is those they start with,
+// sampling 1 in 10000 traces every 10s, that are restored.
+func (e *Exporter) Install(reportingPeriod time.Duration) (uninstall func()) {
+	trace.RegisterExporter(e)
+	view.RegisterExporter(e)
+	trace.SetDefaultSampler(trace.AlwaysSample())
+	view.SetReportingPeriod(reportingPeriod)
+	return func() {
+		trace.UnregisterExporter(e)
+		view.UnregisterExporter(e)
+		trace.SetDefaultSampler(nil)
+		view.SetReportingPeriod(0)
+	}
+}
+
+// ExportSpan implements trace.Exporter.
+func (e *Exporter) ExportSpan(sd *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, sd)
+}
+
+// ExportView implements view.Exporter. Only the latest
+// data of each view is kept.
+func (e *Exporter) ExportView(vd *view.Data) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.views[vd.View.Name] = vd
+}
+
+// Spans returns the spans exported so far.
+func (e *Exporter) Spans() []*trace.SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*trace.SpanData(nil), e.spans...)
+}
+
+// ViewData returns the latest data exported for the named view,
+// or nil if none was.
+func (e *Exporter) ViewData(name string) *view.Data {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.views[name]
+}
+
+// Reset forgets everything exported so far.
+func (e *Exporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+	e.views = make(map[string]*view.Data)
+}
+
+// WaitForSpans waits until at least n spans are exported.
+func (e *Exporter) WaitForSpans(n int, timeout time.Duration) ([]*trace.SpanData, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		spans := e.Spans()
+		if len(spans) >= n {
+			return spans, nil
+		}
+		if time.Now().After(deadline) {
+			return spans, fmt.Errorf("got %d spans after %v, want %d", len(spans), timeout, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WaitForView waits until data is exported for the named view.
+func (e *Exporter) WaitForView(name string, timeout time.Duration) (*view.Data, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if vd := e.ViewData(name); vd != nil {
+			return vd, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no data for view %q after %v", name, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// AssertSpan fails the test unless a span whose name starts with
+// prefix was exported, and returns the first one.
+func (e *Exporter) AssertSpan(t testing.TB, prefix string) *trace.SpanData {
+	t.Helper()
+	var names []string
+	for _, s := range e.Spans() {
+		if strings.HasPrefix(s.Name, prefix) {
+			return s
+		}
+		names = append(names, s.Name)
+	}
+	t.Fatalf("no span named %q*, got %q", prefix, names)
+	return nil
+}
+
+// AssertAttribute fails the test unless the span has the
+// attribute key set to want.
+func AssertAttribute(t testing.TB, s *trace.SpanData, key string, want interface{}) {
+	t.Helper()
+	got, ok := s.Attributes[key]
+	if !ok {
+		t.Errorf("span %q has no attribute %q", s.Name, key)
+		return
+	}
+	if got != want {
+		t.Errorf("span %q attribute %q = %v, want %v", s.Name, key, got, want)
+	}
+}
+
+// AssertCount fails the test unless the latest data of the named
+// count view has a row with the given tags and count.
+func (e *Exporter) AssertCount(t testing.TB, viewName string, tags map[string]string, want int64) {
+	t.Helper()
+	vd := e.ViewData(viewName)
+	if vd == nil {
+		t.Fatalf("no data for view %q", viewName)
+	}
+	for _, r := range vd.Rows {
+		if !rowHasTags(r, tags) {
+			continue
+		}
+		count, ok := r.Data.(*view.CountData)
+		if !ok {
+			t.Fatalf("view %q is not a count view", viewName)
+		}
+		if got := int64(*count); got != want {
+			t.Errorf("view %q %v count = %d, want %d", viewName, tags, got, want)
+		}
+		return
+	}
+	t.Errorf("view %q has no row with tags %v", viewName, tags)
+}
+
+func rowHasTags(r *view.Row, tags map[string]string) bool {
+	if len(r.Tags) != len(tags) {
+		return false
+	}
+	for _, t := range r.Tags {
+		if v, ok := tags[t.Key.Name()]; !ok || v != t.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// Backend is a fake backend recording the requests it receives.
+type Backend struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// NewBackend starts a backend serving with h, or responding
+// 200 OK if h is nil. Close it when done.
+func NewBackend(h http.Handler) *Backend {
+	if h == nil {
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		})
+	}
+	b := &Backend{}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		b.requests = append(b.requests, r)
+		b.mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	return b
+}
+
+// Requests returns the requests received so far. Their bodies
+// can't be read anymore.
+func (b *Backend) Requests() []*http.Request {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*http.Request(nil), b.requests...)
+}
+
+// AssertHeader fails the test unless the last request received
+// by the backend had the header set to want.
+func (b *Backend) AssertHeader(t testing.TB, header, want string) {
+	t.Helper()
+	reqs := b.Requests()
+	if len(reqs) == 0 {
+		t.Fatalf("backend received no request")
+	}
+	if got := reqs[len(reqs)-1].Header.Get(header); got != want {
+		t.Errorf("backend request header %v = %q, want %q", header, got, want)
+	}
+}
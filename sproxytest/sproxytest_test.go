@@ -0,0 +1,244 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sproxytest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/stackdriver-reverse-proxy/sproxy"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// newProxy starts a proxy to b whose middleware chain sets
+// X-Chained on the requests.
+func newProxy(t *testing.T, b *Backend) *httptest.Server {
+	target, err := url.Parse(b.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := &sproxy.Chain{}
+	chain.Use("chained", sproxy.OrderFilter, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("X-Chained", "yes")
+			h.ServeHTTP(w, r)
+		})
+	})
+	p, err := sproxy.New(sproxy.Config{Target: target, Middleware: chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(p)
+}
+
+func get(t *testing.T, url string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %v = %v, want 200 OK", url, resp.Status)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	v := ochttp.ServerResponseCountByStatusCode
+	if err := v.Subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Unsubscribe()
+	e := NewExporter()
+	defer e.Install(10 * time.Millisecond)()
+	b := NewBackend(nil)
+	defer b.Close()
+	p := newProxy(t, b)
+	defer p.Close()
+
+	get(t, p.URL+"/hello")
+
+	if _, err := e.WaitForSpans(2, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	recv := e.AssertSpan(t, "Recv./hello")
+	AssertAttribute(t, recv, ochttp.MethodAttribute, "GET")
+	sent := e.AssertSpan(t, "Sent.")
+	AssertAttribute(t, sent, ochttp.StatusCodeAttribute, int64(200))
+	if sent.ParentSpanID != recv.SpanID {
+		t.Errorf("client span parent = %v, want the server span %v", sent.ParentSpanID, recv.SpanID)
+	}
+	b.AssertHeader(t, "X-Chained", "yes")
+	b.AssertHeader(t, "X-Forwarded-Proto", "http")
+
+	// The response may arrive before the view data is exported.
+	tags := map[string]string{ochttp.StatusCode.Name(): "200"}
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasRow(e.ViewData(v.Name), tags) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.AssertCount(t, v.Name, tags, 1)
+}
+
+func hasRow(vd *view.Data, tags map[string]string) bool {
+	if vd == nil {
+		return false
+	}
+	for _, r := range vd.Rows {
+		if rowHasTags(r, tags) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReset(t *testing.T) {
+	e := NewExporter()
+	defer e.Install(time.Hour)()
+	b := NewBackend(nil)
+	defer b.Close()
+	p := newProxy(t, b)
+	defer p.Close()
+
+	get(t, p.URL+"/")
+	if _, err := e.WaitForSpans(2, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	e.Reset()
+	if spans := e.Spans(); len(spans) != 0 {
+		t.Errorf("got %d spans after Reset, want none", len(spans))
+	}
+	if _, err := e.WaitForSpans(1, 50*time.Millisecond); err == nil {
+		t.Error("WaitForSpans succeeded with no span exported")
+	}
+	if _, err := e.WaitForView("no-such-view", 50*time.Millisecond); err == nil {
+		t.Error("WaitForView succeeded with no data exported")
+	}
+	if got := len(b.Requests()); got != 1 {
+		t.Errorf("backend received %d requests, want 1", got)
+	}
+}
+
+func TestUninstall(t *testing.T) {
+	// The trace ID is above the bound of the default probability
+	// sampler, the parent is not sampled.
+	parent := trace.SpanContext{SpanID: trace.SpanID{1}}
+	for i := range parent.TraceID {
+		parent.TraceID[i] = 0xff
+	}
+	sampled := func() bool {
+		s := trace.NewSpanWithRemoteParent("span", parent, trace.StartOptions{})
+		defer s.End()
+		return s.SpanContext().IsSampled()
+	}
+
+	e := NewExporter()
+	uninstall := e.Install(time.Hour)
+	if !sampled() {
+		t.Error("span not sampled after Install")
+	}
+	uninstall()
+	if sampled() {
+		t.Error("span still sampled after uninstall")
+	}
+	if spans := e.Spans(); len(spans) != 1 {
+		t.Errorf("got %d spans, want only the one ended before uninstall", len(spans))
+	}
+}
+
+// fakeTB records the failures of the assertions.
+type fakeTB struct {
+	testing.TB
+	failures []string
+}
+
+func (tb *fakeTB) Helper() {}
+
+func (tb *fakeTB) Errorf(format string, args ...interface{}) {
+	tb.failures = append(tb.failures, fmt.Sprintf(format, args...))
+}
+
+func (tb *fakeTB) Fatalf(format string, args ...interface{}) {
+	tb.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+// failures runs assert with a fakeTB and returns its failures.
+func failures(assert func(tb testing.TB)) []string {
+	tb := &fakeTB{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert(tb)
+	}()
+	<-done
+	return tb.failures
+}
+
+func TestAssertionsFail(t *testing.T) {
+	e := NewExporter()
+	e.ExportSpan(&trace.SpanData{
+		Name:       "Recv./",
+		Attributes: map[string]interface{}{"http.method": "GET"},
+	})
+	e.ExportView(&view.Data{
+		View: &view.View{Name: "count"},
+		Rows: []*view.Row{{
+			Tags: []tag.Tag{{Key: ochttp.StatusCode, Value: "200"}},
+			Data: newCount(2),
+		}},
+	})
+	b := NewBackend(nil)
+	defer b.Close()
+	get(t, b.URL)
+
+	tests := []struct {
+		name   string
+		assert func(tb testing.TB)
+		fail   bool
+	}{
+		{"span", func(tb testing.TB) { e.AssertSpan(tb, "Recv.") }, false},
+		{"missing span", func(tb testing.TB) { e.AssertSpan(tb, "Sent.") }, true},
+		{"attribute", func(tb testing.TB) { AssertAttribute(tb, e.Spans()[0], "http.method", "GET") }, false},
+		{"wrong attribute", func(tb testing.TB) { AssertAttribute(tb, e.Spans()[0], "http.method", "POST") }, true},
+		{"missing attribute", func(tb testing.TB) { AssertAttribute(tb, e.Spans()[0], "http.path", "/") }, true},
+		{"count", func(tb testing.TB) { e.AssertCount(tb, "count", map[string]string{"http.status": "200"}, 2) }, false},
+		{"wrong count", func(tb testing.TB) { e.AssertCount(tb, "count", map[string]string{"http.status": "200"}, 1) }, true},
+		{"missing row", func(tb testing.TB) { e.AssertCount(tb, "count", map[string]string{"http.status": "500"}, 2) }, true},
+		{"missing view", func(tb testing.TB) { e.AssertCount(tb, "other", nil, 0) }, true},
+		{"header", func(tb testing.TB) { b.AssertHeader(tb, "X-Chained", "") }, false},
+		{"wrong header", func(tb testing.TB) { b.AssertHeader(tb, "X-Chained", "yes") }, true},
+	}
+	for _, tt := range tests {
+		got := failures(tt.assert)
+		if failed := len(got) > 0; failed != tt.fail {
+			t.Errorf("%v: failures %q, want failing %v", tt.name, got, tt.fail)
+		}
+	}
+}
+
+func newCount(n int64) *view.CountData {
+	c := view.CountData(n)
+	return &c
+}